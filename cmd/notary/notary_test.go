@@ -2,9 +2,11 @@ package notary_test
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/vsekhar/fabula/cmd/notary"
+	"github.com/vsekhar/fabula/internal/logstore"
 )
 
 func Example() {
@@ -28,3 +30,26 @@ func TestNotarize(t *testing.T) {
 		t.Errorf("Bad signature")
 	}
 }
+
+func TestLog(t *testing.T) {
+	store, err := logstore.OpenLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	svc, err := notary.NewServiceWithStore(store, "NA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want notary.Log
+	for _, data := range []string{"a", "b", "c"} {
+		n, err := svc.Notarize([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, n.Signature)
+	}
+	if got := svc.Log(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %x, got %x", want, got)
+	}
+}
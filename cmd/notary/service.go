@@ -1,31 +1,51 @@
 package notary
 
 import (
+	"context"
 	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha3"
+	"encoding/hex"
 	"io"
 
+	"github.com/vsekhar/fabula/internal/logstore"
 	"github.com/vsekhar/fabula/internal/truetimeish"
 )
 
 // TODO: Service may need to store salt and timestamps in order to validate
 // timestamp monotonicity.
 
+// DefaultRegion is the region of the log of a Service created with
+// NewService.
+const DefaultRegion = "local"
+
 // Service is a verifiable notary service.
 type Service struct {
 	publicKey  ed25519.PublicKey
 	privateKey ed25519.PrivateKey
 	log        [][]byte // MMR
+	store      logstore.Interface
+	region     string
 }
 
-// NewService returns a new notary Service.
+// NewService returns a new notary Service with its log in memory.
 func NewService() (*Service, error) {
-	return newServiceFromRand(nil)
+	store, err := logstore.OpenLocal("")
+	if err != nil {
+		return nil, err
+	}
+	return NewServiceWithStore(store, DefaultRegion)
+}
+
+// NewServiceWithStore returns a new notary Service that appends notarizations
+// to the log of region in store.
+func NewServiceWithStore(store logstore.Interface, region string) (*Service, error) {
+	return newServiceFromRand(nil, store, region)
 }
 
-func newServiceFromRand(rand io.Reader) (*Service, error) {
-	n := new(Service)
+func newServiceFromRand(rand io.Reader, store logstore.Interface, region string) (*Service, error) {
+	n := &Service{store: store, region: region}
 	var err error
 	n.publicKey, n.privateKey, err = ed25519.GenerateKey(rand)
 	if err != nil {
@@ -60,11 +80,24 @@ func (s *Service) notarizeImpl(p ProofEntry, b []byte) (n Notarization, err erro
 	}
 	n.Timestamp = ts.Timestamp()
 	n.PublicKey = s.publicKey
+
+	// Notarizations are appended to the store by the hash of their
+	// signature, in the prefix chain given by its first hex digit. The
+	// second hex digit gives the chain interlocked with it.
+	h := sha3.Sum512(n.Signature)
+	x := hex.EncodeToString(h[:1])
+	pfx, crossPrefix := x[:1], x[1:]
+	if crossPrefix == pfx {
+		crossPrefix = ""
+	}
+	if _, err := s.store.Append(context.Background(), s.region, pfx, crossPrefix, h[:]); err != nil {
+		return Notarization{}, err
+	}
 	s.log = append(s.log, n.Signature)
 	return n, nil
 }
 
-// Log returns the full notary log and its digest.
+// Log returns the full notary log.
 func (s *Service) Log() Log {
 	return s.log
 }
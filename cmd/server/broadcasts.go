@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vsekhar/fabula/internal/digest"
+	"github.com/vsekhar/fabula/internal/peerbook"
+	"github.com/vsekhar/fabula/internal/peerbook/broadcast"
+	"github.com/vsekhar/fabula/internal/prefixlease"
+	"github.com/vsekhar/fabula/pkg/api/broadcastpb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Servers share prefix digests and prefix leases using typed broadcasts (see
+// api/broadcast.proto).
+
+func digestToPB(d digest.Prefix) *broadcastpb.PrefixDigest {
+	return &broadcastpb.PrefixDigest{
+		Region:        d.Region,
+		Prefix:        d.Prefix,
+		Entries:       d.Entries,
+		LastTimestamp: timestamppb.New(d.LastTimestamp),
+		Sha3512:       d.SHA3512,
+	}
+}
+
+func digestFromPB(m *broadcastpb.PrefixDigest) digest.Prefix {
+	return digest.Prefix{
+		Region:        m.Region,
+		Prefix:        m.Prefix,
+		Entries:       m.Entries,
+		LastTimestamp: m.LastTimestamp.AsTime(),
+		SHA3512:       m.Sha3512,
+	}
+}
+
+func leaseToPB(l prefixlease.Lease) *broadcastpb.PrefixLease {
+	return &broadcastpb.PrefixLease{
+		Region:  l.Region,
+		Prefix:  l.Prefix,
+		Epoch:   l.Epoch,
+		Owner:   l.Owner,
+		Expires: timestamppb.New(l.Expires),
+	}
+}
+
+func leaseFromPB(m *broadcastpb.PrefixLease) prefixlease.Lease {
+	return prefixlease.Lease{
+		Region:  m.Region,
+		Prefix:  m.Prefix,
+		Epoch:   m.Epoch,
+		Owner:   m.Owner,
+		Expires: m.Expires.AsTime(),
+	}
+}
+
+// newBroadcasts returns a broadcast registry sending via peers and updating
+// digests and leases with broadcasts received from peers.
+func newBroadcasts(peers *peerbook.PeerBook, digests *digest.Table, leases *prefixlease.Table) *broadcast.Registry {
+	r := broadcast.New(peers)
+
+	// A prefix chain only grows, so older digests of the same chain can be
+	// dropped.
+	r.Register(&broadcastpb.PrefixDigest{}, func(m proto.Message) string {
+		d := m.(*broadcastpb.PrefixDigest)
+		return d.Region + ":" + d.Prefix
+	}, func(_ uint64, m proto.Message) {
+		digests.Update(digestFromPB(m.(*broadcastpb.PrefixDigest)))
+	})
+
+	// Leases are not ordered by Lamport time since concurrent claims must be
+	// resolved the same way by every peer regardless of the order in which
+	// they are received (see prefixlease.Table.Observe).
+	r.Register(&broadcastpb.PrefixLease{}, nil, func(_ uint64, m proto.Message) {
+		leases.Observe(leaseFromPB(m.(*broadcastpb.PrefixLease)))
+	})
+
+	peers.BroadcastHandler = func(ltime peerbook.LamportTime, name string, payload []byte, _ bool) {
+		err := r.Handle(uint64(ltime), name, payload)
+		switch {
+		case errors.Is(err, broadcast.ErrUnregistered):
+			log.WithField("name", name).Debug("main: unknown broadcast")
+		case err != nil:
+			log.WithError(err).WithField("name", name).Error("main: bad broadcast")
+		}
+	}
+	return r
+}
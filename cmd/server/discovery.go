@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vsekhar/fabula/internal/peerbook"
+	"github.com/vsekhar/fabula/internal/peerbook/discovery"
+	"github.com/vsekhar/fabula/internal/peerbook/discovery/k8s"
+)
+
+// instanceName returns the name of this server among its peers.
+func instanceName() (string, error) {
+	if *nameFlag != "" {
+		return *nameFlag, nil
+	}
+	if name, ok := os.LookupEnv("K8S_POD_NAME"); ok && name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
+
+// newDiscoverer returns the peerbook.Discoverer described by spec, or nil if
+// peers should not be discovered.
+//
+// Specs are of the form:
+//
+//	k8s[:<label selector>]       pods in the namespace in K8S_NAMESPACE, or
+//	                             this pod's namespace
+//	dns:<name>                   DNS SRV records for name
+//	file:<path>                  addresses listed in a file, one per line
+//	static:<host:port>[,...]     a fixed list of addresses
+//
+// An empty spec discovers pods if running in a Kubernetes cluster and nothing
+// otherwise, or if pods cannot be discovered.
+func newDiscoverer(spec string) (peerbook.Discoverer, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "":
+		d, err := k8s.InCluster("", *controlPort)
+		if errors.Is(err, k8s.ErrNotInCluster) {
+			return nil, nil
+		}
+		if err != nil {
+			// Discovery was not asked for, so don't fail without it.
+			log.WithError(err).Warn("main: not discovering pods")
+			return nil, nil
+		}
+		return d, nil
+	case "k8s":
+		return k8s.InCluster(arg, *controlPort)
+	case "dns":
+		if arg == "" {
+			return nil, errors.New("dns discovery requires a name")
+		}
+		return discovery.DNSSRV{Name: arg}, nil
+	case "file":
+		if arg == "" {
+			return nil, errors.New("file discovery requires a path")
+		}
+		return discovery.File{Path: arg, DefaultPort: *controlPort}, nil
+	case "static":
+		if arg == "" {
+			return nil, errors.New("static discovery requires addresses")
+		}
+		return discovery.Static(strings.Split(arg, ",")), nil
+	default:
+		return nil, fmt.Errorf("unknown discovery kind '%s'", kind)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/vsekhar/fabula/internal/api"
+	"github.com/vsekhar/fabula/internal/peerbook"
+	"github.com/vsekhar/fabula/internal/prefix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Any server can accept any Pack request. Requests are forwarded to the server
+// owning the request's prefix according to the peerbook's hash ring.
+//
+// Servers may briefly disagree about the ring while membership changes. To
+// avoid forwarding loops, a forwarded request is never forwarded again. The
+// receiving server either handles it or, if it does not hold a lease on the
+// prefix (see leases.go), refuses it and the forwarding server retries.
+
+const (
+	packRPCPortTag = "fabula-pack-rpc-port"
+
+	// forwardedMetadataKey is set on Pack requests forwarded from another
+	// server.
+	forwardedMetadataKey = "fabula-forwarded"
+
+	maxForwardAttempts = 3
+	forwardBackoff     = 100 * time.Millisecond
+)
+
+// peerConn is the peer object cached for each peer.
+type peerConn struct {
+	conn   *grpc.ClientConn
+	packer pb.PackerClient
+}
+
+func newPeerConn(ctx context.Context) func(name string, addr net.IP, tags map[string]string) (interface{}, error) {
+	return func(name string, addr net.IP, tags map[string]string) (interface{}, error) {
+		port, ok := tags[packRPCPortTag]
+		if !ok {
+			return nil, fmt.Errorf("peer %s does not have '%s' tag", name, packRPCPortTag)
+		}
+		conn, err := grpc.DialContext(ctx, net.JoinHostPort(addr.String(), port), grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		return &peerConn{conn: conn, packer: pb.NewPackerClient(conn)}, nil
+	}
+}
+
+func destroyPeerConn(name string, obj interface{}) {
+	if err := obj.(*peerConn).conn.Close(); err != nil {
+		log.WithError(err).WithField("peer_name", name).Error("main: closing peer connection")
+	}
+}
+
+// packForwarder serves Pack requests locally if this server owns the prefix
+// and forwards them to the owning server otherwise.
+type packForwarder struct {
+	peers *peerbook.PeerBook
+	name  string // of this server
+	local *packServer
+
+	pb.UnimplementedPackerServer
+}
+
+func forwarded(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(forwardedMetadataKey)) > 0
+}
+
+func (f *packForwarder) Pack(ctx context.Context, r *pb.PackRequest) (*pb.PackResponse, error) {
+	if forwarded(ctx) {
+		return f.local.Pack(ctx, r)
+	}
+	p := prefix.ToString(r.Document, prefix.LengthNibbles)
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardedMetadataKey, f.name)
+	var err error
+	var failedOwner string // owner whose connection failed on the last attempt
+	for attempt := 0; attempt < maxForwardAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+				}
+				return nil, status.Error(codes.Canceled, ctx.Err().Error())
+			case <-time.After(time.Duration(attempt) * forwardBackoff):
+			}
+		}
+
+		// Look up the owner on each attempt in case the ring has changed.
+		var owner peerbook.Peer
+		owner, err = f.peers.GetPeer(ctx, p)
+		if err != nil {
+			failedOwner = ""
+			err = status.Errorf(codes.Unavailable, "looking up owner of prefix %s: %s", p, err)
+			continue
+		}
+		if owner.Name == f.name {
+			return f.local.Pack(ctx, r)
+		}
+
+		// The connection to a peer is shared by all requests to it, so it is
+		// only replaced after it has failed.
+		var obj interface{}
+		if owner.Name == failedOwner {
+			obj, err = f.peers.RefreshPeerObject(ctx, p)
+		} else {
+			obj, err = f.peers.GetPeerObject(ctx, p)
+		}
+		failedOwner = ""
+		if err != nil {
+			err = status.Errorf(codes.Unavailable, "connecting to %s: %s", owner.Name, err)
+			continue
+		}
+		pc := obj.(*peerConn)
+		var resp *pb.PackResponse
+		resp, err = pc.packer.Pack(ctx, r)
+		switch status.Code(err) {
+		case codes.Unavailable:
+			if s := pc.conn.GetState(); s == connectivity.TransientFailure || s == connectivity.Shutdown {
+				failedOwner = owner.Name
+			}
+		case codes.FailedPrecondition:
+			// The peer refused the request as it does not hold a lease on
+			// the prefix. The ring may be changing.
+		default:
+			return resp, err
+		}
+		log.WithError(err).WithField("peer_name", owner.Name).Warn("main: forwarding pack request, retrying")
+	}
+	return nil, err
+}
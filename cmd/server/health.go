@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kubernetes restarts pods that fail liveness checks and stops routing traffic
+// to pods that fail readiness checks. Liveness checks should only fail if a
+// restart would help. Readiness checks fail whenever the server cannot serve
+// (e.g. while starting up or if a dependency is unreachable).
+
+const (
+	healthCheckTimeout  = 2 * time.Second
+	maxClockUncertainty = 50 * time.Millisecond
+)
+
+type healthCheck func(ctx context.Context) error
+
+// health runs named liveness and readiness checks.
+//
+// It is safe to use health from multiple goroutines, and checks can be added
+// after its handlers are serving.
+type health struct {
+	mu        sync.Mutex
+	liveness  map[string]healthCheck
+	readiness map[string]healthCheck
+	started   bool
+}
+
+func newHealth() *health {
+	return &health{
+		liveness:  make(map[string]healthCheck),
+		readiness: make(map[string]healthCheck),
+	}
+}
+
+func (h *health) addLiveness(name string, c healthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.liveness[name] = c
+}
+
+func (h *health) addReadiness(name string, c healthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readiness[name] = c
+}
+
+// setStarted marks the server as having completed startup. The server is not
+// ready until setStarted is called, so that traffic is not routed to it before
+// all readiness checks are registered.
+func (h *health) setStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = true
+}
+
+// run runs checks concurrently and returns their errors by name.
+func run(ctx context.Context, checks map[string]healthCheck) map[string]error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	mu := new(sync.Mutex)
+	errs := make(map[string]error, len(checks))
+	wg := new(sync.WaitGroup)
+	wg.Add(len(checks))
+	for name, c := range checks {
+		go func(name string, c healthCheck) {
+			defer wg.Done()
+			err := c(ctx)
+			mu.Lock()
+			errs[name] = err
+			mu.Unlock()
+		}(name, c)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (h *health) handler(readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		checks := h.liveness
+		if readiness {
+			checks = h.readiness
+		}
+		cs := make(map[string]healthCheck, len(checks))
+		for name, c := range checks {
+			cs[name] = c
+		}
+		started := h.started
+		h.mu.Unlock()
+
+		errs := run(r.Context(), cs)
+		if readiness && !started {
+			errs["startup"] = fmt.Errorf("not started")
+		}
+		names := make([]string, 0, len(errs))
+		code := http.StatusOK
+		for name, err := range errs {
+			names = append(names, name)
+			if err != nil {
+				code = http.StatusServiceUnavailable
+			}
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		for _, name := range names {
+			if err := errs[name]; err != nil {
+				fmt.Fprintf(w, "%s: %s\n", name, err)
+				continue
+			}
+			fmt.Fprintf(w, "%s: ok\n", name)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vsekhar/fabula/internal/peerbook"
+	"github.com/vsekhar/fabula/internal/peerbook/broadcast"
+	"github.com/vsekhar/fabula/internal/prefixlease"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Servers lease the prefixes they pack (see package prefixlease) so that only
+// one server packs a prefix chain at a time, even while servers disagree about
+// the hash ring during membership changes. Storage preconditions remain the
+// last line of defence against concurrent writes.
+
+const (
+	leaseDuration    = 10 * time.Second
+	leaseRenewPeriod = 3 * time.Second
+)
+
+type prefixLeaser struct {
+	name   string // of this server
+	region string
+	table  *prefixlease.Table
+	peers  *peerbook.PeerBook
+	bcast  *broadcast.Registry
+}
+
+// owns returns true if this server owns prefix according to the hash ring.
+func (l *prefixLeaser) owns(ctx context.Context, prefix string) (bool, error) {
+	owner, err := l.peers.GetPeer(ctx, prefix)
+	if err != nil {
+		return false, err
+	}
+	return owner.Name == l.name, nil
+}
+
+func (l *prefixLeaser) held(prefix string) bool {
+	return l.table.Held(l.region, prefix, l.name, time.Now())
+}
+
+func (l *prefixLeaser) broadcast(lease prefixlease.Lease) {
+	if err := l.bcast.Send(leaseToPB(lease), false); err != nil {
+		log.WithError(err).WithField("prefix", lease.Prefix).Error("main: broadcasting prefix lease")
+	}
+}
+
+// acquire ensures this server holds a lease on prefix, claiming one if this
+// server owns prefix according to the hash ring. Refusals are gRPC status
+// errors with code FailedPrecondition, so that forwarding servers retry
+// without mistaking them for a failed connection.
+func (l *prefixLeaser) acquire(ctx context.Context, prefix string) error {
+	if l.held(prefix) {
+		return nil
+	}
+	owns, err := l.owns(ctx, prefix)
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "looking up owner of prefix %s: %s", prefix, err)
+	}
+	if !owns {
+		return status.Errorf(codes.FailedPrecondition, "prefix %s is not owned by %s", prefix, l.name)
+	}
+	lease, err := l.table.Claim(l.region, prefix, l.name, time.Now(), leaseDuration)
+	if err == prefixlease.ErrLeased {
+		cur, _ := l.table.Get(l.region, prefix)
+		return status.Errorf(codes.FailedPrecondition, "prefix %s is leased to %s until %s", prefix, cur.Owner, cur.Expires)
+	}
+	if err == prefixlease.ErrNotSynced {
+		return status.Errorf(codes.FailedPrecondition, "prefix %s: %s", prefix, err)
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	l.broadcast(lease)
+	return nil
+}
+
+// renew extends this server's lease on prefix. It returns false if the lease
+// has been lost.
+func (l *prefixLeaser) renew(prefix string) bool {
+	if !l.held(prefix) {
+		return false
+	}
+	lease, err := l.table.Claim(l.region, prefix, l.name, time.Now(), leaseDuration)
+	if err != nil {
+		return false
+	}
+	l.broadcast(lease)
+	return true
+}
+
+// release releases this server's lease on prefix so the new owner need not
+// wait for it to expire.
+func (l *prefixLeaser) release(prefix string) {
+	if lease, ok := l.table.Release(l.region, prefix, l.name, time.Now()); ok {
+		l.broadcast(lease)
+	}
+}
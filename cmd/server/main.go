@@ -8,27 +8,29 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 
-	"github.com/golang/groupcache/consistenthash"
+	"github.com/dgryski/go-maglev"
 	"github.com/gorilla/handlers"
-	lru "github.com/hashicorp/golang-lru"
 	"github.com/kenshaw/sdhook"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
 	"google.golang.org/grpc"
 
-	"github.com/hashicorp/serf/cmd/serf/command/agent"
-	"github.com/hashicorp/serf/serf"
-
 	"cloud.google.com/go/storage"
 
 	internalapi "github.com/vsekhar/fabula/internal/api"
+	"github.com/vsekhar/fabula/internal/atomicwriter"
+	"github.com/vsekhar/fabula/internal/digest"
+	"github.com/vsekhar/fabula/internal/entryindex"
 	"github.com/vsekhar/fabula/internal/interrupt"
+	"github.com/vsekhar/fabula/internal/peerbook"
+	"github.com/vsekhar/fabula/internal/peerbook/broadcast"
+	"github.com/vsekhar/fabula/internal/prefixlease"
+	"github.com/vsekhar/fabula/internal/youtime"
 	"github.com/vsekhar/fabula/pkg/api/servicepb"
 )
 
@@ -38,89 +40,46 @@ var (
 	packRPCPort     = flag.Int("packrpcport", 0, "rpc port for packing (default: auto)")
 	controlPort     = flag.Int("controlport", 7946, "rpc port for P2P cluster control")
 	bucketName      = flag.String("bucket", "", "bucket to store sequence to (e.g. 'gcs://bucket_name')")
+	storeURI        = flag.String("store", "", "local directory or 's3://bucket/prefix' URI to store sequence to instead of -bucket")
+	regionName      = flag.String("region", "", "Fabula region served by this server (default: from FABULA_REGION or GCP metadata)")
+	tokenKeyring    = flag.String("tokenkeyring", "", "path to the keyring for issuing and redeeming access tokens (default: no access control)")
+	ringKind        = flag.String("ring", "consistenthash", "how to assign prefixes to servers: 'consistenthash' or 'maglev' (must match across servers)")
 	join            = flag.String("join", "", "internal host:port of other servers to join with")
+	discoverySpec   = flag.String("discovery", "", "how to discover other servers: 'k8s[:selector]', 'dns:name', 'file:path' or 'static:host:port,...' (default: k8s if in a cluster)")
+	nameFlag        = flag.String("name", "", "name of this server among its peers (default: from K8S_POD_NAME or hostname)")
 	userEventPeriod = flag.Duration("usereventperiod", time.Duration(0), "period with which to send a user event")
 	verbose         = flag.Bool("verbose", false, "verbose log level")
 	dev             = flag.Bool("dev", false, "dev mode (human-readable) logging")
 )
 
-// The number of shards to divide the keyspace into for each server in the
-// cluster. A higher number will ensure a more evently divided keyspace for
-// smaller numbers of servers. There is no real cost to having a very high
-// number since keys are discrete and independent: we don't gain anything by
-// having nearby keys in the keyspace allocated to the same server, only that
-// individual keys are consistently allocated to the same server on each client.
-const shardsPerServer = 100
-
-const memberTimer = 10 * time.Second
-
 const role = "fabula-server"
 
-type ringMux struct {
-	memberFn func() []serf.Member
-	ring     atomic.Value  // *consistenthash.Map[string(prefix)]string(name)
-	members  *sync.Map     // map[string(name)]serf.Member
-	clients  *lru.ARCCache // effectively map[string(name)]*client
-}
-
-// safe to call from multiple goroutines
-func (r *ringMux) updateMembers() {
-	members := r.memberFn()
-	alive := 0
-	for _, m := range members {
-		if m.Status == serf.StatusAlive {
-			alive++
+// Servers periodically broadcast the digests of the prefix chains they handle
+// so that every server can report regional and global digests.
+const digestBroadcastPeriod = 5 * time.Second
+
+// broadcastDigests broadcasts the digests of prefix chains handled by s that
+// have changed since the last broadcast, until ctx is cancelled.
+func broadcastDigests(ctx context.Context, bcast *broadcast.Registry, s *packServer) {
+	sent := make(map[string]uint64) // map[prefix]entries
+	t := time.NewTicker(digestBroadcastPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
 		}
-	}
-
-	nameMap := make(map[string]struct{})
-	addrMap := make(map[string]struct{})
-	for _, m := range members {
-		if m.Tags["role"] == role &&
-			m.Status == serf.StatusAlive {
-			if m.Name == "" || m.Addr.String() == "" {
+		for _, d := range s.digests() {
+			if n, ok := sent[d.Prefix]; ok && n == d.Entries {
 				continue
 			}
-			addrMap[m.Addr.String()] = struct{}{}
-			nameMap[m.Name] = struct{}{}
-			r.members.Store(m.Name, m)
-		}
-	}
-	names := make([]string, 0, len(nameMap))
-	for name := range nameMap {
-		log.Printf("[DEBUG] found member: %s", name)
-		names = append(names, name)
-	}
-
-	// package consistenthash refers to shardsPerServer as "replicas" which
-	// isn't really accurate since there is no replication involved.
-	newRing := consistenthash.New(shardsPerServer /* "replicas" */, nil)
-	newRing.Add(names...)
-	r.ring.Store(newRing)
-
-	// Prevent members map from growing endlessley.
-	r.members.Range(func(key, value interface{}) bool {
-		name := key.(string)
-		if _, ok := nameMap[name]; !ok {
-			r.members.Delete(key)
-			log.Printf("[DEBUG] dropping member: %s", name)
+			if err := bcast.Send(digestToPB(d), false); err != nil {
+				log.WithError(err).Error("main: broadcasting prefix digest")
+				continue
+			}
+			sent[d.Prefix] = d.Entries
 		}
-		return true // continue with range call
-	})
-	log.Printf("[DEBUG] main: hashring size: %d - %#v", len(addrMap), addrMap)
-}
-
-// TODO: redirecting via ringMux
-
-// Handle a serf.Event.
-//
-// Implements interface agent.EventHandler.
-func (r *ringMux) HandleEvent(e serf.Event) {
-	switch x := e.(type) {
-	case serf.MemberEvent:
-		r.updateMembers()
-	case serf.UserEvent:
-		log.Printf("[INFO] User event received: %+v", x)
 	}
 }
 
@@ -169,136 +128,166 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	name, err := getPodName()
+	name, err := instanceName()
 	if err != nil {
-		log.WithError(err).Fatal("could not get pod name")
+		log.WithError(err).Fatal("could not get instance name")
 	}
 	log.Printf("instance name: %s", name)
 
-	if *bucketName == "" {
-		log.Fatalf("[ERROR] -bucket required")
+	if *bucketName == "" && *storeURI == "" {
+		log.Fatalf("[ERROR] -bucket or -store required")
 	}
 
-	// TODO: fix this to get the pod hostname
+	region := *regionName
+	if region == "" {
+		region, err = getRegion()
+		if err != nil {
+			log.WithError(err).Fatal("could not get region")
+		}
+	} else if !isServingRegion(region) {
+		log.Fatalf("[ERROR] -region: '%s' is not a region that can be served (one of %s)", region, strings.Join(regions(), ", "))
+	}
+	log.Printf("region: %s", region)
+	digests := digest.NewTable()
 
-	var a *agent.Agent // forward declare for handlers
+	// Storage
+	var store, spentStore atomicwriter.DriverInterface
+	if *storeURI != "" {
+		store, err = atomicwriter.NewDriver(ctx, *storeURI)
+		if err != nil {
+			log.Fatalf("[ERROR] main: opening store: %s", err)
+		}
+		spentStore, err = atomicwriter.NewDriver(ctx, strings.TrimSuffix(*storeURI, "/")+"/spent-tokens")
+		if err != nil {
+			log.Fatalf("[ERROR] main: opening spent token store: %s", err)
+		}
+	} else {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			log.Fatalf("[ERROR] main: creating storage client: %s", err)
+		}
+		cred, err := google.FindDefaultCredentials(ctx)
+		if err != nil {
+			log.Fatalf("[ERROR] main: getting default credentials: %s", err)
+		}
+		bkt := client.Bucket(*bucketName).UserProject(cred.ProjectID)
+		store = atomicwriter.NewBucketDriver(bkt, "")
+		spentStore = atomicwriter.NewBucketDriver(bkt, "spent-tokens")
+	}
 
-	// Web service
+	entryIndex := entryindex.NewBucket(store)
+
+	// Access control
+	var tokens *tokenServer
+	if *tokenKeyring != "" {
+		tokens, err = newTokenServer(ctx, *tokenKeyring, &driverSpentStore{driver: spentStore}, os.Getenv("FABULA_TOKEN_ISSUANCE_KEY"))
+		if err != nil {
+			log.Fatalf("[ERROR] main: loading token keyring: %s", err)
+		}
+	} else {
+		log.Printf("[WARN] main: -tokenkeyring not set, access control disabled")
+	}
+
+	// Listeners are opened first so their ports can be advertised to peers.
 	weblistener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		log.Fatalf("main: opening web listen port %d: %s", *port, err)
 	}
-
-	notarizeSvr := newNotarizeServer(name, a)
-	websrv := &http.Server{
-		Addr:    weblistener.Addr().String(),
-		Handler: handlers.LoggingHandler(os.Stdout, notarizeSvr),
-	}
-	go websrv.Serve(weblistener)
-	defer websrv.Shutdown(ctx)
-	log.Printf("[INFO] main: web server listening at %s", websrv.Addr)
-
 	_, webListenerPort, err := net.SplitHostPort(weblistener.Addr().String())
 	if err != nil {
 		log.Fatalf("[ERROR] main: splitting web addr:port: %s", err)
 	}
-
-	// RPC notarize service
 	rpcNotarizeListener, err := net.Listen("tcp", fmt.Sprintf(":%d", *notarizeRPCPort))
 	if err != nil {
 		log.Fatalf("[ERROR] main: opening notarize rpc listen port %d: %s", *notarizeRPCPort, err)
 	}
-	_ = rpcNotarizeListener
-	notarizerpcsrv := grpc.NewServer(
-		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
-		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
-	)
-	notarizesvr := newNotarizeServer(name, a)
-	servicepb.RegisterFabulaServer(notarizerpcsrv, notarizesvr)
-	go notarizerpcsrv.Serve(rpcNotarizeListener)
-	defer notarizerpcsrv.Stop()
-	log.Printf("[INFO] main: notarize rpc server listening at %s", rpcNotarizeListener.Addr())
-
 	_, notarizeRPCListenerPort, err := net.SplitHostPort(rpcNotarizeListener.Addr().String())
 	if err != nil {
-		log.Fatalf("[ERROR] main: splitting addr:port: %w", err)
+		log.Fatalf("[ERROR] main: splitting addr:port: %s", err)
 	}
-
-	// Pack service storage
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		log.Fatalf("[ERROR] main: creating storage client: %s", err)
-	}
-	cred, err := google.FindDefaultCredentials(ctx)
-	if err != nil {
-		log.Fatalf("[ERROR] main: getting default credentials: %s", err)
-	}
-	bkt := client.Bucket(*bucketName).UserProject(cred.ProjectID)
-
-	// RPC pack service
 	rpclistener, err := net.Listen("tcp", fmt.Sprintf(":%d", *packRPCPort))
 	if err != nil {
 		log.Fatalf("[ERROR] main: opening pack rpc listen port %d: %s", *packRPCPort, err)
 	}
-	packrpcsrv := grpc.NewServer()
-	packsvr := newPackServer(ctx, bkt)
-	internalapi.RegisterPackerServer(packrpcsrv, packsvr)
-	go packrpcsrv.Serve(rpclistener)
-	defer packrpcsrv.Stop()
-	log.Printf("[INFO] main: pack rpc server listening at %s", rpclistener.Addr())
-
 	_, packRPCListenerPort, err := net.SplitHostPort(rpclistener.Addr().String())
 	if err != nil {
-		log.Fatalf("[ERROR] main: splitting addr:port: %w", err)
+		log.Fatalf("[ERROR] main: splitting addr:port: %s", err)
 	}
 
 	// Set up internal gossip network
 	log.Printf("[INFO] main: using control port: %d", *controlPort)
-	serfConfig := serf.DefaultConfig()
-	serfConfig.NodeName = name
-	serfConfig.MemberlistConfig.BindAddr = "0.0.0.0"
-	serfConfig.MemberlistConfig.BindPort = *controlPort
-	// serfConfig.Logger = stdLogger
-	serfConfig.Tags = map[string]string{
+	var ring peerbook.RingFunc
+	switch *ringKind {
+	case "consistenthash":
+		ring = peerbook.ConsistentHashRing(peerbook.DefaultShardsPerServer)
+	case "maglev":
+		ring = peerbook.MaglevRing(maglev.SmallM)
+	default:
+		log.Fatalf("[ERROR] -ring: unknown ring '%s'", *ringKind)
+	}
+	peers, err := peerbook.New(ctx, name, *controlPort, map[string]string{
 		"role":                     role,
+		"fabula-region":            region,
 		"fabula-notarize-web-port": webListenerPort,
 		"fabula-notarize-rpc-port": notarizeRPCListenerPort,
-		"fabula-pack-rpc-port":     packRPCListenerPort,
-	}
-	agentConfig := agent.DefaultConfig()
-	agentConfig.Discover = "serf.server.fabula-2020-12-14.svc.cluster.local"
-	agentConfig.NodeName = name
-	agentConfig.BindAddr = fmt.Sprintf("0.0.0.0:%d", *controlPort) // seems unused
-	agentConfig.LogLevel = "ERROR"                                 // seems unused
-	// agentConfig.Tags seems unused
-	a, err = agent.Create(agentConfig, serfConfig, os.Stderr)
+		packRPCPortTag:             packRPCListenerPort,
+	}, peerbook.WithRing(ring))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer a.Shutdown()
-	defer a.Leave()
+	defer peers.WaitForShutdown()
+	defer cancel()
+	leases := prefixlease.NewTable(time.Now())
+	bcast := newBroadcasts(peers, digests, leases)
+	peers.NewPeerObject = newPeerConn(ctx)
+	peers.DestroyPeerObject = destroyPeerConn
 
-	// Set up ring muxer
-	rm := &ringMux{
-		memberFn: func() []serf.Member { return a.Serf().Members() },
-		members:  new(sync.Map),
+	// Web service
+	notarizeSvr := newNotarizeServer(name, region, peers, digests, entryIndex, store, tokens)
+	hc := newHealth()
+	notarizeSvr.HandleFunc("/_liveness", hc.handler(false))
+	notarizeSvr.HandleFunc("/_readiness", hc.handler(true))
+	websrv := &http.Server{
+		Addr:    weblistener.Addr().String(),
+		Handler: handlers.LoggingHandler(os.Stdout, notarizeSvr),
 	}
-	a.RegisterEventHandler(rm)
-	go func() {
-		for range time.NewTicker(memberTimer).C {
-			rm.updateMembers()
-		}
-	}()
+	go websrv.Serve(weblistener)
+	defer websrv.Shutdown(ctx)
+	log.Printf("[INFO] main: web server listening at %s", websrv.Addr)
+
+	// RPC notarize service
+	notarizerpcsrv := grpc.NewServer(
+		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
+	)
+	notarizesvr := newNotarizeServer(name, region, peers, digests, entryIndex, store, tokens)
+	servicepb.RegisterFabulaServer(notarizerpcsrv, notarizesvr)
+	go notarizerpcsrv.Serve(rpcNotarizeListener)
+	defer notarizerpcsrv.Stop()
+	log.Printf("[INFO] main: notarize rpc server listening at %s", rpcNotarizeListener.Addr())
+
+	// RPC pack service
+	packrpcsrv := grpc.NewServer()
+	packsvr := newPackServer(ctx, region, store, entryIndex, &prefixLeaser{
+		name:   name,
+		region: region,
+		table:  leases,
+		peers:  peers,
+		bcast:  bcast,
+	})
+	internalapi.RegisterPackerServer(packrpcsrv, &packForwarder{
+		peers: peers,
+		name:  name,
+		local: packsvr,
+	})
+	go packrpcsrv.Serve(rpclistener)
+	defer packrpcsrv.Stop()
+	log.Printf("[INFO] main: pack rpc server listening at %s", rpclistener.Addr())
 
-	if err := a.Start(); err != nil {
-		log.Fatal(err)
-	}
-	local := a.Serf().LocalMember()
-	log.Printf("listening for internal connections at: %s:%d", local.Addr.String(), local.Port)
 	remotes := strings.Split(*join, " ")
 	if *join != "" && len(remotes) > 0 {
 		log.Printf("joining %d remotes: %v", len(remotes), remotes)
-		n, err := a.Join(remotes, false)
+		n, err := peers.Join(remotes)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -308,18 +297,68 @@ func main() {
 		}
 	}
 
+	go broadcastDigests(ctx, bcast, packsvr)
+	go packsvr.maintainLeases(ctx)
+	go packsvr.compactPacks(ctx)
+
+	// Health checks
+	clock := youtime.NewClient(ctx)
+	hc.addLiveness("peerbook", func(context.Context) error {
+		if !peers.Alive() {
+			return fmt.Errorf("left peer group")
+		}
+		return nil
+	})
+	hc.addReadiness("clock", func(context.Context) error {
+		if !clock.Synced() {
+			return fmt.Errorf("not synchronized")
+		}
+		if u := clock.Uncertainty(); u > maxClockUncertainty {
+			return fmt.Errorf("uncertainty %s exceeds %s", u, maxClockUncertainty)
+		}
+		return nil
+	})
+	discoverer, err := newDiscoverer(*discoverySpec)
+	if err != nil {
+		log.Fatalf("[ERROR] -discovery: %s", err)
+	}
+	// A server expecting other servers is not ready until it has found one.
+	// PeerCount includes the local peer.
+	standalone := *join == "" && discoverer == nil
+	hc.addReadiness("peers", func(context.Context) error {
+		if !peers.Ready() {
+			return fmt.Errorf("ring not built")
+		}
+		if !standalone && peers.PeerCount() < 2 {
+			return fmt.Errorf("no other peers")
+		}
+		return nil
+	})
+	hc.addReadiness("storage", func(ctx context.Context) error {
+		_, err := store.List(ctx, region+"/", "").Next()
+		if err != nil && err != iterator.Done {
+			return err
+		}
+		return nil
+	})
+	hc.addReadiness("packs", func(context.Context) error {
+		if err := packsvr.recovery(); err != nil {
+			return fmt.Errorf("recovering prefix chain: %w", err)
+		}
+		return nil
+	})
+	hc.setStarted()
+
 	if *userEventPeriod > time.Duration(0) {
 		go func() {
 			for t := range time.Tick(*userEventPeriod) {
-				a.UserEvent(fmt.Sprintf("event @ %s", t), nil, true)
+				peers.Broadcast(fmt.Sprintf("event @ %s", t), nil, true)
 			}
 		}()
 	}
 
-	if err := populateSerfFromK8s(ctx, a); err != nil {
-		if err != errNotInCluster {
-			log.Fatal(err)
-		}
+	if discoverer != nil {
+		go peers.Discover(ctx, discoverer)
 	}
 
 	// TODO: create new short-lived subscriber, use pkg/latest to track HWM, use HWM
@@ -329,7 +368,7 @@ func main() {
 	// for a prefix, bundles new values and writes them to the log.
 
 	// TODO: put logWriters in an LRU cache. Individual servers don't know/care
-	// which prefixes they own. They trust other servers to use ringMux
+	// which prefixes they own. They trust other servers to use the peerbook
 	// correctly. In other words, from a server's point of view, if a request
 	// arrives, it is correct and should be handled.
 
@@ -337,7 +376,10 @@ func main() {
 	// have something to go by when starting to handle a new prefix.
 	// #optimization
 
-	// TODO: handler for writing notarizing, forwarding based on hash ring
-
 	interrupt.Wait()
+
+	// Finish packing entries that have already been accepted before ctx is
+	// cancelled.
+	packrpcsrv.GracefulStop()
+	packsvr.close()
 }
@@ -2,80 +2,236 @@ package main
 
 import (
 	"context"
+	"crypto/sha3"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 
-	"github.com/hashicorp/serf/cmd/serf/command/agent"
+	"github.com/vsekhar/fabula/internal/atomicwriter"
+	"github.com/vsekhar/fabula/internal/digest"
+	"github.com/vsekhar/fabula/internal/entryindex"
+	"github.com/vsekhar/fabula/internal/peerbook"
 	"github.com/vsekhar/fabula/pkg/api/servicepb"
 	pb "github.com/vsekhar/fabula/pkg/api/servicepb"
+	"github.com/vsekhar/fabula/pkg/privacypass"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 // TODO: notarize server accepts requests from the public and forwards to the
 // pack service
 
+// regionMetadataKey is the gRPC metadata key clients use to request a region.
+const regionMetadataKey = "fabula-region"
+
 type notarizeServer struct {
 	*http.ServeMux
-	agent *agent.Agent
+	peers   *peerbook.PeerBook
+	region  string
+	digests *digest.Table
+	index   entryindex.Interface
+	store   atomicwriter.DriverInterface
+	tokens  *tokenServer // nil if access control is disabled
 
 	servicepb.UnimplementedFabulaServer
 }
 
-func newNotarizeServer(name string, a *agent.Agent) *notarizeServer {
+func newNotarizeServer(name, region string, peers *peerbook.PeerBook, digests *digest.Table, index entryindex.Interface, store atomicwriter.DriverInterface, tokens *tokenServer) *notarizeServer {
 	mux := http.NewServeMux()
+	s := &notarizeServer{
+		ServeMux: mux,
+		peers:    peers,
+		region:   region,
+		digests:  digests,
+		index:    index,
+		store:    store,
+		tokens:   tokens,
+	}
 
-	// TODO: url format
-
-	// TODO: view handlers: packs, entries, proofs
+	// view handlers (see views.go)
+	s.registerViews(mux)
 
 	// notarization handlers
-	// TODO: POST handler for new notarization
-	//  - do notarization
-	//  - redirect to canonical URL for response
 	mux.HandleFunc("/v1/notarize", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.Header().Add("Allow", "POST")
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		// TODO: notarization_sha3512 = hash(document, salt)
-		// TODO: lookup pack service for prefix = notarization_sha3512[:prefixLen]
-		// TODO: submit to Pack Service, block until done
-		// TODO: if fail, return error
-		// TODO: if success, get timestamp, finish commit wait, return success
-		// TODO: response includes: salt, notarization, prefix, timestamp, info
-		//       about packs, debug info (commit-wait length), canonical URL
-		// TODO: if redirect=true, redirect to canonical URL for response
-		//       perhaps using HTML5 window.history.replaceState()
-		fmt.Fprintf(w, "Hello world, from %s\n", name)
+		if _, err := localRegion(r.URL.Query().Get("region"), region); err != nil {
+			http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+			return
+		}
+		doc, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDocumentSize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(doc) > maxDocumentSize {
+			http.Error(w, fmt.Sprintf("document exceeds %d bytes", maxDocumentSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		var redemption privacypass.Redemption
+		if tokens != nil {
+			if redemption, err = tokens.verify(r.Header.Get(tokenHeader), doc); err != nil {
+				http.Error(w, status.Convert(err).Message(), httpStatus(err))
+				return
+			}
+		}
+		e, err := s.notarize(r.Context(), doc)
+		if err != nil {
+			http.Error(w, status.Convert(err).Message(), httpStatus(err))
+			return
+		}
+		if tokens != nil {
+			tokens.spend(r.Context(), redemption)
+		}
+		// Redirect to the canonical URL for the new entry so that reloading
+		// the result does not re-submit the POST.
+		redirectToEntry(w, r, e)
+	})
+
+	// token handlers
+	if tokens != nil {
+		mux.HandleFunc("/v1/tokens", tokens.handleIssue)
+		mux.HandleFunc("/v1/tokens/keys", tokens.handleKeys)
+	}
+
+	// digest handlers
+	mux.HandleFunc("/v1/digests", func(w http.ResponseWriter, r *http.Request) {
+		rs, err := digests.Regions()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		g, err := digest.OfGlobal(rs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req := r.URL.Query().Get("region"); req != "" {
+			if !isRegion(req) {
+				http.Error(w, fmt.Sprintf("unknown region '%s'", req), http.StatusNotFound)
+				return
+			}
+			for _, d := range rs {
+				if d.Region == req {
+					fmt.Fprintln(w, d)
+				}
+			}
+			return
+		}
+		for _, d := range rs {
+			fmt.Fprintln(w, d)
+		}
+		fmt.Fprintln(w, g)
 	})
 
 	// system handlers
 	mux.HandleFunc("/v1/system/peers", func(w http.ResponseWriter, r *http.Request) {
-		members := a.Serf().Members()
-		for _, m := range members {
-			fmt.Fprintf(w, "%+v\n", m)
+		for _, p := range peers.Peers() {
+			fmt.Fprintf(w, "%+v\n", p)
 		}
 	})
 
-	// liveness probe
-	mux.HandleFunc("/_liveness", func(w http.ResponseWriter, r *http.Request) {
-		// TODO: check for liveness
-		return
-	})
+	return s
+}
 
-	return &notarizeServer{
-		ServeMux: mux,
-		agent:    a,
+// maxDocumentSize is the largest document that can be notarized.
+const maxDocumentSize = 64
+
+// notarize creates a new log entry for doc in the local region.
+func (s *notarizeServer) notarize(ctx context.Context, doc []byte) (entryindex.Entry, error) {
+	// TODO: notarization_sha3512 = hash(document, salt)
+	// TODO: lookup pack service for prefix = notarization_sha3512[:prefixLen]
+	// TODO: submit to Pack Service, block until done
+	// TODO: if fail, return error
+	// TODO: if success, get timestamp, finish commit wait, return success
+	// TODO: response includes: salt, notarization, prefix, timestamp, info
+	//       about packs, debug info (commit-wait length)
+	return entryindex.Entry{}, status.Error(codes.Unimplemented, "unimplemented")
+}
+
+// entryHashEncoding is used to encode DataSHA3512 values in URLs.
+var entryHashEncoding = base64.RawURLEncoding
+
+// GetEntry returns the entry with the provided DataSHA3512, along with its
+// location in the log, its predecessors and its timestamp.
+//
+// If region is empty or autoRegion, the local region is searched first and
+// then all other regions. Looking up an entry in the correct region is faster.
+func (s *notarizeServer) GetEntry(ctx context.Context, region string, dataSHA3512 []byte) (entryindex.Entry, error) {
+	if len(dataSHA3512) != sha3.Size512 {
+		return entryindex.Entry{}, status.Errorf(codes.InvalidArgument, "expected %d byte hash, got %d bytes", sha3.Size512, len(dataSHA3512))
+	}
+	var candidates []string
+	switch region {
+	case "", autoRegion:
+		candidates = append(candidates, s.region)
+		for _, r := range append(regions(), globalRegion) {
+			if r != s.region {
+				candidates = append(candidates, r)
+			}
+		}
+	default:
+		if !isRegion(region) {
+			return entryindex.Entry{}, status.Errorf(codes.InvalidArgument, "unknown region '%s'", region)
+		}
+		candidates = []string{region}
+	}
+	for _, r := range candidates {
+		e, err := s.index.Get(ctx, r, dataSHA3512)
+		if err == entryindex.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return entryindex.Entry{}, status.Error(codes.Unavailable, err.Error())
+		}
+		return e, nil
 	}
+	return entryindex.Entry{}, status.Error(codes.NotFound, "entry not found")
+}
+
+// localRegion resolves the region requested by a client and ensures it is
+// served by this server. Entries are only ever written to the region of the
+// server that receives them, so data does not leave its region.
+func localRegion(requested, local string) (string, error) {
+	region, err := resolveRegion(requested, local)
+	if err != nil {
+		return "", err
+	}
+	if region != local {
+		return "", fmt.Errorf("region '%s' is not served here (this server serves '%s')", region, local)
+	}
+	return region, nil
 }
 
 func (s *notarizeServer) Notarize(ctx context.Context, r *pb.NotarizeRequest) (*pb.NotarizeResponse, error) {
+	var requested, token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(regionMetadataKey); len(v) > 0 {
+			requested = v[0]
+		}
+		if v := md.Get(tokenMetadataKey); len(v) > 0 {
+			token = v[0]
+		}
+	}
+	if _, err := localRegion(requested, s.region); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if s.tokens != nil {
+		if _, err := s.tokens.verify(token, r.Document); err != nil {
+			return nil, err
+		}
+	}
 	// TODO: notarization_sha3512 = hash(prior, document, timestamp)
 	// TODO: submit to Pack Service, block until done
 	// TODO: if fail, return error
-	// TODO: if success, get timestamp, finish commit wait, return success
+	// TODO: if success, spend the token, get timestamp, finish commit wait,
+	//       return success
 	return nil, status.Error(codes.Unimplemented, "unimplemented")
 }
 
@@ -2,112 +2,183 @@ package main
 
 import (
 	"context"
+	"crypto/sha3"
+	"errors"
 	"fmt"
+	"io"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"cloud.google.com/go/storage"
+	log "github.com/sirupsen/logrus"
 	pb "github.com/vsekhar/fabula/internal/api"
+	"github.com/vsekhar/fabula/internal/atomicwriter"
 	"github.com/vsekhar/fabula/internal/bigarray"
+	"github.com/vsekhar/fabula/internal/digest"
+	"github.com/vsekhar/fabula/internal/entryindex"
 	"github.com/vsekhar/fabula/internal/prefix"
+	"github.com/vsekhar/fabula/internal/segment"
 	"github.com/vsekhar/fabula/pkg/autobundler"
-	"github.com/vsekhar/fabula/pkg/sortablebase64"
+	"github.com/vsekhar/fabula/pkg/autobundler/otelmetrics"
+	"github.com/vsekhar/fabula/pkg/pack"
+	"github.com/vsekhar/fabula/pkg/packname"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/sync/singleflight"
 	"google.golang.org/api/iterator"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
-const maxPackSize = 100
+// Limits on the entries in each pack. Packs are written as single objects, so
+// bounding their size bounds the latency of writing them.
+const (
+	maxPackSize  = 100
+	maxPackBytes = 1 << 20
+)
 
-func packNamePrefix(prefix string) string {
-	return fmt.Sprintf("%s-")
-}
+// indexBackoff is the backoff between attempts to index the entries of a pack
+// that has been written.
+const indexBackoff = 100 * time.Millisecond
 
-func packName(prefix string, seqNo int) string {
-	return fmt.Sprintf("%s%s.pack", packNamePrefix(prefix), sortablebase64.EncodeUint64(uint64(seqNo)))
+func packName(region, prefix string, seqNo int) string {
+	return packname.Name(region, prefix, uint64(seqNo))
 }
 
 type prefixPacker struct {
 	server        *packServer
 	prefix        string // hex encoded
+	mu            sync.Mutex
 	lastTimestamp time.Time
 	lastHash      []byte
+	lastEntry     []byte // DataSHA3512 of the last entry in the chain
 	nextSeqNo     int
-	bundler       *autobundler.AutoBundler
+	bundler       *autobundler.AutoBundler[*pb.PackRequest]
+
+	// Requests in flight, so the packer can be drained when this server no
+	// longer owns the prefix.
+	inflight *sync.WaitGroup
+	draining bool // guarded by mu
+}
+
+// enter registers a request with r, returning false if r is draining. Callers
+// must call r.inflight.Done() when the request completes.
+func (r *prefixPacker) enter() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return false
+	}
+	r.inflight.Add(1)
+	return true
+}
+
+// drain stops r from accepting new requests and waits for requests in flight
+// to complete. drain returns false if r was already draining.
+func (r *prefixPacker) drain() bool {
+	r.mu.Lock()
+	if r.draining {
+		r.mu.Unlock()
+		return false
+	}
+	r.draining = true
+	r.mu.Unlock()
+	r.inflight.Wait()
+	return true
+}
+
+// digest returns the digest of the prefix chain handled by r. Each pack is an
+// entry in its prefix chain.
+func (r *prefixPacker) digest() digest.Prefix {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return digest.Prefix{
+		Region:        r.server.region,
+		Prefix:        r.prefix,
+		Entries:       uint64(r.nextSeqNo),
+		LastTimestamp: r.lastTimestamp,
+		SHA3512:       r.lastHash,
+	}
 }
 
 func newPrefixPacker(ctx context.Context, server *packServer, prefix string) (*prefixPacker, error) {
 	r := &prefixPacker{
-		server: server,
-		prefix: prefix,
+		server:   server,
+		prefix:   prefix,
+		inflight: new(sync.WaitGroup),
 	}
 	var dneErr error
 	doesNotExist := func(i int) (atLastChecked bool, lastChecked int) {
-		itr := server.bucket.Objects(ctx, &storage.Query{
-			Prefix:      packNamePrefix(prefix),
-			StartOffset: packName(prefix, i),
-		})
-		n := 0
-		var lastObj *storage.ObjectAttrs
-		var dneErr error
-		for {
-			var obj *storage.ObjectAttrs
-			obj, dneErr = itr.Next()
-			if dneErr == iterator.Done {
-				break
-			}
-			if dneErr != nil {
-				return true, i // to stop search, must check dneErr
-			}
-			n++
-			lastObj = obj
-			if itr.PageInfo().Remaining() == 0 {
-				break // next call to itr.Next() will fetch, so stop here
-			}
+		itr := server.store.List(ctx, packname.Prefix(server.region, prefix), packName(server.region, prefix, i))
+		// Pack i or a later pack exists if any object is listed.
+		var attrs atomicwriter.Attrs
+		attrs, dneErr = itr.Next()
+		if dneErr == iterator.Done {
+			// Pack i may have been compacted into a segment.
+			var indexed bool
+			indexed, dneErr = server.store.Exists(ctx, segment.IndexName(segmentName(server.region, prefix, i)))
+			return !indexed, i
+		}
+		if dneErr != nil {
+			return true, i // to stop search, must check dneErr
 		}
-		if n == 0 {
+		// Packs are listed in order, so the listed pack is the first at or
+		// after i, and the search can skip ahead to it.
+		var seqNo int
+		seqNo, dneErr = packSeqNo(server.region, prefix, attrs.Name)
+		if dneErr != nil {
 			return true, i
 		}
-		// TODO: parse lastObj.Name, verify prefix, get seqNo,
-		// return true, seqNo+1
-		_ = lastObj
-		return false, i
+		return false, seqNo
 	}
 	r.nextSeqNo = bigarray.SearchBatch(0, doesNotExist)
 	if dneErr != nil {
 		return nil, dneErr
 	}
 	if r.nextSeqNo > 0 {
-		name := packName(prefix, r.nextSeqNo-1)
-		o := server.bucket.Object(name)
-		_ = o
-		// TODO: read object, set lastTimestamp and lastHash
+		// The next pack chains from the last one, so the prefix cannot be
+		// served until the last pack has been read.
+		if err := r.recoverLast(ctx); err != nil {
+			return nil, err
+		}
 	}
 
-	handler := func(ctx context.Context, v interface{}) {
-		entries := v.([]*packRequest)
+	handler := func(ctx context.Context, reqs []*pb.PackRequest) []error {
+		errs := make([]error, len(reqs))
 
-		// Drop entries with timestamps before r.lastTimestamp
-		j := 0
-		for _, e := range entries {
-			if e.pb.Timestamp.AsTime().Before(r.lastTimestamp) {
-				e.ch <- status.Errorf(codes.Aborted, "timestamp too early (req: %s, last: %s)", e.pb.Timestamp.AsTime(), r.lastTimestamp)
-			} else {
-				entries[j] = e
-				j++
+		// Drop entries with timestamps before r.lastTimestamp and sort the
+		// rest. Results are reported in the order of reqs.
+		var order []int
+		for i, req := range reqs {
+			if req.Timestamp.AsTime().Before(r.lastTimestamp) {
+				errs[i] = status.Errorf(codes.Aborted, "timestamp too early (req: %s, last: %s)", req.Timestamp.AsTime(), r.lastTimestamp)
+				continue
 			}
+			order = append(order, i)
 		}
-		entries = entries[:j]
-
-		sort.Slice(entries, func(i, j int) bool {
-			tsi := entries[i].pb.Timestamp.AsTime()
-			tsj := entries[j].pb.Timestamp.AsTime()
+		if len(order) == 0 {
+			return errs
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			tsi := reqs[order[i]].Timestamp.AsTime()
+			tsj := reqs[order[j]].Timestamp.AsTime()
 			return tsi.Before(tsj)
 		})
 
-		// TODO: do the packing, calculate pack hash.
+		// Drop entries appearing more than once in the bundle. Each entry
+		// must appear in the log only once.
+		seen := make(map[string]bool)
+		unique := order[:0]
+		for _, i := range order {
+			if seen[string(reqs[i].Document)] {
+				errs[i] = status.Error(codes.AlreadyExists, "duplicate entry in pack")
+				continue
+			}
+			seen[string(reqs[i].Document)] = true
+			unique = append(unique, i)
+		}
+		order = unique
 
 		// TODO: submit pack hash for notarization to prefix[:len(prefix)-1]
 		// and block until notarized. NB: may have spurious notarizations in
@@ -117,57 +188,339 @@ func newPrefixPacker(ctx context.Context, server *packServer, prefix string) (*p
 		// notarization to a higher level prefix tree is only to order a new
 		// pack against all other packs in all other prefix trees.
 
-		// TODO: write pack with notarization to bucket with DoesNotExist
-		// condition.
+		// Write the pack before indexing its entries, so that every indexed
+		// location can be read. If the pack cannot be written, no entry in
+		// the bundle is in the log and the chain is unchanged.
+		r.mu.Lock()
+		seqNo, prevHash, prev := r.nextSeqNo, r.lastHash, r.lastEntry
+		r.mu.Unlock()
+		packHash, err := r.writePack(ctx, seqNo, prevHash, reqs, order)
+		if err != nil {
+			for _, i := range order {
+				errs[i] = status.Errorf(codes.Unavailable, "writing pack: %s", err)
+			}
+			return errs
+		}
+		r.mu.Lock()
+		r.nextSeqNo = seqNo + 1
+		r.lastHash = packHash
+		r.lastTimestamp = reqs[order[len(order)-1]].Timestamp.AsTime()
+		r.lastEntry = reqs[order[len(order)-1]].Document
+		r.mu.Unlock()
 
-		// success
-		r.lastTimestamp = entries[len(entries)-1].pb.Timestamp.AsTime()
-		for _, r := range entries {
-			r.ch <- nil
+		// Index entries so they can be found by DataSHA3512. Entries are
+		// acknowledged only once indexed. The pack is already in the log, so
+		// indexing is retried rather than failing individual entries that
+		// later entries name as predecessors. If indexing cannot complete,
+		// the whole bundle fails.
+		entries := make([]entryindex.Entry, len(order))
+		for packIndex, i := range order {
+			req := reqs[i]
+			var predecessors [][]byte
+			if prev != nil {
+				predecessors = [][]byte{prev}
+			}
+			entries[packIndex] = entryindex.Entry{
+				DataSHA3512: req.Document,
+				Timestamp:   req.Timestamp.AsTime(),
+				Location: entryindex.Location{
+					Region: r.server.region,
+					Prefix: r.prefix,
+					Pack:   uint64(seqNo),
+					Index:  packIndex,
+				},
+				Predecessors: predecessors,
+			}
+			prev = req.Document
+		}
+		if err := r.indexEntries(ctx, entries); err != nil {
+			for _, i := range order {
+				// Not Unavailable: the entries are in the log, so
+				// forwarding servers must not retry them.
+				errs[i] = status.Errorf(codes.Internal, "indexing pack %d: %s", seqNo, err)
+			}
 		}
 
-		// TODO: If top-level (prefix=""), broadcast new PrefixInfo across
-		// Serf agent (via ringMux?).
+		// TODO: If top-level (prefix=""), broadcast new PrefixDigest across
+		// peerbook immediately rather than waiting for broadcastDigests.
+		return errs
 	}
-	r.bundler = autobundler.New(ctx, &packRequest{}, handler, maxPackSize)
+	r.bundler = autobundler.NewWithOptions(ctx, handler, autobundler.Options[*pb.PackRequest]{
+		MaxBuffered:    maxPackSize,
+		MaxBundleCount: maxPackSize,
+		MaxBundleBytes: maxPackBytes,
+		Size: func(r *pb.PackRequest) int {
+			return proto.Size(r)
+		},
+		Metrics: server.bundlerMetrics,
+	})
 	return r, nil
 }
 
-type packRequest struct {
-	pb *pb.PackRequest
-	ch chan error
+// recoverLast reads the last pack written to the prefix chain, pack
+// r.nextSeqNo-1, and restores the chain's last hash, entry and timestamp from
+// it.
+func (r *prefixPacker) recoverLast(ctx context.Context) error {
+	seqNo := r.nextSeqNo - 1
+	rc, err := openPack(ctx, r.server.store, r.server.region, r.prefix, seqNo)
+	if err != nil {
+		return fmt.Errorf("opening pack %d: %w", seqNo, err)
+	}
+	defer rc.Close()
+	pr, err := pack.NewReader(rc)
+	if err != nil {
+		return fmt.Errorf("reading pack %d: %w", seqNo, err)
+	}
+	if h := pr.Header(); h.Prefix != r.prefix || h.SeqNo != uint64(seqNo) {
+		return fmt.Errorf("pack %d has header for prefix '%s' pack %d", seqNo, h.Prefix, h.SeqNo)
+	}
+	var last pack.Entry
+	n := 0
+	for {
+		// Next verifies the whole pack before returning io.EOF.
+		e, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading pack %d: %w", seqNo, err)
+		}
+		last = e
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("pack %d has no entries", seqNo)
+	}
+	r.lastHash = pr.SHA3512()
+	r.lastEntry = last.DataSHA3512
+	r.lastTimestamp = last.Timestamp
+	return nil
+}
+
+// writePack durably writes pack seqNo containing reqs in order, and returns
+// its SHA3-512.
+func (r *prefixPacker) writePack(ctx context.Context, seqNo int, prevHash []byte, reqs []*pb.PackRequest, order []int) ([]byte, error) {
+	w, err := r.server.store.NewAtomicWriter(ctx, packName(r.server.region, r.prefix, seqNo))
+	if err != nil {
+		return nil, err
+	}
+	pw, err := pack.NewWriter(w, pack.Header{
+		Prefix:      r.prefix,
+		SeqNo:       uint64(seqNo),
+		PrevSHA3512: prevHash,
+	})
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	for _, i := range order {
+		err = pw.Append(pack.Entry{
+			Timestamp:   reqs[i].Timestamp.AsTime(),
+			DataSHA3512: reqs[i].Document,
+		})
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+	}
+	if err := pw.Close(); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if err := w.CloseAtomically(); err != nil {
+		return nil, err
+	}
+	return pw.SHA3512(), nil
+}
+
+// indexEntries adds entries to the index, retrying until all are indexed or
+// ctx is done. Put is idempotent, so entries already indexed can be put again.
+func (r *prefixPacker) indexEntries(ctx context.Context, entries []entryindex.Entry) error {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * indexBackoff):
+			}
+		}
+		var mu sync.Mutex
+		var failed []entryindex.Entry
+		var lastErr error
+		wg := new(sync.WaitGroup)
+		wg.Add(len(entries))
+		for _, e := range entries {
+			go func(e entryindex.Entry) {
+				defer wg.Done()
+				if err := r.server.index.Put(ctx, e); err != nil {
+					mu.Lock()
+					failed = append(failed, e)
+					lastErr = err
+					mu.Unlock()
+				}
+			}(e)
+		}
+		wg.Wait()
+		if len(failed) == 0 {
+			return nil
+		}
+		if errors.Is(lastErr, entryindex.ErrConflict) {
+			return lastErr
+		}
+		log.WithError(lastErr).WithField("prefix", r.prefix).Warnf("main: retrying indexing of %d entries", len(failed))
+		entries = failed
+	}
 }
 
 type packServer struct {
 	ctx    context.Context // for prefixPacker's
-	bucket *storage.BucketHandle
+	region string
+	store  atomicwriter.DriverInterface
+	index  entryindex.Interface
+	leaser *prefixLeaser // nil if leases are not required
+
+	// Shared by the bundlers of all prefixPackers.
+	bundlerMetrics autobundler.Metrics
 
 	// lots of reads (every RPC handler) and few writes (handling a new prefix)
 	packers *sync.Map           // map[string]*prefixPacker
 	sf      *singleflight.Group // make packers once (it's slow)
 
-	// For faster channel allocation
-	chPool *sync.Pool
+	// Result of the most recent attempt to recover the state of each prefix
+	// chain from storage, nil if it succeeded.
+	recoveryMu   sync.Mutex
+	recoveryErrs map[string]error
 
 	pb.UnimplementedPackerServer
 }
 
-func newPackServer(ctx context.Context, bkt *storage.BucketHandle) *packServer {
+func newPackServer(ctx context.Context, region string, store atomicwriter.DriverInterface, index entryindex.Interface, leaser *prefixLeaser) *packServer {
 	r := &packServer{
 		ctx:     ctx,
-		bucket:  bkt,
+		region:  region,
+		store:   store,
+		index:   index,
+		leaser:  leaser,
 		packers: &sync.Map{},
 		sf:      &singleflight.Group{},
-		chPool:  &sync.Pool{},
-	}
-	r.chPool.New = func() interface{} {
-		return make(chan error)
+
+		recoveryErrs: make(map[string]error),
+
+		bundlerMetrics: otelmetrics.New(otel.Meter("packserver"), "pack"),
 	}
 	return r
 }
 
+// digests returns the digests of all prefix chains handled by s.
+func (s *packServer) digests() []digest.Prefix {
+	var r []digest.Prefix
+	s.packers.Range(func(key, value interface{}) bool {
+		r = append(r, value.(*prefixPacker).digest())
+		return true // keep going
+	})
+	return r
+}
+
+// recovery returns an error if recovering prefix chains is failing for at
+// least half of the prefixes s has attempted to recover, which suggests the
+// server cannot reach storage. Failures confined to fewer prefixes are
+// reported only to requests for those prefixes.
+func (s *packServer) recovery() error {
+	s.recoveryMu.Lock()
+	defer s.recoveryMu.Unlock()
+	var failed []string
+	var last error
+	for p, err := range s.recoveryErrs {
+		if err != nil {
+			failed = append(failed, p)
+			last = err
+		}
+	}
+	if len(failed) == 0 || 2*len(failed) < len(s.recoveryErrs) {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("%d of %d prefixes failing (%s): %w", len(failed), len(s.recoveryErrs), strings.Join(failed, ","), last)
+}
+
+// setRecovery records the result of recovering prefix p.
+func (s *packServer) setRecovery(p string, err error) {
+	s.recoveryMu.Lock()
+	defer s.recoveryMu.Unlock()
+	s.recoveryErrs[p] = err
+}
+
+// maintainLeases renews leases on prefixes handled by s, and drains packers
+// for prefixes s no longer owns, until ctx is cancelled.
+func (s *packServer) maintainLeases(ctx context.Context) {
+	t := time.NewTicker(leaseRenewPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		s.packers.Range(func(key, value interface{}) bool {
+			packer := value.(*prefixPacker)
+			owns, err := s.leaser.owns(ctx, packer.prefix)
+			if err != nil {
+				// Keep the lease rather than disrupt packing while the ring
+				// is unavailable. The lease is still exclusive.
+				log.WithError(err).WithField("prefix", packer.prefix).Warn("main: looking up prefix owner")
+				owns = true
+			}
+			if owns && s.leaser.renew(packer.prefix) {
+				return true // keep going
+			}
+			go func() {
+				if !packer.drain() {
+					return
+				}
+				packer.bundler.Close()
+				s.packers.Delete(packer.prefix)
+				s.recoveryMu.Lock()
+				delete(s.recoveryErrs, packer.prefix)
+				s.recoveryMu.Unlock()
+				s.leaser.release(packer.prefix)
+			}()
+			return true // keep going
+		})
+	}
+}
+
+// close stops s from packing, waiting for entries that have been accepted to
+// be packed.
+func (s *packServer) close() {
+	s.packers.Range(func(key, value interface{}) bool {
+		value.(*prefixPacker).bundler.Close()
+		return true // keep going
+	})
+}
+
+// toStatus converts errors from packing to gRPC status errors.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, autobundler.ErrClosed):
+		return status.Error(codes.Unavailable, "packer is shutting down")
+	}
+	return err
+}
+
 func (s *packServer) Pack(ctx context.Context, r *pb.PackRequest) (*pb.PackResponse, error) {
+	if len(r.Document) != sha3.Size512 {
+		return nil, status.Errorf(codes.InvalidArgument, "expected %d byte document hash, got %d bytes", sha3.Size512, len(r.Document))
+	}
 	p := prefix.ToString(r.Document, prefix.LengthNibbles)
+	if s.leaser != nil {
+		if err := s.leaser.acquire(ctx, p); err != nil {
+			return nil, err
+		}
+	}
 
 	// Get the right packer or create it.
 	packerI, ok := s.packers.Load(p)
@@ -176,6 +529,7 @@ func (s *packServer) Pack(ctx context.Context, r *pb.PackRequest) (*pb.PackRespo
 		packerI, err, _ = s.sf.Do(p, func() (interface{}, error) {
 			var newPacker *prefixPacker
 			newPacker, err := newPrefixPacker(s.ctx, s, p)
+			s.setRecovery(p, err)
 			if err != nil {
 				return nil, err
 			}
@@ -188,14 +542,12 @@ func (s *packServer) Pack(ctx context.Context, r *pb.PackRequest) (*pb.PackRespo
 	}
 
 	packer := packerI.(*prefixPacker)
-	req := new(packRequest)
-	req.pb = r
-	req.ch = s.chPool.Get().(chan error)
-	packer.bundler.Add(ctx, req)
-	err := <-req.ch
-	s.chPool.Put(req.ch)
-	if err != nil {
-		return nil, err
+	if !packer.enter() {
+		return nil, status.Errorf(codes.FailedPrecondition, "prefix %s is being handed off", p)
+	}
+	defer packer.inflight.Done()
+	if err := packer.bundler.Add(ctx, r); err != nil {
+		return nil, toStatus(err)
 	}
 
 	// TODO: prepare PackResponse
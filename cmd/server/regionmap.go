@@ -1,5 +1,14 @@
 package main
 
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
 // Fabula uses regions to improve latency to users. Each region has its own
 // Merkle weave.
 
@@ -21,3 +30,87 @@ var regionMap map[string]string = map[string]string{
 	"europe-west4": "EU",
 	"europe-west6": "EU",
 }
+
+const (
+	// autoRegion is requested by clients that want the infrastructure to
+	// select a region for them. It never selects globalRegion.
+	autoRegion = "auto"
+
+	// globalRegion must be explicitly requested.
+	globalRegion = "global"
+)
+
+// regions returns the sorted list of Fabula regions, not including
+// globalRegion.
+func regions() []string {
+	set := make(map[string]struct{})
+	for _, r := range regionMap {
+		set[r] = struct{}{}
+	}
+	r := make([]string, 0, len(set))
+	for k := range set {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// isRegion returns true if r is a Fabula region or globalRegion. It is used
+// to validate regions requested by queries.
+func isRegion(r string) bool {
+	return r == globalRegion || isServingRegion(r)
+}
+
+// isServingRegion returns true if r is a Fabula region a server can serve.
+// globalRegion is reserved and is not served by any server.
+func isServingRegion(r string) bool {
+	for _, fr := range regionMap {
+		if fr == r {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRegion maps a region requested by a client to a Fabula region. The
+// local region is used when the client requests autoRegion or no region.
+func resolveRegion(requested, local string) (string, error) {
+	switch requested {
+	case "", autoRegion:
+		return local, nil
+	}
+	if !isRegion(requested) {
+		return "", fmt.Errorf("unknown region '%s'", requested)
+	}
+	return requested, nil
+}
+
+// getRegion returns the Fabula region of this server instance.
+//
+// The region is taken from the FABULA_REGION environment variable if set, and
+// is otherwise derived from the zone reported by the GCP metadata server.
+func getRegion() (string, error) {
+	if r, ok := os.LookupEnv("FABULA_REGION"); ok && r != "" {
+		if !isServingRegion(r) {
+			return "", fmt.Errorf("FABULA_REGION: '%s' is not a region that can be served (one of %s)", r, strings.Join(regions(), ", "))
+		}
+		return r, nil
+	}
+	if !metadata.OnGCE() {
+		return "", fmt.Errorf("FABULA_REGION environment variable not set and not running on GCP")
+	}
+	zone, err := metadata.Zone()
+	if err != nil {
+		return "", err
+	}
+	// Zones are named "<gcp region>-<letter>"
+	i := strings.LastIndex(zone, "-")
+	if i < 0 {
+		return "", fmt.Errorf("bad zone name '%s'", zone)
+	}
+	r, ok := regionMap[zone[:i]]
+	if !ok {
+		return "", fmt.Errorf("no Fabula region for zone '%s'", zone)
+	}
+	return r, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vsekhar/fabula/internal/atomicwriter"
+	"github.com/vsekhar/fabula/internal/segment"
+	"github.com/vsekhar/fabula/pkg/packname"
+	"google.golang.org/api/iterator"
+)
+
+// Packs of a prefix chain are compacted into segments of packsPerSegment
+// consecutive packs, so the number of objects per prefix stays bounded as the
+// log grows. Segments are aligned: the segment containing pack seqNo starts at
+// seqNo - seqNo%packsPerSegment, so it can be found without listing.
+const (
+	packsPerSegment  = 256
+	compactionPeriod = 1 * time.Minute
+)
+
+// segmentName returns the name of the segment containing pack seqNo.
+func segmentName(region, prefix string, seqNo int) string {
+	first := seqNo - seqNo%packsPerSegment
+	return packname.Segment(region, prefix, uint64(first))
+}
+
+// packSeqNo returns the sequence number of the pack named name.
+func packSeqNo(region, prefix, name string) (int, error) {
+	r, p, n, err := packname.Parse(name)
+	if err != nil {
+		return 0, err
+	}
+	if r != region || p != prefix {
+		return 0, fmt.Errorf("not a pack of prefix '%s': %s", prefix, name)
+	}
+	return int(n), nil
+}
+
+// storedPack is a pack stored either as its own object or within a segment.
+type storedPack struct {
+	name  string
+	attrs atomicwriter.Attrs // of the pack, or of its segment if compacted
+	index *segment.Index     // nil if not compacted
+	pack  segment.Pack       // location in the segment, if compacted
+}
+
+// findPack locates pack seqNo of a prefix chain. It returns an error
+// satisfying os.IsNotExist if the pack has not been written.
+func findPack(ctx context.Context, store atomicwriter.DriverInterface, region, prefix string, seqNo int) (*storedPack, error) {
+	name := packName(region, prefix, seqNo)
+	attrs, err := store.Attrs(ctx, name)
+	if err == nil {
+		return &storedPack{name: name, attrs: attrs}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Packs are deleted only after their segment is indexed.
+	ix, err := segment.ReadIndex(ctx, store, segmentName(region, prefix, seqNo))
+	if err != nil {
+		return nil, err
+	}
+	p, ok := ix.Find(name)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	attrs, err = store.Attrs(ctx, ix.Segment)
+	if err != nil {
+		return nil, err
+	}
+	return &storedPack{name: name, attrs: attrs, index: ix, pack: p}, nil
+}
+
+// object returns the name of the object containing p.
+func (p *storedPack) object() string {
+	if p.index != nil {
+		return p.index.Segment
+	}
+	return p.name
+}
+
+func (p *storedPack) size() int64 {
+	if p.index != nil {
+		return p.pack.Size
+	}
+	return p.attrs.Size
+}
+
+// openPack opens pack seqNo of a prefix chain for reading.
+func openPack(ctx context.Context, store atomicwriter.DriverInterface, region, prefix string, seqNo int) (io.ReadCloser, error) {
+	r, err := store.Open(ctx, packName(region, prefix, seqNo), 0, -1)
+	if !os.IsNotExist(err) {
+		return r, err
+	}
+	p, err := findPack(ctx, store, region, prefix, seqNo)
+	if err != nil {
+		return nil, err
+	}
+	if p.index == nil {
+		// Written since it was opened above.
+		return store.Open(ctx, p.name, 0, -1)
+	}
+	return p.index.Open(ctx, store, p.pack)
+}
+
+// compactPacks compacts the packs of prefix chains handled by s into segments
+// until ctx is cancelled.
+func (s *packServer) compactPacks(ctx context.Context) {
+	t := time.NewTicker(compactionPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		s.packers.Range(func(key, value interface{}) bool {
+			packer := value.(*prefixPacker)
+			if err := packer.compact(ctx); err != nil {
+				log.WithError(err).WithField("prefix", packer.prefix).Warn("main: compacting packs")
+			}
+			return ctx.Err() == nil
+		})
+	}
+}
+
+// compact composes the packs of r's prefix chain into segments, once all of a
+// segment's packs have been written.
+func (r *prefixPacker) compact(ctx context.Context) error {
+	r.mu.Lock()
+	next := r.nextSeqNo
+	r.mu.Unlock()
+
+	store, region := r.server.store, r.server.region
+	var run []atomicwriter.Attrs
+	first := -1
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		name := segmentName(region, r.prefix, first)
+		if len(run) < packsPerSegment {
+			// Only resume a compaction that indexed the segment before
+			// deleting all of its packs. Otherwise packs are missing.
+			if _, err := segment.ReadIndex(ctx, store, name); err != nil {
+				if os.IsNotExist(err) {
+					return fmt.Errorf("segment %s: found %d of %d packs", name, len(run), packsPerSegment)
+				}
+				return err
+			}
+		}
+		_, err := segment.Compact(ctx, store, name, run)
+		run = nil
+		return err
+	}
+
+	itr := store.List(ctx, packname.Prefix(region, r.prefix), "")
+	for {
+		attrs, err := itr.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		seqNo, err := packSeqNo(region, r.prefix, attrs.Name)
+		if err != nil {
+			return err
+		}
+		segFirst := seqNo - seqNo%packsPerSegment
+		if segFirst+packsPerSegment > next {
+			// Packs are listed in order, so no later segment is complete.
+			break
+		}
+		if segFirst != first {
+			if err := flush(); err != nil {
+				return err
+			}
+			first = segFirst
+		}
+		run = append(run, attrs)
+	}
+	return flush()
+}
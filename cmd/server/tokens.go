@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vsekhar/fabula/internal/atomicwriter"
+	"github.com/vsekhar/fabula/pkg/privacypass"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Customers redeem a token with each notarization. Tokens are issued blinded
+// (see package privacypass) so we can meter usage without learning which
+// customer submitted which document.
+
+const (
+	// tokenHeader and tokenMetadataKey carry an encoded
+	// privacypass.Redemption with each notarization request.
+	tokenHeader      = "Fabula-Token"
+	tokenMetadataKey = "fabula-token"
+
+	maxTokensPerIssuance = 100
+	keyringReloadPeriod  = 1 * time.Minute
+)
+
+// driverSpentStore records spent tokens as write-once objects so that a token
+// cannot be spent twice across all servers sharing the same storage.
+type driverSpentStore struct {
+	driver atomicwriter.DriverInterface
+}
+
+func (d *driverSpentStore) Spend(ctx context.Context, keyID string, t []byte) error {
+	h := sha256.Sum256(t)
+	w, err := d.driver.NewAtomicWriter(ctx, path.Join(keyID, hex.EncodeToString(h[:])))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(t); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.CloseAtomically(); err != nil {
+		if os.IsExist(err) {
+			return privacypass.ErrDoubleSpend
+		}
+		return err
+	}
+	return nil
+}
+
+type tokenServer struct {
+	keyring *privacypass.Keyring
+	spent   privacypass.SpentStore
+
+	// issuanceKey authorizes requests to issue tokens. Issuance is expected to
+	// be fronted by a billing system holding this key.
+	issuanceKey string
+}
+
+// newTokenServer returns a tokenServer using the keyring at keyringPath. The
+// keyring is reloaded periodically so keys can be rotated by updating the file
+// (e.g. a mounted secret) on all servers.
+func newTokenServer(ctx context.Context, keyringPath string, spent privacypass.SpentStore, issuanceKey string) (*tokenServer, error) {
+	t := &tokenServer{
+		keyring:     privacypass.NewKeyring(),
+		spent:       spent,
+		issuanceKey: issuanceKey,
+	}
+	load := func() error {
+		b, err := ioutil.ReadFile(keyringPath)
+		if err != nil {
+			return err
+		}
+		return t.keyring.UnmarshalText(b)
+	}
+	if err := load(); err != nil {
+		return nil, err
+	}
+	go func() {
+		tk := time.NewTicker(keyringReloadPeriod)
+		defer tk.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tk.C:
+				if err := load(); err != nil {
+					log.WithError(err).Error("tokens: reloading keyring")
+				}
+			}
+		}
+	}()
+	return t, nil
+}
+
+// verify verifies the encoded token for the notarization of document without
+// spending it. Tokens are bound to the document they are redeemed for (see
+// privacypass.NotarizeBinding).
+//
+// The returned redemption should be passed to spend once the notarization has
+// committed, so that customers are not charged for failed notarizations.
+func (t *tokenServer) verify(encoded string, document []byte) (privacypass.Redemption, error) {
+	if encoded == "" {
+		return privacypass.Redemption{}, status.Error(codes.Unauthenticated, "token required")
+	}
+	r, err := privacypass.ParseRedemption(encoded)
+	if err != nil {
+		return privacypass.Redemption{}, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err := t.keyring.Verify(r, privacypass.NotarizeBinding(document), time.Now()); err != nil {
+		return privacypass.Redemption{}, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return r, nil
+}
+
+// spend records the token of a verified redemption as spent.
+//
+// A token is bound to one document and a document is only notarized once, so
+// a token cannot pay for two committed notarizations even though it is spent
+// after the fact. Failing to record it only lets the customer keep a token
+// that can no longer be used, so errors are logged rather than returned.
+func (t *tokenServer) spend(ctx context.Context, r privacypass.Redemption) {
+	err := t.spent.Spend(ctx, r.KeyID, r.T)
+	switch {
+	case err == nil:
+	case errors.Is(err, privacypass.ErrDoubleSpend):
+		log.WithField("key_id", r.KeyID).Warn("tokens: token spent twice")
+	default:
+		log.WithError(err).WithField("key_id", r.KeyID).Error("tokens: recording spent token")
+	}
+}
+
+type issueRequest struct {
+	Blinded [][]byte `json:"blinded"`
+}
+
+func (t *tokenServer) handleIssue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if t.issuanceKey == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(t.issuanceKey)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	req := new(issueRequest)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Blinded) == 0 || len(req.Blinded) > maxTokensPerIssuance {
+		http.Error(w, "bad number of tokens requested", http.StatusBadRequest)
+		return
+	}
+	key, err := t.keyring.Current(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	signed, err := key.Sign(rand.Reader, req.Blinded)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(signed)
+}
+
+func (t *tokenServer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.keyring.PublicKeys(time.Now()))
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vsekhar/fabula/internal/digest"
+	"github.com/vsekhar/fabula/internal/entryindex"
+	"github.com/vsekhar/fabula/pkg/timestamp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// View handlers let non-gRPC consumers (and humans debugging) browse the log.
+//
+// Canonical URLs:
+//
+//	/v1/entries/<hash>                  an entry, by DataSHA3512
+//	/v1/packs/<region>/<prefix>/<seq>   a pack in a prefix chain
+//	/v1/summaries/                      regional and global digests
+//	/v1/summaries/<region>              prefix digests in a region
+//	/v1/summaries/<region>/<prefix>     digest of a prefix chain
+//	/v1/proofs/<region>/<prefix>        proof a prefix digest is covered by
+//	                                    the global digest
+//
+// Hashes in URLs are URL-safe base64 with no padding. Views are rendered as
+// JSON, text or HTML according to the format query parameter or, failing
+// that, the Accept header.
+
+const (
+	formatHTML = "html"
+	formatJSON = "json"
+	formatText = "text"
+	formatRaw  = "raw" // packs only
+)
+
+func entryPath(dataSHA3512 []byte) string {
+	return "/v1/entries/" + entryHashEncoding.EncodeToString(dataSHA3512)
+}
+
+func packPath(region, prefix string, seqNo uint64) string {
+	return fmt.Sprintf("/v1/packs/%s/%s/%d", region, prefix, seqNo)
+}
+
+func summaryPath(region, prefix string) string {
+	switch {
+	case region == "":
+		return "/v1/summaries/"
+	case prefix == "":
+		return "/v1/summaries/" + region
+	}
+	return fmt.Sprintf("/v1/summaries/%s/%s", region, prefix)
+}
+
+func proofPath(region, prefix string) string {
+	return fmt.Sprintf("/v1/proofs/%s/%s", region, prefix)
+}
+
+// viewRow is a line in the text and HTML renderings of a view.
+type viewRow struct {
+	Label string
+	Value string
+	Link  string // optional
+}
+
+var viewTemplate = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+{{range .Rows}}<tr><th>{{.Label}}</th><td><code>{{if .Link}}<a href="{{.Link}}">{{.Value}}</a>{{else}}{{.Value}}{{end}}</code></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func viewFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return formatHTML
+	}
+	return formatJSON
+}
+
+// render writes v as JSON, or rows as text or HTML, according to the format
+// requested by r.
+func render(w http.ResponseWriter, r *http.Request, title string, v interface{}, rows []viewRow) {
+	switch viewFormat(r) {
+	case formatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	case formatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, row := range rows {
+			fmt.Fprintf(w, "%s: %s\n", row.Label, row.Value)
+		}
+	case formatHTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		viewTemplate.Execute(w, struct {
+			Title string
+			Rows  []viewRow
+		}{title, rows})
+	default:
+		http.Error(w, fmt.Sprintf("unknown format '%s'", viewFormat(r)), http.StatusNotAcceptable)
+	}
+}
+
+// httpStatus returns the HTTP status code corresponding to a gRPC status
+// error.
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition:
+		return http.StatusMisdirectedRequest
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+// pathParts splits the remainder of r's path after prefix into n parts, or
+// returns false if there are not exactly n non-empty parts.
+func pathParts(r *http.Request, prefix string, n int) ([]string, bool) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if rest == "" {
+		return nil, n == 0
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != n {
+		return nil, false
+	}
+	for _, p := range parts {
+		if p == "" {
+			return nil, false
+		}
+	}
+	return parts, true
+}
+
+func validRegion(region string) bool {
+	return region == globalRegion || isRegion(region)
+}
+
+func digestRows(rs []digest.Region, ps []digest.Prefix) []viewRow {
+	var rows []viewRow
+	for _, d := range rs {
+		rows = append(rows, viewRow{Label: d.Region, Value: d.String(), Link: summaryPath(d.Region, "")})
+	}
+	for _, d := range ps {
+		rows = append(rows, viewRow{Label: d.Prefix, Value: d.String(), Link: summaryPath(d.Region, d.Prefix)})
+	}
+	return rows
+}
+
+func (s *notarizeServer) registerViews(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/entries/", s.handleEntry)
+	mux.HandleFunc("/v1/packs/", s.handlePack)
+	mux.HandleFunc("/v1/summaries/", s.handleSummary)
+	mux.HandleFunc("/v1/proofs/", s.handleProof)
+}
+
+func (s *notarizeServer) handleEntry(w http.ResponseWriter, r *http.Request) {
+	parts, ok := pathParts(r, "/v1/entries/", 1)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	h, err := entryHashEncoding.DecodeString(parts[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad entry hash: %s", err), http.StatusBadRequest)
+		return
+	}
+	e, err := s.GetEntry(r.Context(), r.URL.Query().Get("region"), h)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	loc := e.Location
+	rows := []viewRow{
+		{Label: "DataSHA3512", Value: parts[0], Link: entryPath(e.DataSHA3512)},
+		{Label: "Timestamp", Value: timestamp.ToString(e.Timestamp)},
+		{Label: "Region", Value: loc.Region, Link: summaryPath(loc.Region, "")},
+		{Label: "Prefix", Value: loc.Prefix, Link: summaryPath(loc.Region, loc.Prefix)},
+		{Label: "Pack", Value: strconv.FormatUint(loc.Pack, 10), Link: packPath(loc.Region, loc.Prefix, loc.Pack)},
+		{Label: "Index", Value: strconv.Itoa(loc.Index)},
+		{Label: "Proof", Value: proofPath(loc.Region, loc.Prefix), Link: proofPath(loc.Region, loc.Prefix)},
+	}
+	for _, p := range e.Predecessors {
+		rows = append(rows, viewRow{Label: "Predecessor", Value: entryHashEncoding.EncodeToString(p), Link: entryPath(p)})
+	}
+	render(w, r, "Entry", e, rows)
+}
+
+type packView struct {
+	Region  string `json:"region"`
+	Prefix  string `json:"prefix"`
+	SeqNo   uint64 `json:"seq"`
+	Object  string `json:"object"`
+	Size    int64  `json:"size"`
+	Created string `json:"created"`
+}
+
+func (s *notarizeServer) handlePack(w http.ResponseWriter, r *http.Request) {
+	parts, ok := pathParts(r, "/v1/packs/", 3)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	region, prefix := parts[0], parts[1]
+	if !validRegion(region) {
+		http.Error(w, fmt.Sprintf("unknown region '%s'", region), http.StatusNotFound)
+		return
+	}
+	seqNo, err := strconv.ParseUint(parts[2], 10, 63)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad pack sequence number: %s", err), http.StatusBadRequest)
+		return
+	}
+	if viewFormat(r) == formatRaw {
+		or, err := openPack(r.Context(), s.store, region, prefix, int(seqNo))
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer or.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, or)
+		return
+	}
+	p, err := findPack(r.Context(), s.store, region, prefix, int(seqNo))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	v := packView{
+		Region:  region,
+		Prefix:  prefix,
+		SeqNo:   seqNo,
+		Object:  p.object(),
+		Size:    p.size(),
+		Created: timestamp.ToString(p.attrs.Created),
+	}
+	rows := []viewRow{
+		{Label: "Region", Value: region, Link: summaryPath(region, "")},
+		{Label: "Prefix", Value: prefix, Link: summaryPath(region, prefix)},
+		{Label: "Sequence number", Value: parts[2]},
+		{Label: "Object", Value: p.object(), Link: packPath(region, prefix, seqNo) + "?format=" + formatRaw},
+		{Label: "Size", Value: strconv.FormatInt(p.size(), 10)},
+		{Label: "Created", Value: v.Created},
+	}
+	if seqNo > 0 {
+		rows = append(rows, viewRow{Label: "Previous", Value: strconv.FormatUint(seqNo-1, 10), Link: packPath(region, prefix, seqNo-1)})
+	}
+	render(w, r, "Pack", v, rows)
+}
+
+type summaryView struct {
+	Global   string   `json:"global,omitempty"`
+	Regions  []string `json:"regions,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+func (s *notarizeServer) handleSummary(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/summaries/"), "/")
+	var parts []string
+	if rest != "" {
+		parts = strings.Split(rest, "/")
+	}
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) > 0 && !validRegion(parts[0]) {
+		http.Error(w, fmt.Sprintf("unknown region '%s'", parts[0]), http.StatusNotFound)
+		return
+	}
+
+	var v summaryView
+	var rows []viewRow
+	switch len(parts) {
+	case 0:
+		rs, err := s.digests.Regions()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		g, err := digest.OfGlobal(rs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v.Global = g.String()
+		rows = append(rows, viewRow{Label: "Global", Value: v.Global})
+		for _, d := range rs {
+			v.Regions = append(v.Regions, d.String())
+		}
+		rows = append(rows, digestRows(rs, nil)...)
+	case 1:
+		d, err := s.digests.Region(parts[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ps := s.digests.Prefixes(parts[0])
+		v.Regions = []string{d.String()}
+		for _, p := range ps {
+			v.Prefixes = append(v.Prefixes, p.String())
+		}
+		rows = append(rows, digestRows([]digest.Region{d}, ps)...)
+	case 2:
+		p, ok := s.digests.Prefix(parts[0], parts[1])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		v.Prefixes = []string{p.String()}
+		rows = append(rows, digestRows(nil, []digest.Prefix{p})...)
+		if p.Entries > 0 {
+			rows = append(rows, viewRow{Label: "Latest pack", Value: strconv.FormatUint(p.Entries-1, 10), Link: packPath(p.Region, p.Prefix, p.Entries-1)})
+		}
+		rows = append(rows, viewRow{Label: "Proof", Value: proofPath(p.Region, p.Prefix), Link: proofPath(p.Region, p.Prefix)})
+	}
+	render(w, r, "Summary", v, rows)
+}
+
+type proofView struct {
+	Prefix   string   `json:"prefix"`
+	Prefixes []string `json:"prefixes"`
+	Regions  []string `json:"regions"`
+	Global   string   `json:"global"`
+}
+
+func (s *notarizeServer) handleProof(w http.ResponseWriter, r *http.Request) {
+	parts, ok := pathParts(r, "/v1/proofs/", 2)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !validRegion(parts[0]) {
+		http.Error(w, fmt.Sprintf("unknown region '%s'", parts[0]), http.StatusNotFound)
+		return
+	}
+	p, err := s.digests.Prove(parts[0], parts[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	v := proofView{Prefix: p.Prefix.String(), Global: p.Global.String()}
+	for _, d := range p.Prefixes {
+		v.Prefixes = append(v.Prefixes, d.String())
+	}
+	for _, d := range p.Regions {
+		v.Regions = append(v.Regions, d.String())
+	}
+	rows := []viewRow{{Label: "Proves", Value: v.Prefix, Link: summaryPath(p.Prefix.Region, p.Prefix.Prefix)}}
+	rows = append(rows, digestRows(p.Regions, p.Prefixes)...)
+	rows = append(rows, viewRow{Label: "Global", Value: v.Global, Link: summaryPath("", "")})
+	render(w, r, "Proof", v, rows)
+}
+
+// redirectToEntry redirects a successful POST to the canonical URL of the new
+// entry.
+func redirectToEntry(w http.ResponseWriter, r *http.Request, e entryindex.Entry) {
+	u := entryPath(e.DataSHA3512) + "?region=" + e.Location.Region
+	if f := r.URL.Query().Get("format"); f != "" {
+		u += "&format=" + f
+	}
+	http.Redirect(w, r, u, http.StatusSeeOther)
+}
@@ -96,6 +96,7 @@ resource "kubernetes_deployment" "fabula" {
                         "-packrpcport=28193",
                         "-controlport=7946", // serf default
                         "-bucket=${var.storage_bucket_name}",
+                        "-discovery=k8s:app=fabula",
                         "-usereventperiod=5s",
                         "-verbose",
                     ]
@@ -130,6 +131,15 @@ resource "kubernetes_deployment" "fabula" {
                         initial_delay_seconds = 3
                         period_seconds = 3
                     }
+
+                    readiness_probe {
+                        http_get {
+                            path = "/_readiness"
+                            port = 8080
+                        }
+                        initial_delay_seconds = 3
+                        period_seconds = 3
+                    }
                 }
                 container {
                     name = "esp"
@@ -1,29 +1,101 @@
 package atomicwriter
 
 import (
+	"bytes"
 	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 var errExist = os.ErrExist
+var errNotExist = os.ErrNotExist
+
+// ErrChanged is returned by Delete if the object no longer matches the
+// generation it was asked to delete.
+var ErrChanged = errors.New("atomicwriter: object changed")
 
 // DriverInterface is the interface an atomic writer driver fulfills. It can be
-// used to create atomic writers.
+// used to create atomic writers and to read the immutable objects they
+// commit.
+//
+// Object names are relative to the directory or prefix the driver was created
+// with and use "/" as a separator. Clients can use os.IsNotExist(err) to check
+// if an error was due to a missing object.
 type DriverInterface interface {
 	NewAtomicWriter(context.Context, string) (Interface, error)
 	Exists(context.Context, string) (bool, error)
+
+	// Open opens an object for reading length bytes starting at offset. If
+	// length is negative, the object is read to the end.
+	Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+
+	// Attrs returns the attributes of an object.
+	Attrs(ctx context.Context, name string) (Attrs, error)
+
+	// List returns an iterator over the attributes of objects whose names
+	// begin with prefix and are lexicographically greater than or equal to
+	// startOffset, in lexicographic order of name. The iterator returns
+	// iterator.Done when there are no more objects.
+	List(ctx context.Context, prefix, startOffset string) ObjectIterator
+
+	// Delete deletes the generation of an object described by attrs, as
+	// returned by Attrs or List. If the object has since been deleted and
+	// committed again, Delete returns ErrChanged and leaves it in place, so
+	// garbage collectors never delete objects they have not inspected.
+	Delete(ctx context.Context, attrs Attrs) error
+
+	// Compose atomically commits dst as the concatenation of the objects
+	// described by srcs. Like CloseAtomically, Compose fails with an error
+	// satisfying os.IsExist if dst exists. The checksum of dst is validated
+	// against the checksums of srcs, and if it does not match, dst is deleted
+	// and ErrChecksum is returned.
+	Compose(ctx context.Context, dst string, srcs []Attrs) (Attrs, error)
+}
+
+// Attrs are the attributes of a committed object.
+type Attrs struct {
+	Name    string
+	Size    int64
+	Created time.Time
+
+	// Generation distinguishes objects committed under the same name at
+	// different times.
+	Generation int64
+
+	// Metadata is the metadata set by Interface.SetMetadata, or nil.
+	Metadata map[string]string
+
+	// CRC32C is the CRC32C checksum of the object's data, if HasCRC32C is
+	// set. Atomic writers compute checksums as data is written, and reads of
+	// whole objects are verified against them, failing with ErrChecksum.
+	CRC32C    uint32
+	HasCRC32C bool
+}
+
+// ObjectIterator iterates over objects returned by DriverInterface.List.
+type ObjectIterator interface {
+	// Next returns the attributes of the next object, or iterator.Done if
+	// there are no more objects.
+	Next() (Attrs, error)
 }
 
 // Interface is the interface an individual atomic writer fulfills.
@@ -37,43 +109,140 @@ type Interface interface {
 	// Clients can use os.IsExist(err) to check if the error was due to a name
 	// conflict.
 	CloseAtomically() error
+
+	// Abort discards the object without committing it, releasing any
+	// resources held by the writer. Writers that are abandoned rather than
+	// committed should be aborted. Abort does nothing if called after
+	// CloseAtomically.
+	//
+	// Once CloseAtomically or Abort has been called, Write and
+	// CloseAtomically return an error.
+	Abort() error
+
+	// SetMetadata sets metadata to be committed with the object. It must be
+	// called before the first call to Write.
+	SetMetadata(map[string]string)
 }
 
 const fsPattern = ".atomicwritertmp-*"
 
+// Temp files older than fsStaleAge are assumed to have been left by writers
+// that crashed, and are removed when a driver is created.
+const fsStaleAge = 1 * time.Hour
+
+var errClosed = errors.New("atomicwriter: writer closed")
+
+// fsCrashPoint is called as an object is committed so that tests can simulate
+// crashes at each step.
+var fsCrashPoint = func(step string) {}
+
 type fsDriverObject struct {
-	path  string
-	tfile *os.File
+	path     string
+	tfile    *os.File // nil once committed or aborted
+	crc      hash.Hash32
+	metadata map[string]string
+}
+
+func (fdo *fsDriverObject) SetMetadata(m map[string]string) {
+	fdo.metadata = m
 }
 
 func (fdo *fsDriverObject) Write(b []byte) (int, error) {
-	return fdo.tfile.Write(b)
+	if fdo.tfile == nil {
+		return 0, errClosed
+	}
+	n, err := fdo.tfile.Write(b)
+	fdo.crc.Write(b[:n])
+	return n, err
 }
 
+// CloseAtomically syncs the temp file, links it into place and syncs the
+// directory containing it, so the object is durable once CloseAtomically
+// returns. If the process crashes first, either the object is not committed
+// or it is committed in full, and the temp file is left for sweep.
 func (fdo *fsDriverObject) CloseAtomically() error {
+	if fdo.tfile == nil {
+		return errClosed
+	}
+	// There's something on disk now, so ensure we cleanup. Once linked, the
+	// object is the file's other link.
+	defer fdo.Abort()
+
+	// Attributes are attached to the temp file so they are committed with the
+	// data when the file is linked below. Without extended attributes, objects
+	// can still be committed as long as they have no metadata, but they have
+	// no checksum.
+	xa, err := newFSXattrs(fdo.metadata, fdo.crc.Sum32())
+	if err == nil {
+		err = setXattrs(fdo.tfile, xa)
+	}
+	if err != nil && (fdo.metadata != nil || !xattrsUnsupported(err)) {
+		return err
+	}
+	fsCrashPoint("written")
 	if err := fdo.tfile.Sync(); err != nil {
 		return err
 	}
-	// there's something on disk now, so ensure we cleanup. We know this is a
-	// file so we don't need the extra protections os.Remove() provides.
-	defer syscall.Unlink(fdo.tfile.Name())
 	if err := fdo.tfile.Close(); err != nil {
 		return err // shouldn't happen, we sync above
 	}
+	fsCrashPoint("synced")
 	if err := os.Link(fdo.tfile.Name(), fdo.path); err != nil {
 		// Link will return something that satisfies os.IsExist(), so
 		return err
 	}
+	fsCrashPoint("linked")
+	if err := syncDir(filepath.Dir(fdo.path)); err != nil {
+		return err
+	}
+	fsCrashPoint("committed")
 	return nil
 }
 
+func (fdo *fsDriverObject) Abort() error {
+	if fdo.tfile == nil {
+		return nil
+	}
+	fdo.tfile.Close() // might already be closed
+	// We know this is a file so we don't need the extra protections
+	// os.Remove() provides.
+	err := syscall.Unlink(fdo.tfile.Name())
+	fdo.tfile = nil
+	return err
+}
+
+// fsXattrs are the attributes of a file system object stored in its extended
+// attributes.
+type fsXattrs struct {
+	Generation int64             `json:"generation"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	CRC32C     *uint32           `json:"crc32c,omitempty"`
+}
+
+// newFSXattrs returns attributes for a new object. Generations are random
+// since inode numbers are reused as soon as a file is deleted.
+func newFSXattrs(m map[string]string, crc uint32) (fsXattrs, error) {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return fsXattrs{}, err
+	}
+	return fsXattrs{
+		Generation: int64(binary.BigEndian.Uint64(b[:]) >> 1),
+		Metadata:   m,
+		CRC32C:     &crc,
+	}, nil
+}
+
 type fsDriver struct {
 	dir string
 }
 
 func (fd *fsDriver) NewAtomicWriter(_ context.Context, name string) (Interface, error) {
-	path := filepath.Join(fd.dir, name)
+	path := fd.path(name)
 	d := filepath.Dir(path) // name might include additional directory separators
+	if err := mkdirAll(d); err != nil {
+		return nil, err
+	}
 	tfile, err := ioutil.TempFile(d, fsPattern)
 	if err != nil {
 		return nil, err
@@ -81,11 +250,45 @@ func (fd *fsDriver) NewAtomicWriter(_ context.Context, name string) (Interface,
 	return &fsDriverObject{
 		path:  path,
 		tfile: tfile,
+		crc:   newCRC32C(),
 	}, nil
 }
 
+// mkdirAll is like os.MkdirAll, but syncs the parent of each directory it
+// creates so that objects committed in them are not lost with the directory
+// in a crash.
+func mkdirAll(dir string) error {
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil // created concurrently
+		}
+		return err
+	}
+	return syncDir(parent)
+}
+
+func (fd *fsDriver) path(name string) string {
+	return filepath.Join(fd.dir, filepath.FromSlash(name))
+}
+
 func (fd *fsDriver) Exists(_ context.Context, name string) (bool, error) {
-	_, err := os.Stat(filepath.Join(fd.dir, name))
+	_, err := os.Stat(fd.path(name))
 	if err == nil {
 		return true, nil
 	}
@@ -95,33 +298,244 @@ func (fd *fsDriver) Exists(_ context.Context, name string) (bool, error) {
 	return false, err
 }
 
+type fsReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (fd *fsDriver) Open(_ context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(fd.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		xa, _, err := getXattrs(f.Name())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if xa.CRC32C != nil {
+			return verify(f, offset, length, *xa.CRC32C), nil
+		}
+		return f, nil
+	}
+	return fsReader{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+func (fd *fsDriver) attrs(name string, fi os.FileInfo) (Attrs, error) {
+	xa, ok, err := getXattrs(fd.path(name))
+	if err != nil {
+		return Attrs{}, err
+	}
+	if !ok {
+		xa.Generation = fi.ModTime().UnixNano()
+	}
+	attrs := Attrs{
+		Name:       name,
+		Size:       fi.Size(),
+		Created:    fi.ModTime(),
+		Generation: xa.Generation,
+		Metadata:   xa.Metadata,
+	}
+	if xa.CRC32C != nil {
+		attrs.CRC32C, attrs.HasCRC32C = *xa.CRC32C, true
+	}
+	return attrs, nil
+}
+
+func (fd *fsDriver) Attrs(_ context.Context, name string) (Attrs, error) {
+	fi, err := os.Stat(fd.path(name))
+	if err != nil {
+		return Attrs{}, err
+	}
+	return fd.attrs(name, fi)
+}
+
+type fsIterator struct {
+	fd    *fsDriver
+	names []string
+	err   error
+}
+
+func (fi *fsIterator) Next() (Attrs, error) {
+	for {
+		if fi.err != nil {
+			return Attrs{}, fi.err
+		}
+		if len(fi.names) == 0 {
+			return Attrs{}, iterator.Done
+		}
+		name := fi.names[0]
+		fi.names = fi.names[1:]
+		info, err := os.Stat(fi.fd.path(name))
+		if os.IsNotExist(err) {
+			continue // deleted since listing
+		}
+		if err != nil {
+			return Attrs{}, err
+		}
+		return fi.fd.attrs(name, info)
+	}
+}
+
+// List walks the directory containing prefix, so it is only suitable for
+// modest numbers of objects (e.g. in development and tests).
+func (fd *fsDriver) List(_ context.Context, prefix, startOffset string) ObjectIterator {
+	// Objects matching prefix are under the directory part of prefix.
+	root := fd.dir
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		root = fd.path(prefix[:i])
+	}
+	r := &fsIterator{fd: fd}
+	r.err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(fd.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if ok, _ := filepath.Match(fsPattern, info.Name()); ok {
+			return nil
+		}
+		if strings.HasPrefix(name, prefix) && name >= startOffset {
+			r.names = append(r.names, name)
+		}
+		return nil
+	})
+	sort.Strings(r.names)
+	return r
+}
+
+// Delete compares generations before unlinking, which is sufficient as long
+// as an object is not concurrently deleted and committed again by another
+// client. On file systems without extended attributes, generations are
+// modification times and may not distinguish objects committed in quick
+// succession.
+func (fd *fsDriver) Delete(ctx context.Context, attrs Attrs) error {
+	current, err := fd.Attrs(ctx, attrs.Name)
+	if err != nil {
+		return err
+	}
+	if current.Generation != attrs.Generation {
+		return ErrChanged
+	}
+	path := fd.path(attrs.Name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func (fd *fsDriver) Compose(ctx context.Context, dst string, srcs []Attrs) (Attrs, error) {
+	return copyCompose(ctx, fd, dst, srcs)
+}
+
+// sweep removes temp files under fd.dir last modified before t, returning the
+// number removed.
+func (fd *fsDriver) sweep(t time.Time) (int, error) {
+	n := 0
+	err := filepath.Walk(fd.dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !info.ModTime().Before(t) {
+			return nil
+		}
+		if ok, _ := filepath.Match(fsPattern, info.Name()); !ok {
+			return nil
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
 // NewFileSystemDriver returns a new atomic writer backed by the local
 // file system.
+//
+// Temp files left in dir by writers that crashed are removed. Errors doing so
+// are ignored since they do not affect committed objects.
 func NewFileSystemDriver(dir string) DriverInterface {
-	return &fsDriver{dir: dir}
+	fd := &fsDriver{dir: dir}
+	fd.sweep(time.Now().Add(-fsStaleAge))
+	return fd
 }
 
+// Objects are buffered so that their checksum can be sent when the upload
+// starts, allowing Cloud Storage to reject uploads that were corrupted in
+// transit.
 type gsDriverObject struct {
-	obj    *storage.ObjectHandle
-	writer *storage.Writer
+	ctx      context.Context
+	obj      *storage.ObjectHandle
+	buf      bytes.Buffer
+	crc      hash.Hash32
+	metadata map[string]string
+	closed   bool // once committed or aborted
 }
 
 func (gsdo *gsDriverObject) Write(b []byte) (int, error) {
-	return gsdo.writer.Write(b)
+	if gsdo.closed {
+		return 0, errClosed
+	}
+	gsdo.crc.Write(b)
+	return gsdo.buf.Write(b)
+}
+
+func (gsdo *gsDriverObject) Abort() error {
+	gsdo.closed = true
+	gsdo.buf = bytes.Buffer{}
+	return nil
+}
+
+func (gsdo *gsDriverObject) SetMetadata(m map[string]string) {
+	gsdo.metadata = m
 }
 
 func (gsdo *gsDriverObject) CloseAtomically() error {
-	// Just close it. Atomicity is assured with the storage condition defined
-	// when creating the gsDriverObject in gsDriver.NewAtomicWriter().
+	if gsdo.closed {
+		return errClosed
+	}
+	gsdo.closed = true
+	// Atomicity is assured with the storage condition defined when creating
+	// the gsDriverObject in gsDriver.NewAtomicWriter().
+	w := gsdo.obj.NewWriter(gsdo.ctx)
+	w.Metadata = gsdo.metadata
+	w.CRC32C = gsdo.crc.Sum32()
+	w.SendCRC32C = true
+	if _, err := w.Write(gsdo.buf.Bytes()); err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+	return gsError(w.Close())
+}
 
-	err := gsdo.writer.Close()
+// gsError converts precondition failures to errExist.
+func gsError(err error) error {
 	switch ee := err.(type) {
 	case *googleapi.Error:
 		if ee.Code == http.StatusPreconditionFailed {
 			// TODO: can we determine if it was the DoesNotExist precondition
 			// specifically, as opposed to any other precondition? Maybe it's ok
-			// since this package is the only place where preconditions can be
-			// applied and we only set DoesNotExist in NewAtomicWriter.
+			// since this package only sets DoesNotExist when committing
+			// objects.
 			return errExist
 		}
 	}
@@ -133,18 +547,23 @@ type gsDriver struct {
 	prefix string
 }
 
+func (g *gsDriver) path(name string) string {
+	return path.Join(g.prefix, name)
+}
+
 func (g *gsDriver) NewAtomicWriter(ctx context.Context, name string) (Interface, error) {
-	path := filepath.Join(g.prefix, name)
+	path := g.path(name)
 	// Important: DoesNotExist condition here is needed for atomicity.
 	obj := g.bkt.Object(path).If(storage.Conditions{DoesNotExist: true})
 	return &gsDriverObject{
-		obj:    obj,
-		writer: obj.NewWriter(ctx),
+		ctx: ctx,
+		obj: obj,
+		crc: newCRC32C(),
 	}, nil
 }
 
 func (g *gsDriver) Exists(ctx context.Context, name string) (bool, error) {
-	_, err := g.bkt.Object(filepath.Join(g.prefix, name)).Attrs(ctx)
+	_, err := g.bkt.Object(g.path(name)).Attrs(ctx)
 	if err == nil {
 		return true, nil
 	}
@@ -154,6 +573,101 @@ func (g *gsDriver) Exists(ctx context.Context, name string) (bool, error) {
 	return false, err
 }
 
+// Open relies on the storage client, which verifies the checksums of whole
+// objects as they are read.
+func (g *gsDriver) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	r, err := g.bkt.Object(g.path(name)).NewRangeReader(ctx, offset, length)
+	if err == storage.ErrObjectNotExist {
+		return nil, errNotExist
+	}
+	return r, err
+}
+
+func (g *gsDriver) attrs(oa *storage.ObjectAttrs) Attrs {
+	return Attrs{
+		Name:       strings.TrimPrefix(oa.Name, g.objectPrefix()),
+		Size:       oa.Size,
+		Created:    oa.Created,
+		Generation: oa.Generation,
+		Metadata:   oa.Metadata,
+		CRC32C:     oa.CRC32C,
+		HasCRC32C:  true,
+	}
+}
+
+func (g *gsDriver) Attrs(ctx context.Context, name string) (Attrs, error) {
+	oa, err := g.bkt.Object(g.path(name)).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return Attrs{}, errNotExist
+	}
+	if err != nil {
+		return Attrs{}, err
+	}
+	return g.attrs(oa), nil
+}
+
+// objectPrefix returns the prefix of the names of objects in g.
+func (g *gsDriver) objectPrefix() string {
+	if g.prefix == "" {
+		return ""
+	}
+	return strings.TrimSuffix(g.prefix, "/") + "/"
+}
+
+type gsIterator struct {
+	g   *gsDriver
+	itr *storage.ObjectIterator
+}
+
+func (gi *gsIterator) Next() (Attrs, error) {
+	oa, err := gi.itr.Next()
+	if err != nil {
+		return Attrs{}, err
+	}
+	return gi.g.attrs(oa), nil
+}
+
+func (g *gsDriver) List(ctx context.Context, prefix, startOffset string) ObjectIterator {
+	q := &storage.Query{Prefix: g.objectPrefix() + prefix}
+	if startOffset != "" {
+		q.StartOffset = g.objectPrefix() + startOffset
+	}
+	return &gsIterator{g: g, itr: g.bkt.Objects(ctx, q)}
+}
+
+func (g *gsDriver) Delete(ctx context.Context, attrs Attrs) error {
+	obj := g.bkt.Object(g.path(attrs.Name))
+	err := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx)
+	switch ee := err.(type) {
+	case *googleapi.Error:
+		if ee.Code == http.StatusPreconditionFailed {
+			return ErrChanged
+		}
+	}
+	if err == storage.ErrObjectNotExist {
+		return errNotExist
+	}
+	return err
+}
+
+// Compose composes objects on the server, so it is limited to 32 sources.
+func (g *gsDriver) Compose(ctx context.Context, dst string, srcs []Attrs) (Attrs, error) {
+	srcs, err := composeSources(ctx, g, srcs)
+	if err != nil {
+		return Attrs{}, err
+	}
+	objs := make([]*storage.ObjectHandle, len(srcs))
+	for i, src := range srcs {
+		objs[i] = g.bkt.Object(g.path(src.Name)).Generation(src.Generation)
+	}
+	// Important: DoesNotExist condition here is needed for atomicity.
+	obj := g.bkt.Object(g.path(dst)).If(storage.Conditions{DoesNotExist: true})
+	if _, err := obj.ComposerFrom(objs...).Run(ctx); err != nil {
+		return Attrs{}, gsError(err)
+	}
+	return checkComposed(ctx, g, dst, srcs)
+}
+
 // ParseGcsURI parses a "gs://" URI into a bucket, name pair.
 // Inspired by:
 // https://github.com/GoogleCloudPlatform/gifinator/blob/master/internal/gcsref/gcsref.go#L37
@@ -190,17 +704,27 @@ func NewGCSDriver(ctx context.Context, dir string, opts ...option.ClientOption)
 		return nil, err
 	}
 	// TODO: specify Bucket().UserProject(cred.ProjectID)
+	return NewBucketDriver(gcsClient.Bucket(bucket), prefix), nil
+}
+
+// NewBucketDriver returns a new atomic writer backed by objects in bkt whose
+// names begin with prefix.
+func NewBucketDriver(bkt *storage.BucketHandle, prefix string) DriverInterface {
 	return &gsDriver{
-		bkt:    gcsClient.Bucket(bucket),
+		bkt:    bkt,
 		prefix: prefix,
-	}, nil
+	}
 }
 
-// NewDriver returns a driver for the specified path.
+// NewDriver returns a driver for the specified path, which may be a "gs://" or
+// "s3://" URI or a local directory. S3 drivers are configured from the
+// environment (see S3ConfigFromEnv).
 func NewDriver(ctx context.Context, dir string) (DriverInterface, error) {
 	switch {
 	case strings.HasPrefix(dir, "gs://"):
 		return NewGCSDriver(ctx, dir)
+	case strings.HasPrefix(dir, "s3://"):
+		return NewS3Driver(dir, S3ConfigFromEnv())
 	default:
 		return NewFileSystemDriver(dir), nil
 	}
@@ -3,11 +3,17 @@ package atomicwriter
 import (
 	"context"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
+
+	"google.golang.org/api/iterator"
 )
 
 const filenamePrefix = "_atomicwriter_test_tmp_"
@@ -242,3 +248,665 @@ func TestGCSUnderwrite(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func writeObject(t *testing.T, d DriverInterface, name, contents string, metadata map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+	w, err := d.NewAtomicWriter(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata != nil {
+		w.SetMetadata(metadata)
+	}
+	if _, err := w.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseAtomically(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemRead(t *testing.T) {
+	dir, cleanup := tempFileSystemWriter(t)
+	defer cleanup()
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	d := NewFileSystemDriver(dir)
+	metadata := map[string]string{"seqno": "7"}
+	writeObject(t, d, "a/b/object", "0123456789", metadata)
+
+	for _, c := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{3, -1, "3456789"},
+		{3, 4, "3456"},
+		{8, 10, "89"},
+	} {
+		r, err := d.Open(ctx, "a/b/object", c.offset, c.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.want {
+			t.Errorf("Open(%d, %d): expected %q, got %q", c.offset, c.length, c.want, got)
+		}
+	}
+	if _, err := d.Open(ctx, "a/b/missing", 0, -1); !os.IsNotExist(err) {
+		t.Errorf("expected os.IsNotExist, got %v", err)
+	}
+
+	attrs, err := d.Attrs(ctx, "a/b/object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Name != "a/b/object" || attrs.Size != 10 {
+		t.Errorf("bad attrs: %+v", attrs)
+	}
+	if !reflect.DeepEqual(attrs.Metadata, metadata) {
+		t.Errorf("expected metadata %v, got %v", metadata, attrs.Metadata)
+	}
+	if _, err := d.Attrs(ctx, "a/b/missing"); !os.IsNotExist(err) {
+		t.Errorf("expected os.IsNotExist, got %v", err)
+	}
+}
+
+func listNames(t *testing.T, d DriverInterface, prefix, startOffset string) []string {
+	t.Helper()
+	var names []string
+	itr := d.List(context.Background(), prefix, startOffset)
+	for {
+		attrs, err := itr.Next()
+		if err == iterator.Done {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, attrs.Name)
+	}
+}
+
+func TestFileSystemList(t *testing.T) {
+	dir, cleanup := tempFileSystemWriter(t)
+	defer cleanup()
+	defer os.RemoveAll(dir)
+
+	d := NewFileSystemDriver(dir)
+	for _, name := range []string{"NA/00-b", "NA/00-a", "NA/00-c", "NA/01-a", "NA/entries/x", "EU/00-a", "top"} {
+		writeObject(t, d, name, name, nil)
+	}
+	// An uncommitted writer should not be listed.
+	if _, err := d.NewAtomicWriter(context.Background(), "NA/00-d"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		prefix, startOffset string
+		want                []string
+	}{
+		{"NA/00-", "", []string{"NA/00-a", "NA/00-b", "NA/00-c"}},
+		{"NA/00-", "NA/00-b", []string{"NA/00-b", "NA/00-c"}},
+		{"NA/00-", "NA/00-z", nil},
+		{"NA/", "", []string{"NA/00-a", "NA/00-b", "NA/00-c", "NA/01-a", "NA/entries/x"}},
+		{"", "NA/01", []string{"NA/01-a", "NA/entries/x", "top"}},
+		{"SA/", "", nil},
+	} {
+		if got := listNames(t, d, c.prefix, c.startOffset); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("List(%q, %q): expected %v, got %v", c.prefix, c.startOffset, c.want, got)
+		}
+	}
+}
+
+func TestFileSystemDelete(t *testing.T) {
+	dir, cleanup := tempFileSystemWriter(t)
+	defer cleanup()
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	d := NewFileSystemDriver(dir)
+	writeObject(t, d, "garbage", "abc", nil)
+	stale, err := d.Attrs(ctx, "garbage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := d.Exists(ctx, "garbage"); err != nil || exists {
+		t.Fatalf("expected false,nil; got %t, %s", exists, err)
+	}
+	if err := d.Delete(ctx, stale); !os.IsNotExist(err) {
+		t.Errorf("expected os.IsNotExist, got %v", err)
+	}
+
+	// Committed again, so the stale attrs no longer describe the object.
+	writeObject(t, d, "garbage", "def", nil)
+	if err := d.Delete(ctx, stale); err != ErrChanged {
+		t.Errorf("expected ErrChanged, got %v", err)
+	}
+	if exists, err := d.Exists(ctx, "garbage"); err != nil || !exists {
+		t.Fatalf("expected true,nil; got %t, %s", exists, err)
+	}
+}
+
+func TestGCSReadListDelete(t *testing.T) {
+	if gcsBucket == "" {
+		t.Skip("no bucket specified, skipping GCS tests")
+		return
+	}
+
+	prefix := randFilename() + "/"
+	ctx := context.Background()
+
+	d, err := NewDriver(ctx, gcsBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := map[string]string{"seqno": "7"}
+	writeObject(t, d, prefix+"b", "0123456789", metadata)
+	writeObject(t, d, prefix+"a", "abc", nil)
+
+	r, err := d.Open(ctx, prefix+"b", 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "3456" {
+		t.Errorf("expected %q, got %q", "3456", got)
+	}
+	if _, err := d.Open(ctx, prefix+"missing", 0, -1); !os.IsNotExist(err) {
+		t.Errorf("expected os.IsNotExist, got %v", err)
+	}
+
+	attrs, err := d.Attrs(ctx, prefix+"b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Name != prefix+"b" || attrs.Size != 10 || !reflect.DeepEqual(attrs.Metadata, metadata) {
+		t.Errorf("bad attrs: %+v", attrs)
+	}
+
+	if names := listNames(t, d, prefix, prefix+"b"); !reflect.DeepEqual(names, []string{prefix + "b"}) {
+		t.Errorf("expected [%sb], got %v", prefix, names)
+	}
+	names := listNames(t, d, prefix, "")
+	if !reflect.DeepEqual(names, []string{prefix + "a", prefix + "b"}) {
+		t.Errorf("expected [%sa %sb], got %v", prefix, prefix, names)
+	}
+
+	stale := attrs
+	stale.Generation--
+	if err := d.Delete(ctx, stale); err != ErrChanged {
+		t.Errorf("expected ErrChanged, got %v", err)
+	}
+	for _, name := range names {
+		attrs, err := d.Attrs(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Delete(ctx, attrs); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// testDriver exercises the behavior common to all drivers.
+func testDriver(t *testing.T, d DriverInterface) {
+	ctx := context.Background()
+	metadata := map[string]string{"seqno": "7"}
+	writeObject(t, d, "NA/00-b", "0123456789", metadata)
+	writeObject(t, d, "NA/00-a", "abc", nil)
+	writeObject(t, d, "NA/01-a", "abc", nil)
+
+	// Overwrite
+	w, err := d.NewAtomicWriter(ctx, "NA/00-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseAtomically(); !os.IsExist(err) {
+		t.Errorf("expected os.IsExist, got %v", err)
+	}
+	if exists, err := d.Exists(ctx, "NA/00-c"); err != nil || exists {
+		t.Errorf("expected false,nil; got %t, %v", exists, err)
+	}
+
+	// Abort
+	w, err = d.NewAtomicWriter(ctx, "NA/00-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := d.Exists(ctx, "NA/00-c"); err != nil || exists {
+		t.Errorf("expected false,nil after abort; got %t, %v", exists, err)
+	}
+
+	// Read
+	for _, c := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{3, 4, "3456"},
+		{8, 10, "89"},
+		{3, 0, ""},
+	} {
+		r, err := d.Open(ctx, "NA/00-b", c.offset, c.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.want {
+			t.Errorf("Open(%d, %d): expected %q, got %q", c.offset, c.length, c.want, got)
+		}
+	}
+	if _, err := d.Open(ctx, "NA/00-c", 0, -1); !os.IsNotExist(err) {
+		t.Errorf("expected os.IsNotExist, got %v", err)
+	}
+	attrs, err := d.Attrs(ctx, "NA/00-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Name != "NA/00-b" || attrs.Size != 10 || !reflect.DeepEqual(attrs.Metadata, metadata) {
+		t.Errorf("bad attrs: %+v", attrs)
+	}
+	if want := crc32.Checksum([]byte("0123456789"), crc32cTable); !attrs.HasCRC32C || attrs.CRC32C != want {
+		t.Errorf("expected CRC32C %x, got %+v", want, attrs)
+	}
+
+	// List
+	if got, want := listNames(t, d, "NA/00-", "NA/00-b"), []string{"NA/00-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if got, want := listNames(t, d, "NA/", ""), []string{"NA/00-a", "NA/00-b", "NA/01-a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// Compose
+	var srcs []Attrs
+	itr := d.List(ctx, "NA/00-", "")
+	for {
+		attrs, err := itr.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, attrs)
+	}
+	composed, err := d.Compose(ctx, "NA/02-ab", srcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := crc32.Checksum([]byte("abc0123456789"), crc32cTable); composed.Size != 13 || composed.CRC32C != want {
+		t.Errorf("expected size 13 and CRC32C %x, got %+v", want, composed)
+	}
+	r, err := d.Open(ctx, "NA/02-ab", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != "abc0123456789" {
+		t.Errorf("expected %q, got %q, %v", "abc0123456789", got, err)
+	}
+	if _, err := d.Compose(ctx, "NA/02-ab", srcs); !os.IsExist(err) {
+		t.Errorf("expected os.IsExist, got %v", err)
+	}
+
+	// Delete
+	stale := attrs
+	stale.Generation--
+	if err := d.Delete(ctx, stale); err != ErrChanged {
+		t.Errorf("expected ErrChanged, got %v", err)
+	}
+	itr = d.List(ctx, "NA/", "")
+	for {
+		attrs, err := itr.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Delete(ctx, attrs); err != nil {
+			t.Error(err)
+		}
+	}
+	if names := listNames(t, d, "", ""); len(names) != 0 {
+		t.Errorf("expected no objects, got %v", names)
+	}
+}
+
+func TestMemoryDriver(t *testing.T) {
+	testDriver(t, NewMemoryDriver())
+}
+
+// testCorruption checks that reads of the whole object name, whose data has
+// been corrupted, fail.
+func testCorruption(t *testing.T, d DriverInterface, name string) {
+	ctx := context.Background()
+	r, err := d.Open(ctx, name, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != ErrChecksum {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+	r.Close()
+
+	// Ranges cannot be verified.
+	r, err = d.Open(ctx, name, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Error(err)
+	}
+	r.Close()
+
+	attrs, err := d.Attrs(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Compose(ctx, name+"-composed", []Attrs{attrs}); err != ErrChecksum {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+}
+
+func TestMemoryCorruption(t *testing.T) {
+	d := NewMemoryDriver()
+	writeObject(t, d, "corrupt", "abc", nil)
+	d.(*memDriver).objects["corrupt"].data[1] = 'x'
+	testCorruption(t, d, "corrupt")
+}
+
+func TestFileSystemCorruption(t *testing.T) {
+	dir, cleanup := tempFileSystemWriter(t)
+	defer cleanup()
+	defer os.RemoveAll(dir)
+
+	d := NewFileSystemDriver(dir)
+	writeObject(t, d, "corrupt", "abc", nil)
+	f, err := os.OpenFile(filepath.Join(dir, "corrupt"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	testCorruption(t, d, "corrupt")
+}
+
+func TestFileSystemDriver(t *testing.T) {
+	dir, cleanup := tempFileSystemWriter(t)
+	defer cleanup()
+	defer os.RemoveAll(dir)
+	testDriver(t, NewFileSystemDriver(dir))
+}
+
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var r []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ok, _ := filepath.Match(fsPattern, info.Name()); ok {
+			r = append(r, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// testAbort checks that an aborted writer commits nothing, even if it is
+// written to or closed afterwards.
+func testAbort(t *testing.T, d DriverInterface, name string) {
+	ctx := context.Background()
+	w, err := d.NewAtomicWriter(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("def")); err != errClosed {
+		t.Errorf("expected errClosed, got %v", err)
+	}
+	if err := w.CloseAtomically(); err != errClosed {
+		t.Errorf("expected errClosed, got %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Errorf("expected second abort to succeed, got %v", err)
+	}
+	if exists, err := d.Exists(ctx, name); err != nil || exists {
+		t.Errorf("expected false,nil after abort; got %t, %v", exists, err)
+	}
+
+	// The name can still be committed by another writer.
+	writeObject(t, d, name, "abc", nil)
+
+	// Aborting after committing leaves the object in place.
+	w, err = d.NewAtomicWriter(ctx, name+"-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseAtomically(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("def")); err != errClosed {
+		t.Errorf("expected errClosed, got %v", err)
+	}
+	if exists, err := d.Exists(ctx, name+"-b"); err != nil || !exists {
+		t.Errorf("expected true,nil; got %t, %v", exists, err)
+	}
+}
+
+func TestMemoryAbort(t *testing.T) {
+	testAbort(t, NewMemoryDriver(), "NA/00-a")
+}
+
+func TestGCSAbort(t *testing.T) {
+	if gcsBucket == "" {
+		t.Skip("no bucket specified, skipping GCS tests")
+		return
+	}
+	ctx := context.Background()
+	d, err := NewDriver(ctx, gcsBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := randFilename()
+	testAbort(t, d, name)
+	for _, n := range []string{name, name + "-b"} {
+		attrs, err := d.Attrs(ctx, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Delete(ctx, attrs); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFileSystemAbort(t *testing.T) {
+	dir, cleanup := tempFileSystemWriter(t)
+	defer cleanup()
+	defer os.RemoveAll(dir)
+
+	d := NewFileSystemDriver(dir)
+	w, err := d.NewAtomicWriter(context.Background(), "NA/00-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if temps := tempFiles(t, dir); len(temps) != 1 {
+		t.Fatalf("expected 1 temp file, got %v", temps)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if temps := tempFiles(t, dir); len(temps) != 0 {
+		t.Errorf("expected no temp files, got %v", temps)
+	}
+	if _, err := w.Write([]byte("def")); err != errClosed {
+		t.Errorf("expected errClosed, got %v", err)
+	}
+	if err := w.CloseAtomically(); err != errClosed {
+		t.Errorf("expected errClosed, got %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Errorf("expected second abort to succeed, got %v", err)
+	}
+
+	// Aborting after committing leaves the object in place.
+	w, err = d.NewAtomicWriter(context.Background(), "NA/00-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseAtomically(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := d.Exists(context.Background(), "NA/00-b"); err != nil || !exists {
+		t.Errorf("expected true,nil; got %t, %v", exists, err)
+	}
+}
+
+// Crash tests run the test binary again to commit an object, exiting with
+// crashExitCode at a step of CloseAtomically.
+const (
+	crashStepEnv  = "ATOMICWRITER_CRASH_STEP"
+	crashDirEnv   = "ATOMICWRITER_CRASH_DIR"
+	crashExitCode = 17
+)
+
+func crashWriter(step, dir string) {
+	fsCrashPoint = func(s string) {
+		if s == step {
+			os.Exit(crashExitCode)
+		}
+	}
+	d := NewFileSystemDriver(dir)
+	w, err := d.NewAtomicWriter(context.Background(), "NA/00-a")
+	if err != nil {
+		panic(err)
+	}
+	w.SetMetadata(map[string]string{"seqno": "7"})
+	if _, err := w.Write([]byte("abc")); err != nil {
+		panic(err)
+	}
+	if err := w.CloseAtomically(); err != nil {
+		panic(err)
+	}
+	os.Exit(0)
+}
+
+func TestFileSystemCrash(t *testing.T) {
+	if step := os.Getenv(crashStepEnv); step != "" {
+		crashWriter(step, os.Getenv(crashDirEnv))
+		return
+	}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		step      string
+		committed bool
+	}{
+		{"written", false},
+		{"synced", false},
+		{"linked", true},
+		{"committed", true},
+	} {
+		t.Run(c.step, func(t *testing.T) {
+			dir, cleanup := tempFileSystemWriter(t)
+			defer cleanup()
+			defer os.RemoveAll(dir)
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestFileSystemCrash$")
+			cmd.Env = append(os.Environ(), crashStepEnv+"="+c.step, crashDirEnv+"="+dir)
+			out, err := cmd.CombinedOutput()
+			if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != crashExitCode {
+				t.Fatalf("expected exit code %d, got %v: %s", crashExitCode, err, out)
+			}
+
+			// Restarting soon after the crash leaves the temp file, since
+			// it might belong to another writer.
+			d := NewFileSystemDriver(dir)
+			temps := tempFiles(t, dir)
+			if len(temps) != 1 {
+				t.Fatalf("expected 1 temp file, got %v", temps)
+			}
+			exists, err := d.Exists(ctx, "NA/00-a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists != c.committed {
+				t.Fatalf("expected committed %t, got %t", c.committed, exists)
+			}
+			if exists {
+				attrs, err := d.Attrs(ctx, "NA/00-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if attrs.Size != 3 || attrs.Metadata["seqno"] != "7" {
+					t.Errorf("bad attrs: %+v", attrs)
+				}
+			}
+			if names := listNames(t, d, "", ""); (len(names) == 1) != c.committed {
+				t.Errorf("unexpected objects: %v", names)
+			}
+
+			stale := time.Now().Add(-2 * fsStaleAge)
+			if err := os.Chtimes(temps[0], stale, stale); err != nil {
+				t.Fatal(err)
+			}
+			d = NewFileSystemDriver(dir)
+			if temps := tempFiles(t, dir); len(temps) != 0 {
+				t.Errorf("expected stale temp files to be swept, got %v", temps)
+			}
+			if exists, err := d.Exists(ctx, "NA/00-a"); err != nil || exists != c.committed {
+				t.Errorf("expected %t,nil after sweep; got %t, %v", c.committed, exists, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package atomicwriter
+
+import (
+	"context"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/vsekhar/fabula/internal/crc32combine"
+)
+
+// ErrChecksum is returned when the data of an object does not match its
+// CRC32C checksum.
+var ErrChecksum = errors.New("atomicwriter: checksum mismatch")
+
+// Checksums are CRC32C, as used by Cloud Storage.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func newCRC32C() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
+
+// crcReader verifies the checksum of an object as it is read to the end.
+type crcReader struct {
+	io.ReadCloser
+	h    hash.Hash32
+	want uint32
+}
+
+func (cr *crcReader) Read(b []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(b)
+	cr.h.Write(b[:n])
+	if err == io.EOF && cr.h.Sum32() != cr.want {
+		return n, ErrChecksum
+	}
+	return n, err
+}
+
+// verify wraps r, which reads an object from offset for length bytes, to
+// verify the object's checksum if r reads the whole object.
+func verify(r io.ReadCloser, offset, length int64, crc uint32) io.ReadCloser {
+	if offset != 0 || length >= 0 {
+		return r
+	}
+	return &crcReader{ReadCloser: r, h: newCRC32C(), want: crc}
+}
+
+// combinedCRC32C returns the checksum of the concatenation of srcs.
+func combinedCRC32C(srcs []Attrs) uint32 {
+	crc := srcs[0].CRC32C
+	for _, src := range srcs[1:] {
+		crc = crc32combine.Combine(crc, src.CRC32C, int(src.Size), crc32.Castagnoli)
+	}
+	return crc
+}
+
+// composeSources returns srcs with their checksums, fetching attributes of
+// sources without them.
+func composeSources(ctx context.Context, d DriverInterface, srcs []Attrs) ([]Attrs, error) {
+	if len(srcs) == 0 {
+		return nil, errors.New("atomicwriter: no sources to compose")
+	}
+	r := make([]Attrs, len(srcs))
+	for i, src := range srcs {
+		if !src.HasCRC32C {
+			var err error
+			if src, err = d.Attrs(ctx, src.Name); err != nil {
+				return nil, err
+			}
+			if src.Generation != srcs[i].Generation {
+				return nil, ErrChanged
+			}
+			if !src.HasCRC32C {
+				return nil, errors.New("atomicwriter: source " + src.Name + " has no checksum")
+			}
+		}
+		r[i] = src
+	}
+	return r, nil
+}
+
+// checkComposed verifies the checksum of dst, composed from srcs, deleting dst
+// if it does not match.
+func checkComposed(ctx context.Context, d DriverInterface, dst string, srcs []Attrs) (Attrs, error) {
+	attrs, err := d.Attrs(ctx, dst)
+	if err != nil {
+		return Attrs{}, err
+	}
+	if !attrs.HasCRC32C || attrs.CRC32C != combinedCRC32C(srcs) {
+		if err := d.Delete(ctx, attrs); err != nil {
+			return Attrs{}, err
+		}
+		return Attrs{}, ErrChecksum
+	}
+	return attrs, nil
+}
+
+// copyCompose composes dst by reading srcs and writing their data, for drivers
+// without a native compose operation.
+func copyCompose(ctx context.Context, d DriverInterface, dst string, srcs []Attrs) (Attrs, error) {
+	srcs, err := composeSources(ctx, d, srcs)
+	if err != nil {
+		return Attrs{}, err
+	}
+	w, err := d.NewAtomicWriter(ctx, dst)
+	if err != nil {
+		return Attrs{}, err
+	}
+	for _, src := range srcs {
+		r, err := d.Open(ctx, src.Name, 0, -1)
+		if err != nil {
+			w.Abort()
+			return Attrs{}, err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			w.Abort()
+			return Attrs{}, err
+		}
+	}
+	if err := w.CloseAtomically(); err != nil {
+		return Attrs{}, err
+	}
+	return checkComposed(ctx, d, dst, srcs)
+}
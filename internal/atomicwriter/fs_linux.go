@@ -0,0 +1,6 @@
+package atomicwriter
+
+import "golang.org/x/sys/unix"
+
+// errNoXattr is returned when a file does not have an extended attribute.
+const errNoXattr = unix.ENODATA
@@ -0,0 +1,28 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package atomicwriter
+
+import (
+	"errors"
+	"os"
+)
+
+var errXattrsUnsupported = errors.New("atomicwriter: extended attributes not supported on this platform")
+
+func setXattrs(*os.File, fsXattrs) error {
+	return errXattrsUnsupported
+}
+
+func getXattrs(string) (fsXattrs, bool, error) {
+	return fsXattrs{}, false, nil
+}
+
+func xattrsUnsupported(err error) bool {
+	return err == errXattrsUnsupported
+}
+
+// syncDir does nothing since directories cannot be synced on all platforms.
+func syncDir(string) error {
+	return nil
+}
@@ -0,0 +1,69 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package atomicwriter
+
+import (
+	"encoding/json"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Attributes of file system objects are stored in an extended attribute of the
+// file, so that they are linked into place atomically with the file's
+// contents.
+const attrsXattr = "user.atomicwriter"
+
+func setXattrs(f *os.File, xa fsXattrs) error {
+	buf, err := json.Marshal(xa)
+	if err != nil {
+		return err
+	}
+	if err := unix.Fsetxattr(int(f.Fd()), attrsXattr, buf, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+func getXattrs(path string) (xa fsXattrs, ok bool, err error) {
+	sz, err := unix.Getxattr(path, attrsXattr, nil)
+	if err == errNoXattr || err == unix.ENOTSUP {
+		return fsXattrs{}, false, nil
+	}
+	if err != nil {
+		return fsXattrs{}, false, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	buf := make([]byte, sz)
+	sz, err = unix.Getxattr(path, attrsXattr, buf)
+	if err != nil {
+		return fsXattrs{}, false, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	if err := json.Unmarshal(buf[:sz], &xa); err != nil {
+		return fsXattrs{}, false, err
+	}
+	return xa, true, nil
+}
+
+// xattrsUnsupported reports whether err means the file system does not support
+// extended attributes.
+func xattrsUnsupported(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == unix.ENOTSUP
+	}
+	return false
+}
+
+// syncDir syncs the directory dir, making the creation and removal of links
+// in it durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+package atomicwriter
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+type memObject struct {
+	data       []byte
+	created    time.Time
+	generation int64
+	metadata   map[string]string
+	crc        uint32
+}
+
+type memDriverObject struct {
+	d        *memDriver
+	name     string
+	buf      bytes.Buffer
+	metadata map[string]string
+	closed   bool // once committed or aborted
+}
+
+func (mdo *memDriverObject) Write(b []byte) (int, error) {
+	if mdo.closed {
+		return 0, errClosed
+	}
+	return mdo.buf.Write(b)
+}
+
+func (mdo *memDriverObject) Abort() error {
+	mdo.closed = true
+	mdo.buf = bytes.Buffer{}
+	return nil
+}
+
+func (mdo *memDriverObject) SetMetadata(m map[string]string) {
+	mdo.metadata = m
+}
+
+func (mdo *memDriverObject) CloseAtomically() error {
+	if mdo.closed {
+		return errClosed
+	}
+	mdo.closed = true
+	d := mdo.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.objects[mdo.name]; ok {
+		return errExist
+	}
+	d.generation++
+	d.objects[mdo.name] = &memObject{
+		data:       mdo.buf.Bytes(),
+		created:    time.Now(),
+		generation: d.generation,
+		metadata:   mdo.metadata,
+		crc:        crc32.Checksum(mdo.buf.Bytes(), crc32cTable),
+	}
+	return nil
+}
+
+type memDriver struct {
+	mu         sync.Mutex
+	objects    map[string]*memObject
+	generation int64 // of the most recently committed object
+}
+
+func (d *memDriver) get(name string) (*memObject, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	o, ok := d.objects[name]
+	if !ok {
+		return nil, errNotExist
+	}
+	return o, nil
+}
+
+func (d *memDriver) NewAtomicWriter(_ context.Context, name string) (Interface, error) {
+	return &memDriverObject{d: d, name: name}, nil
+}
+
+func (d *memDriver) Exists(_ context.Context, name string) (bool, error) {
+	_, err := d.get(name)
+	return err == nil, nil
+}
+
+func (d *memDriver) Open(_ context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	o, err := d.get(name)
+	if err != nil {
+		return nil, err
+	}
+	// Object data is never modified once committed, so it can be read
+	// without holding d.mu.
+	data := o.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return verify(ioutil.NopCloser(bytes.NewReader(data)), offset, length, o.crc), nil
+}
+
+func (o *memObject) attrs(name string) Attrs {
+	return Attrs{
+		Name:       name,
+		Size:       int64(len(o.data)),
+		Created:    o.created,
+		Generation: o.generation,
+		Metadata:   o.metadata,
+		CRC32C:     o.crc,
+		HasCRC32C:  true,
+	}
+}
+
+func (d *memDriver) Attrs(_ context.Context, name string) (Attrs, error) {
+	o, err := d.get(name)
+	if err != nil {
+		return Attrs{}, err
+	}
+	return o.attrs(name), nil
+}
+
+type memIterator struct {
+	attrs []Attrs
+}
+
+func (mi *memIterator) Next() (Attrs, error) {
+	if len(mi.attrs) == 0 {
+		return Attrs{}, iterator.Done
+	}
+	r := mi.attrs[0]
+	mi.attrs = mi.attrs[1:]
+	return r, nil
+}
+
+func (d *memDriver) List(_ context.Context, prefix, startOffset string) ObjectIterator {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := &memIterator{}
+	for name, o := range d.objects {
+		if strings.HasPrefix(name, prefix) && name >= startOffset {
+			r.attrs = append(r.attrs, o.attrs(name))
+		}
+	}
+	sort.Slice(r.attrs, func(i, j int) bool {
+		return r.attrs[i].Name < r.attrs[j].Name
+	})
+	return r
+}
+
+func (d *memDriver) Delete(_ context.Context, attrs Attrs) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	o, ok := d.objects[attrs.Name]
+	if !ok {
+		return errNotExist
+	}
+	if o.generation != attrs.Generation {
+		return ErrChanged
+	}
+	delete(d.objects, attrs.Name)
+	return nil
+}
+
+func (d *memDriver) Compose(ctx context.Context, dst string, srcs []Attrs) (Attrs, error) {
+	return copyCompose(ctx, d, dst, srcs)
+}
+
+// NewMemoryDriver returns a new atomic writer that stores objects in memory.
+// It is intended for tests.
+func NewMemoryDriver() DriverInterface {
+	return &memDriver{objects: make(map[string]*memObject)}
+}
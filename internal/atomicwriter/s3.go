@@ -0,0 +1,560 @@
+package atomicwriter
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+// S3Config configures an S3-compatible driver.
+type S3Config struct {
+	// Endpoint is the URL of the S3 service, e.g. "https://s3.amazonaws.com"
+	// or "http://localhost:9000" for a local MinIO server. Buckets are
+	// addressed by path.
+	Endpoint string
+
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // optional
+
+	// Client is used to make requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// S3ConfigFromEnv returns an S3Config from the standard AWS environment
+// variables.
+func S3ConfigFromEnv() S3Config {
+	cfg := S3Config{
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL_S3"),
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	return cfg
+}
+
+// s3Error is an error response from an S3 service.
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %s: %s (status %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// S3 does not support streaming uploads of unknown length without chunked
+// signing, so objects are buffered and uploaded when committed.
+type s3DriverObject struct {
+	ctx      context.Context // of NewAtomicWriter, bounding the upload
+	s        *s3Driver
+	name     string
+	buf      bytes.Buffer
+	crc      hash.Hash32
+	metadata map[string]string
+	closed   bool // once committed or aborted
+}
+
+func (sdo *s3DriverObject) Write(b []byte) (int, error) {
+	if sdo.closed {
+		return 0, errClosed
+	}
+	sdo.crc.Write(b)
+	return sdo.buf.Write(b)
+}
+
+func (sdo *s3DriverObject) Abort() error {
+	sdo.closed = true
+	sdo.buf = bytes.Buffer{}
+	return nil
+}
+
+func (sdo *s3DriverObject) SetMetadata(m map[string]string) {
+	sdo.metadata = m
+}
+
+func (sdo *s3DriverObject) CloseAtomically() error {
+	if sdo.closed {
+		return errClosed
+	}
+	sdo.closed = true
+	h := make(http.Header)
+	// Important: If-None-Match condition here is needed for atomicity.
+	h.Set("If-None-Match", "*")
+	// The service rejects the upload if the data does not match.
+	h.Set(s3ChecksumHeader, encodeS3Checksum(sdo.crc.Sum32()))
+	for k, v := range sdo.metadata {
+		h.Set("X-Amz-Meta-"+k, v)
+	}
+	resp, err := sdo.s.do(sdo.ctx, http.MethodPut, sdo.name, nil, h, sdo.buf.Bytes())
+	if conditionFailed(err) {
+		return errExist
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// conditionFailed returns true if err is the service refusing a conditional
+// request. The service answers 412 if the condition does not hold, and 409 if
+// another conditional request for the same key is in progress, which may yet
+// make it not hold.
+func conditionFailed(err error) bool {
+	e, ok := err.(*s3Error)
+	return ok && (e.StatusCode == http.StatusPreconditionFailed || e.StatusCode == http.StatusConflict)
+}
+
+type s3Driver struct {
+	cfg      S3Config
+	endpoint *url.URL
+	bucket   string
+	prefix   string // empty or ending in "/"
+}
+
+func (s *s3Driver) key(name string) string {
+	return s.prefix + name
+}
+
+// do sends a signed request for key to the service, returning an error if the
+// response is not successful.
+func (s *s3Driver) do(ctx context.Context, method, key string, query url.Values, h http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = awsEscapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	signV4(req, s.cfg, body, time.Now())
+
+	client := s.cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	e := &s3Error{StatusCode: resp.StatusCode}
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err := xml.Unmarshal(buf, e); err != nil || e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusNotFound && e.Code != "NoSuchBucket" {
+		return nil, errNotExist
+	}
+	return nil, e
+}
+
+func (s *s3Driver) NewAtomicWriter(ctx context.Context, name string) (Interface, error) {
+	return &s3DriverObject{ctx: ctx, s: s, name: s.key(name), crc: newCRC32C()}, nil
+}
+
+func (s *s3Driver) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.Attrs(ctx, name)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *s3Driver) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		// Ranges cannot be empty, so only check that the object exists.
+		if _, err := s.Attrs(ctx, name); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	h := make(http.Header)
+	h.Set("X-Amz-Checksum-Mode", "ENABLED")
+	if length > 0 {
+		h.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		h.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.key(name), nil, h, nil)
+	if e, ok := err.(*s3Error); ok && e.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil // offset past the end
+	}
+	if err != nil {
+		return nil, err
+	}
+	if crc, ok := decodeS3Checksum(resp.Header); ok {
+		return verify(resp.Body, offset, length, crc), nil
+	}
+	return resp.Body, nil
+}
+
+// s3Generation derives a generation from an object's ETag and modification
+// time, since S3 objects in unversioned buckets have no generation of their
+// own. Both are reported (with different precision) by HEAD and by listing.
+func s3Generation(etag string, modified time.Time) int64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s %d", etag, modified.Unix())
+	return int64(h.Sum64() >> 1)
+}
+
+func (s *s3Driver) Attrs(ctx context.Context, name string) (Attrs, error) {
+	attrs, _, err := s.head(ctx, name)
+	return attrs, err
+}
+
+// head returns the attributes and ETag of an object.
+func (s *s3Driver) head(ctx context.Context, name string) (Attrs, string, error) {
+	h := make(http.Header)
+	h.Set("X-Amz-Checksum-Mode", "ENABLED")
+	resp, err := s.do(ctx, http.MethodHead, s.key(name), nil, h, nil)
+	if err != nil {
+		return Attrs{}, "", err
+	}
+	resp.Body.Close()
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return Attrs{}, "", err
+	}
+	etag := resp.Header.Get("ETag")
+	attrs := Attrs{
+		Name:       name,
+		Size:       resp.ContentLength,
+		Created:    modified,
+		Generation: s3Generation(etag, modified),
+	}
+	attrs.CRC32C, attrs.HasCRC32C = decodeS3Checksum(resp.Header)
+	for k, v := range resp.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") && len(v) > 0 {
+			if attrs.Metadata == nil {
+				attrs.Metadata = make(map[string]string)
+			}
+			attrs.Metadata[strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))] = v[0]
+		}
+	}
+	return attrs, etag, nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+// s3Iterator lists a page of objects at a time. Listing does not return
+// metadata or checksums, so attributes returned by s3Iterator have nil
+// Metadata and no CRC32C.
+type s3Iterator struct {
+	ctx         context.Context
+	s           *s3Driver
+	prefix      string
+	startOffset string
+
+	page  []Attrs
+	token string
+	done  bool
+	err   error
+}
+
+func (si *s3Iterator) Next() (Attrs, error) {
+	for len(si.page) == 0 {
+		if si.err != nil {
+			return Attrs{}, si.err
+		}
+		if si.done {
+			return Attrs{}, iterator.Done
+		}
+		si.err = si.fetch()
+	}
+	r := si.page[0]
+	si.page = si.page[1:]
+	return r, nil
+}
+
+func (si *s3Iterator) fetch() error {
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("prefix", si.s.key(si.prefix))
+	if si.token != "" {
+		q.Set("continuation-token", si.token)
+	} else if si.startOffset != "" {
+		// start-after is exclusive, so start after a prefix of startOffset
+		// and skip names before it below.
+		q.Set("start-after", si.s.key(si.startOffset[:len(si.startOffset)-1]))
+	}
+	resp, err := si.s.do(si.ctx, http.MethodGet, "", q, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	for _, c := range result.Contents {
+		name := strings.TrimPrefix(c.Key, si.s.prefix)
+		if name < si.startOffset {
+			continue
+		}
+		si.page = append(si.page, Attrs{
+			Name:       name,
+			Size:       c.Size,
+			Created:    c.LastModified,
+			Generation: s3Generation(c.ETag, c.LastModified),
+		})
+	}
+	si.token = result.NextContinuationToken
+	si.done = !result.IsTruncated || si.token == ""
+	return nil
+}
+
+func (s *s3Driver) List(ctx context.Context, prefix, startOffset string) ObjectIterator {
+	return &s3Iterator{ctx: ctx, s: s, prefix: prefix, startOffset: startOffset}
+}
+
+func (s *s3Driver) Delete(ctx context.Context, attrs Attrs) error {
+	current, etag, err := s.head(ctx, attrs.Name)
+	if err != nil {
+		return err
+	}
+	if current.Generation != attrs.Generation {
+		return ErrChanged
+	}
+	h := make(http.Header)
+	h.Set("If-Match", etag)
+	resp, err := s.do(ctx, http.MethodDelete, s.key(attrs.Name), nil, h, nil)
+	if conditionFailed(err) {
+		return ErrChanged
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Driver) Compose(ctx context.Context, dst string, srcs []Attrs) (Attrs, error) {
+	return copyCompose(ctx, s, dst, srcs)
+}
+
+const s3ChecksumHeader = "X-Amz-Checksum-Crc32c"
+
+func encodeS3Checksum(crc uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], crc)
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// decodeS3Checksum returns the checksum of the object in a response, if any.
+// Checksums are only returned for whole objects.
+func decodeS3Checksum(h http.Header) (uint32, bool) {
+	b, err := base64.StdEncoding.DecodeString(h.Get(s3ChecksumHeader))
+	if err != nil || len(b) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b), true
+}
+
+// parseS3URI parses an "s3://" URI into a bucket, prefix pair.
+func parseS3URI(uri string) (bucket, prefix string, err error) {
+	const scheme = "s3://"
+	if !strings.HasPrefix(uri, scheme) {
+		return "", "", fmt.Errorf("bad S3 URI %q: scheme is not %q", uri, scheme)
+	}
+	uri = uri[len(scheme):]
+	i := strings.IndexByte(uri, '/')
+	if i == -1 {
+		return uri, "", nil
+	}
+	return uri[:i], uri[i+1:], nil
+}
+
+// NewS3Driver returns a new atomic writer backed by an S3-compatible service.
+// The service must support conditional writes (If-None-Match) and, for
+// Delete, conditional deletes (If-Match). As in S3, metadata keys are case
+// insensitive and are returned in lower case.
+func NewS3Driver(dir string, cfg S3Config) (DriverInterface, error) {
+	bucket, prefix, err := parseS3URI(dir)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("bad S3 URI %q: no bucket", dir)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Driver{
+		cfg:      cfg,
+		endpoint: endpoint,
+		bucket:   bucket,
+		prefix:   prefix,
+	}, nil
+}
+
+// AWS Signature Version 4. See:
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	amzDayFormat    = "20060102"
+	sigV4Terminator = "aws4_request"
+)
+
+// signV4 signs req, which will be sent with body at time now.
+func signV4(req *http.Request, cfg S3Config, body []byte, now time.Time) {
+	now = now.UTC()
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery, // already canonical, see canonicalQuery
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{now.Format(amzDayFormat), cfg.Region, "s3", sigV4Terminator}, "/")
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		now.Format(amzDateFormat),
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + cfg.SecretAccessKey)
+	for _, s := range []string{now.Format(amzDayFormat), cfg.Region, "s3", sigV4Terminator} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// awsEscape escapes s as required by Signature Version 4, escaping "/" only if
+// escapeSlash is set.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func awsEscapePath(p string) string {
+	return awsEscape(p, false)
+}
+
+// canonicalQuery encodes q sorted by key, as required by Signature Version 4.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
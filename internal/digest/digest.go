@@ -0,0 +1,306 @@
+// Package digest computes and formats digests of the log.
+//
+// The log is split by region and then by prefix. A digest of a prefix chain is
+// reported as:
+//
+//	<region>:<prefix>:<number of entries in chain>:<last timestamp>:<SHA3512>
+//
+// Digests of prefix chains in a region are combined into a regional digest:
+//
+//	<region>:<last timestamp>:<SHA3512>
+//
+// And regional digests are combined into the global digest:
+//
+//	<last timestamp>:<SHA3512>
+//
+// Timestamps are encoded using package timestamp. SHA3512 values are URL-safe
+// base64-encoded (RFC 4648 §5) with no padding.
+package digest
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/fabula/pkg/timestamp"
+)
+
+const separator = ":"
+
+var encoding = base64.RawURLEncoding
+
+// Prefix is the digest of a single prefix chain within a region.
+type Prefix struct {
+	Region        string
+	Prefix        string
+	Entries       uint64
+	LastTimestamp time.Time
+	SHA3512       []byte
+}
+
+func (p Prefix) String() string {
+	return strings.Join([]string{
+		p.Region,
+		p.Prefix,
+		strconv.FormatUint(p.Entries, 10),
+		timestamp.ToString(p.LastTimestamp),
+		encoding.EncodeToString(p.SHA3512),
+	}, separator)
+}
+
+// ParsePrefix parses a prefix digest produced by Prefix.String.
+func ParsePrefix(s string) (Prefix, error) {
+	parts := strings.Split(s, separator)
+	if len(parts) != 5 {
+		return Prefix{}, fmt.Errorf("digest: expected 5 fields in prefix digest, got %d", len(parts))
+	}
+	n, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return Prefix{}, fmt.Errorf("digest: bad entry count: %w", err)
+	}
+	ts, h, err := parseTail(parts[3:])
+	if err != nil {
+		return Prefix{}, err
+	}
+	return Prefix{
+		Region:        parts[0],
+		Prefix:        parts[1],
+		Entries:       n,
+		LastTimestamp: ts,
+		SHA3512:       h,
+	}, nil
+}
+
+// Region is the digest of all prefix chains within a region.
+type Region struct {
+	Region        string
+	LastTimestamp time.Time
+	SHA3512       []byte
+}
+
+func (r Region) String() string {
+	return strings.Join([]string{
+		r.Region,
+		timestamp.ToString(r.LastTimestamp),
+		encoding.EncodeToString(r.SHA3512),
+	}, separator)
+}
+
+// ParseRegion parses a regional digest produced by Region.String.
+func ParseRegion(s string) (Region, error) {
+	parts := strings.Split(s, separator)
+	if len(parts) != 3 {
+		return Region{}, fmt.Errorf("digest: expected 3 fields in region digest, got %d", len(parts))
+	}
+	ts, h, err := parseTail(parts[1:])
+	if err != nil {
+		return Region{}, err
+	}
+	return Region{
+		Region:        parts[0],
+		LastTimestamp: ts,
+		SHA3512:       h,
+	}, nil
+}
+
+// Global is the digest of all regions.
+type Global struct {
+	LastTimestamp time.Time
+	SHA3512       []byte
+}
+
+func (g Global) String() string {
+	return strings.Join([]string{
+		timestamp.ToString(g.LastTimestamp),
+		encoding.EncodeToString(g.SHA3512),
+	}, separator)
+}
+
+// ParseGlobal parses a global digest produced by Global.String.
+func ParseGlobal(s string) (Global, error) {
+	parts := strings.Split(s, separator)
+	if len(parts) != 2 {
+		return Global{}, fmt.Errorf("digest: expected 2 fields in global digest, got %d", len(parts))
+	}
+	ts, h, err := parseTail(parts)
+	if err != nil {
+		return Global{}, err
+	}
+	return Global{LastTimestamp: ts, SHA3512: h}, nil
+}
+
+func parseTail(parts []string) (time.Time, []byte, error) {
+	ts, err := timestamp.FromString(parts[0])
+	if err != nil {
+		return time.Time{}, nil, fmt.Errorf("digest: bad timestamp: %w", err)
+	}
+	h, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, nil, fmt.Errorf("digest: bad hash: %w", err)
+	}
+	return ts, h, nil
+}
+
+// OfRegion combines digests of prefix chains into a digest of region.
+//
+// All prefix digests must belong to region, and each prefix may appear at most
+// once. The order of prefixes does not affect the result.
+func OfRegion(region string, prefixes []Prefix) (Region, error) {
+	if strings.Contains(region, separator) {
+		return Region{}, fmt.Errorf("digest: region name %q contains %q", region, separator)
+	}
+	ps := make([]Prefix, len(prefixes))
+	copy(ps, prefixes)
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Prefix < ps[j].Prefix })
+
+	r := Region{Region: region}
+	h := sha3.New512()
+	for i, p := range ps {
+		if p.Region != region {
+			return Region{}, fmt.Errorf("digest: prefix %q is in region %q, expected %q", p.Prefix, p.Region, region)
+		}
+		if i > 0 && ps[i-1].Prefix == p.Prefix {
+			return Region{}, fmt.Errorf("digest: duplicate prefix %q", p.Prefix)
+		}
+		if p.LastTimestamp.After(r.LastTimestamp) {
+			r.LastTimestamp = p.LastTimestamp
+		}
+		h.Write([]byte(p.String()))
+		h.Write([]byte{'\n'})
+	}
+	r.SHA3512 = h.Sum(nil)
+	return r, nil
+}
+
+// OfGlobal combines regional digests into the global digest.
+//
+// Each region may appear at most once. The order of regions does not affect
+// the result.
+func OfGlobal(regions []Region) (Global, error) {
+	rs := make([]Region, len(regions))
+	copy(rs, regions)
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Region < rs[j].Region })
+
+	var g Global
+	h := sha3.New512()
+	for i, r := range rs {
+		if i > 0 && rs[i-1].Region == r.Region {
+			return Global{}, fmt.Errorf("digest: duplicate region %q", r.Region)
+		}
+		if r.LastTimestamp.After(g.LastTimestamp) {
+			g.LastTimestamp = r.LastTimestamp
+		}
+		h.Write([]byte(r.String()))
+		h.Write([]byte{'\n'})
+	}
+	g.SHA3512 = h.Sum(nil)
+	return g, nil
+}
+
+// Equal returns true if r and o are the same regional digest.
+func (r Region) Equal(o Region) bool {
+	return r.Region == o.Region &&
+		r.LastTimestamp.Equal(o.LastTimestamp) &&
+		bytes.Equal(r.SHA3512, o.SHA3512)
+}
+
+// Table holds the latest known digest of each prefix chain in each region.
+//
+// It is safe to use a Table from multiple goroutines.
+type Table struct {
+	mu       sync.Mutex
+	prefixes map[string]map[string]Prefix // map[region]map[prefix]Prefix
+}
+
+// NewTable returns a new empty Table.
+func NewTable() *Table {
+	return &Table{prefixes: make(map[string]map[string]Prefix)}
+}
+
+// Update records p if it is more recent than the digest currently held for its
+// prefix chain. Update returns true if p was recorded.
+func (t *Table) Update(p Prefix) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ps, ok := t.prefixes[p.Region]
+	if !ok {
+		ps = make(map[string]Prefix)
+		t.prefixes[p.Region] = ps
+	}
+	if cur, ok := ps[p.Prefix]; ok && p.Entries <= cur.Entries {
+		return false
+	}
+	ps[p.Prefix] = p
+	return true
+}
+
+// Region returns the digest of region computed from the prefix chains held for
+// that region.
+func (t *Table) Region(region string) (Region, error) {
+	t.mu.Lock()
+	ps := make([]Prefix, 0, len(t.prefixes[region]))
+	for _, p := range t.prefixes[region] {
+		ps = append(ps, p)
+	}
+	t.mu.Unlock()
+	return OfRegion(region, ps)
+}
+
+// Regions returns the digests of each region held in the table, ordered by
+// region.
+func (t *Table) Regions() ([]Region, error) {
+	t.mu.Lock()
+	names := make([]string, 0, len(t.prefixes))
+	for r := range t.prefixes {
+		names = append(names, r)
+	}
+	t.mu.Unlock()
+	sort.Strings(names)
+
+	rs := make([]Region, 0, len(names))
+	for _, n := range names {
+		r, err := t.Region(n)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// Global returns the global digest combining the digests of each region held
+// in the table.
+func (t *Table) Global() (Global, error) {
+	rs, err := t.Regions()
+	if err != nil {
+		return Global{}, err
+	}
+	return OfGlobal(rs)
+}
+
+// Prefix returns the digest held for the prefix chain prefix in region.
+func (t *Table) Prefix(region, prefix string) (Prefix, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.prefixes[region][prefix]
+	return p, ok
+}
+
+// Prefixes returns the digests of each prefix chain held for region, ordered
+// by prefix.
+func (t *Table) Prefixes(region string) []Prefix {
+	t.mu.Lock()
+	ps := make([]Prefix, 0, len(t.prefixes[region]))
+	for _, p := range t.prefixes[region] {
+		ps = append(ps, p)
+	}
+	t.mu.Unlock()
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Prefix < ps[j].Prefix })
+	return ps
+}
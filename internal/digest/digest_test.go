@@ -0,0 +1,154 @@
+package digest_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/digest"
+)
+
+func hash(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 64)
+}
+
+func TestRoundTrip(t *testing.T) {
+	ts := time.Unix(1608000000, 123456789).UTC()
+
+	p := digest.Prefix{Region: "NA", Prefix: "a1", Entries: 15673, LastTimestamp: ts, SHA3512: hash(1)}
+	gp, err := digest.ParsePrefix(p.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gp.String() != p.String() {
+		t.Errorf("expected %s, got %s", p, gp)
+	}
+
+	r := digest.Region{Region: "EU", LastTimestamp: ts, SHA3512: hash(2)}
+	gr, err := digest.ParseRegion(r.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gr.Equal(r) {
+		t.Errorf("expected %s, got %s", r, gr)
+	}
+
+	g := digest.Global{LastTimestamp: ts, SHA3512: hash(3)}
+	gg, err := digest.ParseGlobal(g.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gg.String() != g.String() {
+		t.Errorf("expected %s, got %s", g, gg)
+	}
+
+	for _, bad := range []string{"", "NA:1", "NA:x:AAAA", "NA:1:!!"} {
+		if _, err := digest.ParseRegion(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestOfRegion(t *testing.T) {
+	t1 := time.Unix(100, 0)
+	t2 := time.Unix(200, 0)
+	a := digest.Prefix{Region: "NA", Prefix: "00", Entries: 1, LastTimestamp: t2, SHA3512: hash(1)}
+	b := digest.Prefix{Region: "NA", Prefix: "01", Entries: 2, LastTimestamp: t1, SHA3512: hash(2)}
+
+	r1, err := digest.OfRegion("NA", []digest.Prefix{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := digest.OfRegion("NA", []digest.Prefix{b, a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r1.Equal(r2) {
+		t.Errorf("order of prefixes changed regional digest: %s, %s", r1, r2)
+	}
+	if !r1.LastTimestamp.Equal(t2) {
+		t.Errorf("expected last timestamp %s, got %s", t2, r1.LastTimestamp)
+	}
+
+	if _, err := digest.OfRegion("EU", []digest.Prefix{a}); err == nil {
+		t.Error("expected error combining prefix from another region")
+	}
+	if _, err := digest.OfRegion("NA", []digest.Prefix{a, a}); err == nil {
+		t.Error("expected error combining duplicate prefixes")
+	}
+}
+
+func TestTable(t *testing.T) {
+	tbl := digest.NewTable()
+	na1 := digest.Prefix{Region: "NA", Prefix: "00", Entries: 1, LastTimestamp: time.Unix(100, 0), SHA3512: hash(1)}
+	na2 := digest.Prefix{Region: "NA", Prefix: "00", Entries: 2, LastTimestamp: time.Unix(200, 0), SHA3512: hash(2)}
+	eu := digest.Prefix{Region: "EU", Prefix: "00", Entries: 1, LastTimestamp: time.Unix(150, 0), SHA3512: hash(3)}
+
+	if !tbl.Update(na2) || !tbl.Update(eu) {
+		t.Fatal("expected updates to succeed")
+	}
+	if tbl.Update(na1) {
+		t.Error("expected stale update to be ignored")
+	}
+	rs, err := tbl.Regions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 2 || rs[0].Region != "EU" || rs[1].Region != "NA" {
+		t.Fatalf("unexpected regions: %v", rs)
+	}
+	wantNA, err := digest.OfRegion("NA", []digest.Prefix{na2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs[1].Equal(wantNA) {
+		t.Errorf("expected %s, got %s", wantNA, rs[1])
+	}
+
+	g, err := tbl.Global()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := digest.OfGlobal(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.String() != want.String() {
+		t.Errorf("expected %s, got %s", want, g)
+	}
+	if !g.LastTimestamp.Equal(na2.LastTimestamp) {
+		t.Errorf("expected last timestamp %s, got %s", na2.LastTimestamp, g.LastTimestamp)
+	}
+}
+
+func TestProof(t *testing.T) {
+	tbl := digest.NewTable()
+	tbl.Update(digest.Prefix{Region: "NA", Prefix: "00", Entries: 1, LastTimestamp: time.Unix(100, 0), SHA3512: hash(1)})
+	tbl.Update(digest.Prefix{Region: "NA", Prefix: "01", Entries: 3, LastTimestamp: time.Unix(300, 0), SHA3512: hash(2)})
+	tbl.Update(digest.Prefix{Region: "EU", Prefix: "00", Entries: 2, LastTimestamp: time.Unix(200, 0), SHA3512: hash(3)})
+
+	p, err := tbl.Prove("NA", "01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(); err != nil {
+		t.Error(err)
+	}
+	g, err := tbl.Global()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Global.String() != g.String() {
+		t.Errorf("expected global digest %s, got %s", g, p.Global)
+	}
+
+	// Tampering with a sibling breaks the proof.
+	p.Prefixes[0].Entries++
+	if err := p.Verify(); err == nil {
+		t.Error("expected tampered proof to fail verification")
+	}
+
+	if _, err := tbl.Prove("NA", "02"); err == nil {
+		t.Error("expected error proving unknown prefix")
+	}
+}
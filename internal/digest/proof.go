@@ -0,0 +1,91 @@
+package digest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Proof shows that a prefix digest is covered by a global digest.
+//
+// Prefixes holds the digests of every prefix chain in the region (including
+// the proven one) and Regions holds the digests of every region (including the
+// proven one). Together they are sufficient to recompute the global digest.
+type Proof struct {
+	Prefix   Prefix
+	Prefixes []Prefix
+	Regions  []Region
+	Global   Global
+}
+
+// Prove returns a proof that the digest held for prefix in region is covered
+// by the global digest of t.
+func (t *Table) Prove(region, prefix string) (Proof, error) {
+	// Snapshot under a single lock so the proof is consistent.
+	t.mu.Lock()
+	p, ok := t.prefixes[region][prefix]
+	all := make(map[string][]Prefix, len(t.prefixes))
+	for r, ps := range t.prefixes {
+		for _, p := range ps {
+			all[r] = append(all[r], p)
+		}
+	}
+	t.mu.Unlock()
+	if !ok {
+		return Proof{}, fmt.Errorf("digest: no digest for prefix %q in region %q", prefix, region)
+	}
+
+	proof := Proof{Prefix: p, Prefixes: all[region]}
+	sort.Slice(proof.Prefixes, func(i, j int) bool { return proof.Prefixes[i].Prefix < proof.Prefixes[j].Prefix })
+	for r, ps := range all {
+		rd, err := OfRegion(r, ps)
+		if err != nil {
+			return Proof{}, err
+		}
+		proof.Regions = append(proof.Regions, rd)
+	}
+	sort.Slice(proof.Regions, func(i, j int) bool { return proof.Regions[i].Region < proof.Regions[j].Region })
+	g, err := OfGlobal(proof.Regions)
+	if err != nil {
+		return Proof{}, err
+	}
+	proof.Global = g
+	return proof, nil
+}
+
+// Verify recomputes the global digest from the digests in p and returns an
+// error if p does not show that p.Prefix is covered by p.Global.
+func (p Proof) Verify() error {
+	found := false
+	for _, q := range p.Prefixes {
+		if q.String() == p.Prefix.String() {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("digest: prefix digest %s not in proof", p.Prefix)
+	}
+	r, err := OfRegion(p.Prefix.Region, p.Prefixes)
+	if err != nil {
+		return err
+	}
+	found = false
+	for _, q := range p.Regions {
+		if q.Equal(r) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("digest: region digest %s not in proof", r)
+	}
+	g, err := OfGlobal(p.Regions)
+	if err != nil {
+		return err
+	}
+	if !g.LastTimestamp.Equal(p.Global.LastTimestamp) || !bytes.Equal(g.SHA3512, p.Global.SHA3512) {
+		return fmt.Errorf("digest: computed global digest %s, expected %s", g, p.Global)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package entryindex
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/vsekhar/fabula/internal/atomicwriter"
+)
+
+// Bucket is an index stored in an object store, such as a Cloud Storage bucket
+// or a local directory. Each entry is stored as an individual object named:
+//
+//	<region>/entries/<hex-encoded DataSHA3512>
+//
+// Entry objects are written once and never modified.
+type Bucket struct {
+	driver atomicwriter.DriverInterface
+}
+
+// NewBucket returns a new index stored in the objects of driver.
+func NewBucket(driver atomicwriter.DriverInterface) *Bucket {
+	return &Bucket{driver: driver}
+}
+
+func objectName(region string, h []byte) string {
+	return path.Join(region, "entries", hex.EncodeToString(h))
+}
+
+// Put implements Interface.
+func (b *Bucket) Put(ctx context.Context, e Entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	name := objectName(e.Location.Region, e.DataSHA3512)
+	w, err := b.driver.NewAtomicWriter(ctx, name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buf); err != nil {
+		w.Abort()
+		return err
+	}
+	err = w.CloseAtomically()
+	if os.IsExist(err) {
+		// Already indexed, ensure it's the same entry (e.g. we are retrying
+		// a write).
+		existing, err := b.Get(ctx, e.Location.Region, e.DataSHA3512)
+		if err != nil {
+			return err
+		}
+		if !existing.equal(e) {
+			return ErrConflict
+		}
+		return nil
+	}
+	return err
+}
+
+// Get implements Interface.
+func (b *Bucket) Get(ctx context.Context, region string, dataSHA3512 []byte) (Entry, error) {
+	r, err := b.driver.Open(ctx, objectName(region, dataSHA3512), 0, -1)
+	if os.IsNotExist(err) {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Entry{}, err
+	}
+	var e Entry
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return Entry{}, err
+	}
+	return e, nil
+}
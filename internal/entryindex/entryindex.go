@@ -0,0 +1,100 @@
+// Package entryindex implements an index of log entries by DataSHA3512.
+//
+// Users often only have the DataSHA3512 of their notarization. The index maps
+// it to the entry's location in the log (region, prefix chain, pack and
+// position in the pack), its predecessors and its timestamp. The timestamp
+// allows the log to be read as of the time the entry was written.
+package entryindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when an entry is not in the index.
+var ErrNotFound = errors.New("entryindex: entry not found")
+
+// ErrConflict is returned when an entry is added to the index with the same
+// DataSHA3512 as a different entry already in the index.
+var ErrConflict = errors.New("entryindex: conflicting entry exists")
+
+// Location identifies where an entry is stored in the log.
+type Location struct {
+	Region string `json:"region"`
+	Prefix string `json:"prefix"`
+	Pack   uint64 `json:"pack"`  // sequence number of the pack in its prefix chain
+	Index  int    `json:"index"` // position of the entry in the pack
+}
+
+// Entry is an indexed log entry.
+type Entry struct {
+	DataSHA3512  []byte    `json:"data_sha3512"`
+	Timestamp    time.Time `json:"timestamp"`
+	Location     Location  `json:"location"`
+	Predecessors [][]byte  `json:"predecessors"`
+}
+
+func (e Entry) equal(o Entry) bool {
+	if !bytes.Equal(e.DataSHA3512, o.DataSHA3512) ||
+		!e.Timestamp.Equal(o.Timestamp) ||
+		e.Location != o.Location ||
+		len(e.Predecessors) != len(o.Predecessors) {
+		return false
+	}
+	for i := range e.Predecessors {
+		if !bytes.Equal(e.Predecessors[i], o.Predecessors[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Interface is the interface fulfilled by an index.
+type Interface interface {
+	// Put adds e to the index in the region e.Location.Region. Adding an
+	// entry that is already in the index succeeds. Adding a different entry
+	// with the same DataSHA3512 returns ErrConflict.
+	Put(ctx context.Context, e Entry) error
+
+	// Get returns the entry with the provided DataSHA3512 in region, or
+	// ErrNotFound.
+	Get(ctx context.Context, region string, dataSHA3512 []byte) (Entry, error)
+}
+
+// Memory is an index held in memory.
+//
+// It is safe to use Memory from multiple goroutines.
+type Memory struct {
+	entries *sync.Map // map[string(region/hex(hash))]Entry
+}
+
+// NewMemory returns a new empty Memory index.
+func NewMemory() *Memory {
+	return &Memory{entries: new(sync.Map)}
+}
+
+func key(region string, h []byte) string {
+	return region + "/" + hex.EncodeToString(h)
+}
+
+// Put implements Interface.
+func (m *Memory) Put(_ context.Context, e Entry) error {
+	existing, loaded := m.entries.LoadOrStore(key(e.Location.Region, e.DataSHA3512), e)
+	if loaded && !existing.(Entry).equal(e) {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Get implements Interface.
+func (m *Memory) Get(_ context.Context, region string, dataSHA3512 []byte) (Entry, error) {
+	e, ok := m.entries.Load(key(region, dataSHA3512))
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	return e.(Entry), nil
+}
@@ -0,0 +1,56 @@
+package entryindex_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/atomicwriter"
+	"github.com/vsekhar/fabula/internal/entryindex"
+)
+
+func TestMemory(t *testing.T) {
+	testIndex(t, entryindex.NewMemory())
+}
+
+func TestBucket(t *testing.T) {
+	testIndex(t, entryindex.NewBucket(atomicwriter.NewFileSystemDriver(t.TempDir())))
+}
+
+func testIndex(t *testing.T, idx entryindex.Interface) {
+	ctx := context.Background()
+	h := bytes.Repeat([]byte{1}, 64)
+	e := entryindex.Entry{
+		DataSHA3512:  h,
+		Timestamp:    time.Unix(100, 0),
+		Location:     entryindex.Location{Region: "NA", Prefix: "01", Pack: 3, Index: 7},
+		Predecessors: [][]byte{bytes.Repeat([]byte{2}, 64)},
+	}
+
+	if _, err := idx.Get(ctx, "NA", h); err != entryindex.ErrNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if err := idx.Put(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Put(ctx, e); err != nil {
+		t.Errorf("expected repeated put to succeed, got %v", err)
+	}
+	got, err := idx.Get(ctx, "NA", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Location != e.Location || !got.Timestamp.Equal(e.Timestamp) {
+		t.Errorf("expected %+v, got %+v", e, got)
+	}
+	if _, err := idx.Get(ctx, "EU", h); err != entryindex.ErrNotFound {
+		t.Errorf("expected not found in other region, got %v", err)
+	}
+
+	conflict := e
+	conflict.Location.Pack++
+	if err := idx.Put(ctx, conflict); err != entryindex.ErrConflict {
+		t.Errorf("expected conflict, got %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+// Package interval builds a tree of time intervals over the log, so that the
+// state of the log at a time can be found and attested to efficiently.
+//
+// Intervals are deterministic: at level 0, time is split into leaf intervals
+// of a fixed duration aligned to the Unix epoch, and each interval at level
+// k+1 covers two consecutive intervals at level k. The SHA3-512 hash of an
+// interval commits to its bounds and the entries committed within it:
+//
+//   - an interval with no entries hashes only its bounds,
+//   - a leaf hashes its bounds and the NodeSHA3512 of each of its entries in
+//     order of timestamp,
+//   - other intervals hash their bounds and the hashes of their two children.
+//
+// An interval is final once Blackout has passed since its end, allowing for
+// entries timestamped just before the end to be committed. Only final
+// intervals are hashed, so an interval's hash never changes.
+package interval
+
+import (
+	"context"
+	"crypto/sha3"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/digest"
+	"github.com/vsekhar/fabula/internal/logstore"
+	"github.com/vsekhar/fabula/pkg/timestamp"
+	"google.golang.org/api/iterator"
+)
+
+// Blackout is the time after the end of an interval before it is final.
+const Blackout = 50 * time.Millisecond
+
+// MaxLevel is the highest level of the tree.
+const MaxLevel = 40
+
+// ErrNotFinal is returned when hashing an interval that is not yet final.
+var ErrNotFinal = errors.New("interval: interval is not final")
+
+// Interval is the interval [Start, End) at Level of a tree.
+type Interval struct {
+	Level      int
+	Start, End time.Time
+}
+
+func (iv Interval) String() string {
+	return fmt.Sprintf("%d:%s-%s", iv.Level, timestamp.ToString(iv.Start), timestamp.ToString(iv.End))
+}
+
+// Contains reports whether t is in iv.
+func (iv Interval) Contains(t time.Time) bool {
+	return !t.Before(iv.Start) && t.Before(iv.End)
+}
+
+// Final reports whether iv is final at now.
+func (iv Interval) Final(now time.Time) bool {
+	return !now.Before(iv.End.Add(Blackout))
+}
+
+// children returns the intervals covered by iv at the level below.
+func (iv Interval) children() (Interval, Interval) {
+	mid := iv.Start.Add(iv.End.Sub(iv.Start) / 2)
+	return Interval{iv.Level - 1, iv.Start, mid}, Interval{iv.Level - 1, mid, iv.End}
+}
+
+type key struct {
+	level int
+	start int64
+}
+
+// Tree is a tree of intervals over the log of a region.
+//
+// It is safe to use Tree from multiple goroutines.
+type Tree struct {
+	store  logstore.Interface
+	region string
+	leaf   time.Duration
+
+	mu     sync.Mutex
+	hashes map[key][]byte // of final intervals
+}
+
+// New returns a tree over the log of region in store, with leaf intervals of
+// duration leaf.
+func New(store logstore.Interface, region string, leaf time.Duration) *Tree {
+	if leaf <= 0 {
+		panic("interval: leaf duration must be positive")
+	}
+	return &Tree{
+		store:  store,
+		region: region,
+		leaf:   leaf,
+		hashes: make(map[key][]byte),
+	}
+}
+
+// Containing returns the interval at level containing t.
+func (tr *Tree) Containing(t time.Time, level int) Interval {
+	if level < 0 || level > MaxLevel || int64(tr.leaf) > math.MaxInt64>>uint(level) {
+		panic(fmt.Sprintf("interval: bad level %d", level))
+	}
+	d := int64(tr.leaf) << uint(level)
+	n := t.UnixNano()
+	start := n - n%d
+	if n < 0 && n%d != 0 {
+		start -= d
+	}
+	return Interval{
+		Level: level,
+		Start: time.Unix(0, start).UTC(),
+		End:   time.Unix(0, start+d).UTC(),
+	}
+}
+
+// Largest returns the largest interval containing t that is final at now. It
+// returns false if no interval containing t is final.
+func (tr *Tree) Largest(t, now time.Time) (Interval, bool) {
+	iv := tr.Containing(t, 0)
+	if !iv.Final(now) {
+		return Interval{}, false
+	}
+	for iv.Level < MaxLevel && int64(tr.leaf) <= math.MaxInt64>>uint(iv.Level+1) {
+		parent := tr.Containing(t, iv.Level+1)
+		if !parent.Final(now) {
+			break
+		}
+		iv = parent
+	}
+	return iv, true
+}
+
+// Predecessor returns the most recent leaf interval that is final at t. It is
+// determined by t alone, so an entry committed at t can deterministically
+// attest to the state of the log as of the end of its predecessor.
+func (tr *Tree) Predecessor(t time.Time) Interval {
+	iv := tr.Containing(t.Add(-Blackout), 0)
+	return tr.Containing(iv.Start.Add(-1), 0)
+}
+
+func writeTime(h interface{ Write([]byte) (int, error) }, t time.Time) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := timestamp.ToBytes(buf, t)
+	h.Write(buf[:n])
+}
+
+// hash returns the hash of iv, given the entries committed within it in
+// order. tr.mu must be held.
+func (tr *Tree) hash(iv Interval, entries []logstore.Entry) []byte {
+	k := key{iv.Level, iv.Start.UnixNano()}
+	if h, ok := tr.hashes[k]; ok {
+		return h
+	}
+	h := sha3.New512()
+	writeTime(h, iv.Start)
+	writeTime(h, iv.End)
+	switch {
+	case len(entries) == 0:
+	case iv.Level == 0:
+		for _, e := range entries {
+			h.Write(e.NodeSHA3512)
+		}
+	default:
+		left, right := iv.children()
+		i := sort.Search(len(entries), func(i int) bool {
+			return !entries[i].Timestamp.Before(right.Start)
+		})
+		h.Write(tr.hash(left, entries[:i]))
+		h.Write(tr.hash(right, entries[i:]))
+	}
+	r := h.Sum(nil)
+	tr.hashes[k] = r
+	return r
+}
+
+// Entries returns the entries committed within iv, in order of timestamp.
+func (tr *Tree) Entries(ctx context.Context, iv Interval) ([]logstore.Entry, error) {
+	itr := tr.store.Scan(ctx, tr.region, iv.Start, iv.End)
+	defer itr.Stop()
+	var r []logstore.Entry
+	for {
+		e, err := itr.Next()
+		if err == iterator.Done {
+			return r, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, e)
+	}
+}
+
+// Hash returns the hash of iv, which must be final.
+func (tr *Tree) Hash(ctx context.Context, iv Interval) ([]byte, error) {
+	if !iv.Final(time.Now()) {
+		return nil, ErrNotFinal
+	}
+	tr.mu.Lock()
+	h, ok := tr.hashes[key{iv.Level, iv.Start.UnixNano()}]
+	tr.mu.Unlock()
+	if ok {
+		return h, nil
+	}
+	entries, err := tr.Entries(ctx, iv)
+	if err != nil {
+		return nil, err
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.hash(iv, entries), nil
+}
+
+// Snapshot describes the log of a region at a time.
+type Snapshot struct {
+	// Interval is the largest final interval containing the time, and
+	// SHA3512 is its hash.
+	Interval Interval
+	SHA3512  []byte
+
+	// Entries are the entries committed within the leaf interval containing
+	// the time, up to and including the time.
+	Entries []logstore.Entry
+
+	// Digest is the digest of the region at the time.
+	Digest digest.Region
+}
+
+// At returns a snapshot of the log at t. It returns ErrNotFinal if the leaf
+// interval containing t is not yet final.
+func (tr *Tree) At(ctx context.Context, t time.Time) (Snapshot, error) {
+	iv, ok := tr.Largest(t, time.Now())
+	if !ok {
+		return Snapshot{}, ErrNotFinal
+	}
+	h, err := tr.Hash(ctx, iv)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	leaf := tr.Containing(t, 0)
+	entries, err := tr.Entries(ctx, Interval{Level: 0, Start: leaf.Start, End: t.Add(1)})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	prefixes, err := tr.store.Digests(ctx, tr.region, t)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	d, err := digest.OfRegion(tr.region, prefixes)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{
+		Interval: iv,
+		SHA3512:  h,
+		Entries:  entries,
+		Digest:   d,
+	}, nil
+}
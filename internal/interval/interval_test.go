@@ -0,0 +1,230 @@
+package interval_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha3"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/digest"
+	"github.com/vsekhar/fabula/internal/interval"
+	"github.com/vsekhar/fabula/internal/logstore"
+	"github.com/vsekhar/fabula/pkg/timestamp"
+)
+
+const leaf = 20 * time.Millisecond
+
+func newTree(t *testing.T) (*interval.Tree, *logstore.Local) {
+	store, err := logstore.OpenLocal("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return interval.New(store, "NA", leaf), store
+}
+
+func TestContaining(t *testing.T) {
+	tr, _ := newTree(t)
+	base := time.Unix(1600000000, 0)
+	for _, c := range []struct {
+		t          time.Time
+		level      int
+		start, end time.Time
+	}{
+		{base, 0, base, base.Add(leaf)},
+		{base.Add(leaf - 1), 0, base, base.Add(leaf)},
+		{base.Add(leaf), 0, base.Add(leaf), base.Add(2 * leaf)},
+		{base.Add(leaf), 1, base, base.Add(2 * leaf)},
+		{base.Add(3 * leaf), 2, base, base.Add(4 * leaf)},
+		{time.Unix(0, -1), 0, time.Unix(0, -int64(leaf)), time.Unix(0, 0)},
+	} {
+		iv := tr.Containing(c.t, c.level)
+		if iv.Level != c.level || !iv.Start.Equal(c.start) || !iv.End.Equal(c.end) {
+			t.Errorf("Containing(%s, %d): expected [%s, %s), got %s", c.t, c.level, c.start, c.end, iv)
+		}
+		if !iv.Contains(c.t) {
+			t.Errorf("%s does not contain %s", iv, c.t)
+		}
+	}
+}
+
+func TestLargest(t *testing.T) {
+	tr, _ := newTree(t)
+	base := time.Unix(1600000000, 0)
+	if _, ok := tr.Largest(base, base.Add(leaf)); ok {
+		t.Error("expected no final interval before blackout")
+	}
+	iv, ok := tr.Largest(base, base.Add(leaf+interval.Blackout))
+	if !ok || iv.Level != 0 || !iv.Start.Equal(base) {
+		t.Errorf("expected leaf at %s, got %s", base, iv)
+	}
+	iv, ok = tr.Largest(base, base.Add(8*leaf+interval.Blackout))
+	if !ok || iv.Level != 3 || !iv.Start.Equal(base) {
+		t.Errorf("expected level 3 at %s, got %s", base, iv)
+	}
+	if iv, ok := tr.Largest(base, time.Now()); !ok || !iv.Contains(base) || !iv.Final(time.Now()) {
+		t.Errorf("bad largest interval %s", iv)
+	}
+}
+
+func TestPredecessor(t *testing.T) {
+	tr, _ := newTree(t)
+	base := time.Unix(1600000000, 0)
+	for _, c := range []struct {
+		t, start time.Time
+	}{
+		{base.Add(leaf + interval.Blackout), base},
+		{base.Add(2*leaf + interval.Blackout - 1), base},
+		{base.Add(2*leaf + interval.Blackout), base.Add(leaf)},
+	} {
+		iv := tr.Predecessor(c.t)
+		if iv.Level != 0 || !iv.Start.Equal(c.start) || !iv.Final(c.t) {
+			t.Errorf("Predecessor(%s): expected leaf at %s, got %s", c.t, c.start, iv)
+		}
+	}
+}
+
+// leafHash computes the hash of a leaf as specified by package interval.
+func leafHash(iv interval.Interval, entries []logstore.Entry) []byte {
+	h := sha3.New512()
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, t := range []time.Time{iv.Start, iv.End} {
+		n := timestamp.ToBytes(buf, t)
+		h.Write(buf[:n])
+	}
+	for _, e := range entries {
+		h.Write(e.NodeSHA3512)
+	}
+	return h.Sum(nil)
+}
+
+func TestHash(t *testing.T) {
+	ctx := context.Background()
+	tr, store := newTree(t)
+	var entries []logstore.Entry
+	for i, prefix := range []string{"00", "01", "00", "02", "01"} {
+		e, err := store.Append(ctx, "NA", prefix, "", []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+		time.Sleep(leaf / 3)
+	}
+	first, last := entries[0], entries[len(entries)-1]
+	current := tr.Containing(last.Timestamp, 0)
+	if _, err := tr.Hash(ctx, current); err != interval.ErrNotFinal {
+		t.Errorf("expected ErrNotFinal, got %v", err)
+	}
+	time.Sleep(time.Until(current.End.Add(interval.Blackout)))
+
+	// Leaves
+	for _, e := range entries {
+		iv := tr.Containing(e.Timestamp, 0)
+		var want []logstore.Entry
+		for _, o := range entries {
+			if iv.Contains(o.Timestamp) {
+				want = append(want, o)
+			}
+		}
+		h, err := tr.Hash(ctx, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(h, leafHash(iv, want)) {
+			t.Errorf("bad hash of leaf %s with %d entries", iv, len(want))
+		}
+	}
+	empty := tr.Containing(first.Timestamp.Add(-time.Hour), 0)
+	h, err := tr.Hash(ctx, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h, leafHash(empty, nil)) {
+		t.Error("bad hash of empty leaf")
+	}
+
+	// Entries span several leaves, so the parent of the first is final. An
+	// interval, hashed by another tree over the same log, combines the
+	// hashes of its children.
+	iv, ok := tr.Largest(first.Timestamp, time.Now())
+	if !ok || iv.Level == 0 {
+		t.Fatalf("expected a final interval above the leaves, got %s", iv)
+	}
+	h, err = interval.New(store, "NA", leaf).Hash(ctx, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := tr.Containing(iv.Start, iv.Level-1)
+	right := tr.Containing(left.End, iv.Level-1)
+	lh, err := tr.Hash(ctx, left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rh, err := tr.Hash(ctx, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := sha3.New512()
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, t := range []time.Time{iv.Start, iv.End} {
+		n := timestamp.ToBytes(buf, t)
+		hs.Write(buf[:n])
+	}
+	hs.Write(lh)
+	hs.Write(rh)
+	if !bytes.Equal(h, hs.Sum(nil)) {
+		t.Errorf("bad hash of %s", iv)
+	}
+}
+
+func TestAt(t *testing.T) {
+	ctx := context.Background()
+	tr, store := newTree(t)
+	var entries []logstore.Entry
+	for i, prefix := range []string{"00", "01", "00"} {
+		e, err := store.Append(ctx, "NA", prefix, "", []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	at := entries[1].Timestamp
+	if _, err := tr.At(ctx, at); err != interval.ErrNotFinal {
+		t.Errorf("expected ErrNotFinal, got %v", err)
+	}
+	time.Sleep(time.Until(tr.Containing(entries[2].Timestamp, 0).End.Add(interval.Blackout)))
+
+	s, err := tr.At(ctx, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Interval.Contains(at) || !s.Interval.Final(time.Now()) {
+		t.Errorf("bad interval %s", s.Interval)
+	}
+	if h, err := tr.Hash(ctx, s.Interval); err != nil || !bytes.Equal(h, s.SHA3512) {
+		t.Errorf("bad interval hash: %v", err)
+	}
+	leafStart := tr.Containing(at, 0).Start
+	var want []logstore.Entry
+	for _, e := range entries[:2] {
+		if !e.Timestamp.Before(leafStart) {
+			want = append(want, e)
+		}
+	}
+	if len(s.Entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(s.Entries))
+	}
+	for i := range want {
+		if !bytes.Equal(s.Entries[i].DataSHA3512, want[i].DataSHA3512) {
+			t.Errorf("entry %d: expected %x, got %x", i, want[i].DataSHA3512, s.Entries[i].DataSHA3512)
+		}
+	}
+	d, err := digest.OfRegion("NA", []digest.Prefix{entries[0].Digest(), entries[1].Digest()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Digest.Equal(d) {
+		t.Errorf("expected digest %s, got %s", d, s.Digest)
+	}
+}
@@ -0,0 +1,449 @@
+package logstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/digest"
+	"google.golang.org/api/iterator"
+)
+
+const localExt = ".log"
+
+var errClosed = errors.New("logstore: store closed")
+
+// localRecord is an entry as stored in the file of its prefix chain. Region
+// and prefix are given by the file's path.
+type localRecord struct {
+	SequenceNo      uint64    `json:"seq"`
+	DataSHA3512     []byte    `json:"data_sha3512"`
+	NodeSHA3512     []byte    `json:"node_sha3512"`
+	Timestamp       time.Time `json:"timestamp"`
+	CrossPrefix     string    `json:"cross_prefix,omitempty"`
+	CrossSequenceNo uint64    `json:"cross_seq,omitempty"`
+}
+
+type localChain struct {
+	region, prefix string
+	f              *os.File // nil if the store is in memory
+	size           int64    // of f, up to the end of the last entry
+	entries        []Entry
+}
+
+// search returns the number of entries in c committed at or before t.
+func (c *localChain) search(t time.Time) int {
+	return sort.Search(len(c.entries), func(i int) bool {
+		return c.entries[i].Timestamp.After(t)
+	})
+}
+
+type localPosition struct {
+	chain *localChain
+	seqNo uint64
+}
+
+// Local is a log store kept in a local directory, so that a notary can run
+// without cloud services.
+//
+// Each prefix chain is a file of JSON entries, one per line, which is synced
+// as each entry is appended. The files are read and indexed in memory when the
+// store is opened, so Local is suited to logs of modest size, e.g. in
+// development, tests and self-hosted notaries. Entries are timestamped with
+// the local clock, adjusted to be strictly increasing.
+//
+// It is safe to use Local from multiple goroutines, but not to open the same
+// directory more than once.
+type Local struct {
+	dir string
+
+	mu     sync.RWMutex
+	chains map[string]*localChain // by region/prefix
+	byHash map[string]localPosition
+	last   time.Time // most recent timestamp
+	closed bool
+}
+
+// validName reports whether s can be used as a region or prefix.
+func validName(s string) bool {
+	return s != "" && !strings.HasPrefix(s, ".") && !strings.ContainsAny(s, `/\`)
+}
+
+func chainKey(region, prefix string) string {
+	return region + "/" + prefix
+}
+
+// OpenLocal opens the log store in dir, creating it if it does not exist. If
+// dir is empty, the log is kept in memory only.
+//
+// An entry that was partially written when the process crashed is discarded.
+func OpenLocal(dir string) (*Local, error) {
+	l := &Local{
+		dir:    dir,
+		chains: make(map[string]*localChain),
+		byHash: make(map[string]localPosition),
+	}
+	if dir == "" {
+		return l, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*"+localExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		region := filepath.Base(filepath.Dir(p))
+		prefix := strings.TrimSuffix(filepath.Base(p), localExt)
+		if !validName(region) || !validName(prefix) {
+			continue
+		}
+		c, err := l.load(region, prefix, p)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.chains[chainKey(region, prefix)] = c
+	}
+	return l, nil
+}
+
+// load reads the file of a prefix chain, truncating a partially written
+// entry at its end.
+func (l *Local) load(region, prefix, path string) (*localChain, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c := &localChain{region: region, prefix: prefix, f: f}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break // discard an unterminated entry
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var rec localRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("logstore: %s: entry %d: %w", path, len(c.entries), err)
+		}
+		if rec.SequenceNo != uint64(len(c.entries)) {
+			f.Close()
+			return nil, fmt.Errorf("logstore: %s: expected entry %d, got %d", path, len(c.entries), rec.SequenceNo)
+		}
+		e := Entry{
+			Region:          region,
+			Prefix:          prefix,
+			SequenceNo:      rec.SequenceNo,
+			DataSHA3512:     rec.DataSHA3512,
+			NodeSHA3512:     rec.NodeSHA3512,
+			Timestamp:       rec.Timestamp,
+			CrossPrefix:     rec.CrossPrefix,
+			CrossSequenceNo: rec.CrossSequenceNo,
+		}
+		c.entries = append(c.entries, e)
+		c.size += int64(len(line))
+		l.byHash[string(e.DataSHA3512)] = localPosition{c, e.SequenceNo}
+		if e.Timestamp.After(l.last) {
+			l.last = e.Timestamp
+		}
+	}
+	if err := f.Truncate(c.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(c.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the files of the store.
+func (l *Local) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for _, c := range l.chains {
+		if c.f != nil {
+			if cerr := c.f.Close(); err == nil {
+				err = cerr
+			}
+			c.f = nil
+		}
+	}
+	l.closed = true
+	return err
+}
+
+// chain returns the prefix chain, creating it if create is true. It returns
+// nil if the chain does not exist and create is false. l.mu must be held, for
+// writing if create is true.
+func (l *Local) chain(region, prefix string, create bool) (*localChain, error) {
+	if c, ok := l.chains[chainKey(region, prefix)]; ok || !create {
+		return c, nil
+	}
+	if !validName(region) || !validName(prefix) {
+		return nil, fmt.Errorf("logstore: invalid region or prefix: %q, %q", region, prefix)
+	}
+	c := &localChain{region: region, prefix: prefix}
+	if l.dir != "" {
+		dir := filepath.Join(l.dir, region)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(filepath.Join(dir, prefix+localExt), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, err
+		}
+		// Make the new file durable along with its first entry.
+		if err := syncDir(dir); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := syncDir(l.dir); err != nil {
+			f.Close()
+			return nil, err
+		}
+		c.f = f
+	}
+	l.chains[chainKey(region, prefix)] = c
+	return c, nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write appends e to the file of c.
+func (c *localChain) write(e Entry) error {
+	if c.f == nil {
+		return nil
+	}
+	buf, err := json.Marshal(localRecord{
+		SequenceNo:      e.SequenceNo,
+		DataSHA3512:     e.DataSHA3512,
+		NodeSHA3512:     e.NodeSHA3512,
+		Timestamp:       e.Timestamp,
+		CrossPrefix:     e.CrossPrefix,
+		CrossSequenceNo: e.CrossSequenceNo,
+	})
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = c.f.Write(buf)
+	if err == nil {
+		err = c.f.Sync()
+	}
+	if err != nil {
+		// Remove what was written so later entries are not appended to a
+		// partial one.
+		c.f.Truncate(c.size)
+		c.f.Seek(c.size, io.SeekStart)
+		return err
+	}
+	c.size += int64(len(buf))
+	return nil
+}
+
+// now returns a timestamp for a new entry. l.mu must be held for writing.
+func (l *Local) now() time.Time {
+	t := time.Now().UTC().Round(0) // strip monotonic clock reading
+	if !t.After(l.last) {
+		t = l.last.Add(time.Nanosecond)
+	}
+	l.last = t
+	return t
+}
+
+// Append implements Interface.
+func (l *Local) Append(_ context.Context, region, prefix, crossPrefix string, dataSHA3512 []byte) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return Entry{}, errClosed
+	}
+	if _, ok := l.byHash[string(dataSHA3512)]; ok {
+		return Entry{}, ErrExists
+	}
+	c, err := l.chain(region, prefix, true)
+	if err != nil {
+		return Entry{}, err
+	}
+	e := Entry{
+		Region:      region,
+		Prefix:      prefix,
+		SequenceNo:  uint64(len(c.entries)),
+		DataSHA3512: append([]byte(nil), dataSHA3512...),
+	}
+	var predecessors []Entry
+	if len(c.entries) > 0 {
+		predecessors = append(predecessors, c.entries[len(c.entries)-1])
+	}
+	if crossPrefix != "" {
+		cross, _ := l.chain(region, crossPrefix, false)
+		if cross != nil && len(cross.entries) > 0 {
+			p := cross.entries[len(cross.entries)-1]
+			e.CrossPrefix, e.CrossSequenceNo = crossPrefix, p.SequenceNo
+			predecessors = append(predecessors, p)
+		}
+	}
+	e.NodeSHA3512 = NodeSHA3512(dataSHA3512, predecessors...)
+	e.Timestamp = l.now()
+	if err := c.write(e); err != nil {
+		return Entry{}, err
+	}
+	c.entries = append(c.entries, e)
+	l.byHash[string(e.DataSHA3512)] = localPosition{c, e.SequenceNo}
+	return e, nil
+}
+
+// Get implements Interface.
+func (l *Local) Get(_ context.Context, region, prefix string, seqNo uint64) (Entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	c, _ := l.chain(region, prefix, false)
+	if c == nil || seqNo >= uint64(len(c.entries)) {
+		return Entry{}, ErrNotFound
+	}
+	return c.entries[seqNo], nil
+}
+
+// Tail implements Interface.
+func (l *Local) Tail(_ context.Context, region, prefix string) (Entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	c, _ := l.chain(region, prefix, false)
+	if c == nil || len(c.entries) == 0 {
+		return Entry{}, ErrNotFound
+	}
+	return c.entries[len(c.entries)-1], nil
+}
+
+// Lookup implements Interface.
+func (l *Local) Lookup(_ context.Context, dataSHA3512 []byte) (Entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	p, ok := l.byHash[string(dataSHA3512)]
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	return p.chain.entries[p.seqNo], nil
+}
+
+// digest returns the digest of c as of at. l.mu must be held.
+func (c *localChain) digest(at time.Time) (digest.Prefix, bool) {
+	n := len(c.entries)
+	if !at.IsZero() {
+		n = c.search(at)
+	}
+	if n == 0 {
+		return digest.Prefix{}, false
+	}
+	return c.entries[n-1].Digest(), true
+}
+
+// Digest implements Interface.
+func (l *Local) Digest(_ context.Context, region, prefix string, at time.Time) (digest.Prefix, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	c, _ := l.chain(region, prefix, false)
+	if c == nil {
+		return digest.Prefix{}, ErrNotFound
+	}
+	d, ok := c.digest(at)
+	if !ok {
+		return digest.Prefix{}, ErrNotFound
+	}
+	return d, nil
+}
+
+// Digests implements Interface.
+func (l *Local) Digests(_ context.Context, region string, at time.Time) ([]digest.Prefix, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var r []digest.Prefix
+	for _, c := range l.chains {
+		if c.region != region {
+			continue
+		}
+		if d, ok := c.digest(at); ok {
+			r = append(r, d)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Prefix < r[j].Prefix })
+	return r, nil
+}
+
+type sliceIterator struct {
+	entries []Entry
+}
+
+func (si *sliceIterator) Next() (Entry, error) {
+	if len(si.entries) == 0 {
+		return Entry{}, iterator.Done
+	}
+	e := si.entries[0]
+	si.entries = si.entries[1:]
+	return e, nil
+}
+
+func (si *sliceIterator) Stop() {}
+
+// Scan implements Interface.
+func (l *Local) Scan(_ context.Context, region string, start, end time.Time) Iterator {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	r := &sliceIterator{}
+	for _, c := range l.chains {
+		if c.region != region {
+			continue
+		}
+		i := sort.Search(len(c.entries), func(i int) bool {
+			return !c.entries[i].Timestamp.Before(start)
+		})
+		j := len(c.entries)
+		if !end.IsZero() {
+			j = sort.Search(len(c.entries), func(i int) bool {
+				return !c.entries[i].Timestamp.Before(end)
+			})
+		}
+		if i < j {
+			r.entries = append(r.entries, c.entries[i:j]...)
+		}
+	}
+	sort.Slice(r.entries, func(i, j int) bool {
+		a, b := r.entries[i], r.entries[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.Prefix != b.Prefix {
+			return a.Prefix < b.Prefix
+		}
+		return a.SequenceNo < b.SequenceNo
+	})
+	return r
+}
@@ -0,0 +1,120 @@
+package logstore_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vsekhar/fabula/internal/logstore"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "logstore_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func openLocal(t *testing.T, dir string) *logstore.Local {
+	t.Helper()
+	l, err := logstore.OpenLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestLocal(t *testing.T) {
+	testStore(t, openLocal(t, tempDir(t)))
+}
+
+func TestLocalMemory(t *testing.T) {
+	testStore(t, openLocal(t, ""))
+}
+
+func TestLocalReopen(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	l := openLocal(t, dir)
+	a0, err := l.Append(ctx, "NA", "00", "", hash("a0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b0, err := l.Append(ctx, "NA", "01", "00", hash("b0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Append(ctx, "NA", "00", "", hash("a1")); err == nil {
+		t.Error("expected error appending to closed store")
+	}
+
+	// A crash while appending leaves a partial entry.
+	f, err := os.OpenFile(filepath.Join(dir, "NA", "00.log"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(`{"seq":1,"data_sha3`)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l = openLocal(t, dir)
+	for _, e := range []logstore.Entry{a0, b0} {
+		got, err := l.Lookup(ctx, e.DataSHA3512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameEntry(got, e) {
+			t.Errorf("expected %+v, got %+v", e, got)
+		}
+	}
+	a1, err := l.Append(ctx, "NA", "00", "01", hash("a1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a1.SequenceNo != 1 || a1.CrossPrefix != "01" || !a1.Timestamp.After(b0.Timestamp) {
+		t.Errorf("bad entry after reopening: %+v", a1)
+	}
+	l.Close()
+
+	l = openLocal(t, dir)
+	got, err := l.Tail(ctx, "NA", "00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameEntry(got, a1) {
+		t.Errorf("expected %+v, got %+v", a1, got)
+	}
+}
+
+func TestLocalCorrupt(t *testing.T) {
+	dir := tempDir(t)
+	l := openLocal(t, dir)
+	if _, err := l.Append(context.Background(), "NA", "00", "", hash("a0")); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "NA", "00.log"), []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logstore.OpenLocal(dir); err == nil {
+		t.Error("expected error opening corrupt store")
+	}
+}
+
+func TestLocalInvalidNames(t *testing.T) {
+	l := openLocal(t, tempDir(t))
+	for _, c := range [][2]string{{"", "00"}, {"NA", ""}, {"NA", "../00"}, {"..", "00"}, {"NA", ".00"}} {
+		if _, err := l.Append(context.Background(), c[0], c[1], "", hash(c[0]+c[1])); err == nil {
+			t.Errorf("expected error appending to %q, %q", c[0], c[1])
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package logstore stores the entries of the log.
+//
+// The log is split by region and then by prefix into independent prefix
+// chains. Entries are appended to a prefix chain in sequence. Each entry's
+// NodeSHA3512 hashes the NodeSHA3512 and timestamp of its predecessors with
+// its own DataSHA3512, so the last entry of a chain as of some time is the
+// digest of the chain at that time.
+//
+// The first predecessor of an entry is the previous entry in its prefix
+// chain. Entries may also have a second predecessor, the last entry in
+// another "cross" prefix chain, which interlocks the chains.
+package logstore
+
+import (
+	"context"
+	"crypto/sha3"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/digest"
+	"github.com/vsekhar/fabula/pkg/timestamp"
+)
+
+// ErrNotFound is returned when an entry is not in the log.
+var ErrNotFound = errors.New("logstore: entry not found")
+
+// ErrExists is returned when appending an entry with the same DataSHA3512 as
+// an entry already in the log.
+var ErrExists = errors.New("logstore: entry exists")
+
+// Entry is an entry in a prefix chain.
+type Entry struct {
+	Region      string
+	Prefix      string
+	SequenceNo  uint64
+	DataSHA3512 []byte
+	NodeSHA3512 []byte
+
+	// Timestamp is the time the entry was committed. It is not included in
+	// the entry's own NodeSHA3512, but in those of its successors.
+	Timestamp time.Time
+
+	// CrossPrefix is the prefix chain of the entry's second predecessor,
+	// entry CrossSequenceNo of that chain, or empty if the entry has none.
+	CrossPrefix     string
+	CrossSequenceNo uint64
+}
+
+// Digest returns the digest of e's prefix chain as of e.
+func (e Entry) Digest() digest.Prefix {
+	return digest.Prefix{
+		Region:        e.Region,
+		Prefix:        e.Prefix,
+		Entries:       e.SequenceNo + 1,
+		LastTimestamp: e.Timestamp,
+		SHA3512:       e.NodeSHA3512,
+	}
+}
+
+// NodeSHA3512 returns the NodeSHA3512 of an entry with DataSHA3512
+// dataSHA3512 and the provided predecessors, in order.
+func NodeSHA3512(dataSHA3512 []byte, predecessors ...Entry) []byte {
+	h := sha3.New512()
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, p := range predecessors {
+		h.Write(p.NodeSHA3512)
+		n := timestamp.ToBytes(buf, p.Timestamp)
+		h.Write(buf[:n])
+	}
+	h.Write(dataSHA3512)
+	return h.Sum(nil)
+}
+
+// Interface is the interface fulfilled by a log store.
+//
+// Reads take a time at which to read the log. A zero time reads the latest
+// state of the log.
+type Interface interface {
+	// Append appends an entry with dataSHA3512 to the prefix chain prefix
+	// in region. If crossPrefix is not empty, the last entry of that chain,
+	// if any, is the entry's second predecessor. Predecessors are read and
+	// the entry is written atomically.
+	Append(ctx context.Context, region, prefix, crossPrefix string, dataSHA3512 []byte) (Entry, error)
+
+	// Get returns entry seqNo of a prefix chain, or ErrNotFound.
+	Get(ctx context.Context, region, prefix string, seqNo uint64) (Entry, error)
+
+	// Tail returns the last entry of a prefix chain, or ErrNotFound if the
+	// chain is empty.
+	Tail(ctx context.Context, region, prefix string) (Entry, error)
+
+	// Lookup returns the entry with dataSHA3512, or ErrNotFound.
+	Lookup(ctx context.Context, dataSHA3512 []byte) (Entry, error)
+
+	// Digest returns the digest of a prefix chain as of time at, or
+	// ErrNotFound if the chain was empty.
+	Digest(ctx context.Context, region, prefix string, at time.Time) (digest.Prefix, error)
+
+	// Digests returns the digests of all non-empty prefix chains in region as
+	// of time at, ordered by prefix. The digests are a consistent snapshot
+	// of the region.
+	Digests(ctx context.Context, region string, at time.Time) ([]digest.Prefix, error)
+
+	// Scan returns an iterator over the entries in region committed at or
+	// after start and before end, in order of timestamp. Entries with the
+	// same timestamp are ordered by prefix and sequence number. If end is
+	// zero, entries are scanned to the end of the log.
+	Scan(ctx context.Context, region string, start, end time.Time) Iterator
+}
+
+// Iterator iterates over entries.
+type Iterator interface {
+	// Next returns the next entry, or iterator.Done if there are no more
+	// entries.
+	Next() (Entry, error)
+
+	// Stop releases the resources of the iterator. It must be called if
+	// iteration ends before Next returns an error.
+	Stop()
+}
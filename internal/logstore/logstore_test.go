@@ -0,0 +1,211 @@
+package logstore_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha3"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/digest"
+	"github.com/vsekhar/fabula/internal/logstore"
+	"google.golang.org/api/iterator"
+)
+
+func hash(s string) []byte {
+	h := sha3.Sum512([]byte(s))
+	return h[:]
+}
+
+func sameEntry(a, b logstore.Entry) bool {
+	return a.Region == b.Region &&
+		a.Prefix == b.Prefix &&
+		a.SequenceNo == b.SequenceNo &&
+		bytes.Equal(a.DataSHA3512, b.DataSHA3512) &&
+		bytes.Equal(a.NodeSHA3512, b.NodeSHA3512) &&
+		a.Timestamp.Equal(b.Timestamp) &&
+		a.CrossPrefix == b.CrossPrefix &&
+		a.CrossSequenceNo == b.CrossSequenceNo
+}
+
+func digestStrings(ds []digest.Prefix) []string {
+	var r []string
+	for _, d := range ds {
+		r = append(r, d.String())
+	}
+	return r
+}
+
+func TestNodeSHA3512(t *testing.T) {
+	a := logstore.Entry{NodeSHA3512: hash("a"), Timestamp: time.Unix(1, 0)}
+	b := logstore.Entry{NodeSHA3512: hash("b"), Timestamp: time.Unix(2, 0)}
+	n := logstore.NodeSHA3512(hash("c"), a, b)
+	if len(n) != 64 {
+		t.Fatalf("expected 64 bytes, got %d", len(n))
+	}
+	if bytes.Equal(n, logstore.NodeSHA3512(hash("c"), b, a)) {
+		t.Error("expected order of predecessors to matter")
+	}
+	a2 := a
+	a2.Timestamp = a.Timestamp.Add(time.Nanosecond)
+	if bytes.Equal(n, logstore.NodeSHA3512(hash("c"), a2, b)) {
+		t.Error("expected timestamps of predecessors to matter")
+	}
+	if bytes.Equal(logstore.NodeSHA3512(hash("c")), logstore.NodeSHA3512(hash("d"))) {
+		t.Error("expected data to matter")
+	}
+}
+
+// testStore exercises the behavior common to all log stores. s must be
+// empty.
+func testStore(t *testing.T, s logstore.Interface) {
+	ctx := context.Background()
+	appendEntry := func(prefix, crossPrefix, data string) logstore.Entry {
+		t.Helper()
+		e, err := s.Append(ctx, "NA", prefix, crossPrefix, hash(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	a0 := appendEntry("00", "", "a0")
+	if a0.SequenceNo != 0 || !bytes.Equal(a0.NodeSHA3512, logstore.NodeSHA3512(hash("a0"))) {
+		t.Errorf("bad first entry: %+v", a0)
+	}
+	// The cross prefix chain is empty, so there is no second predecessor.
+	a1 := appendEntry("00", "01", "a1")
+	if a1.SequenceNo != 1 || a1.CrossPrefix != "" || !bytes.Equal(a1.NodeSHA3512, logstore.NodeSHA3512(hash("a1"), a0)) {
+		t.Errorf("bad second entry: %+v", a1)
+	}
+	if !a1.Timestamp.After(a0.Timestamp) {
+		t.Errorf("expected %s after %s", a1.Timestamp, a0.Timestamp)
+	}
+	b0 := appendEntry("01", "00", "b0")
+	if b0.SequenceNo != 0 || b0.CrossPrefix != "00" || b0.CrossSequenceNo != 1 || !bytes.Equal(b0.NodeSHA3512, logstore.NodeSHA3512(hash("b0"), a1)) {
+		t.Errorf("bad cross entry: %+v", b0)
+	}
+	if _, err := s.Append(ctx, "NA", "02", "", hash("a0")); err != logstore.ErrExists {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+
+	for _, e := range []logstore.Entry{a0, a1, b0} {
+		got, err := s.Get(ctx, e.Region, e.Prefix, e.SequenceNo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameEntry(got, e) {
+			t.Errorf("Get: expected %+v, got %+v", e, got)
+		}
+		got, err = s.Lookup(ctx, e.DataSHA3512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameEntry(got, e) {
+			t.Errorf("Lookup: expected %+v, got %+v", e, got)
+		}
+	}
+	for _, e := range []logstore.Entry{a1, b0} {
+		got, err := s.Tail(ctx, e.Region, e.Prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameEntry(got, e) {
+			t.Errorf("Tail: expected %+v, got %+v", e, got)
+		}
+	}
+	if _, err := s.Tail(ctx, "NA", "02"); err != logstore.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Get(ctx, "NA", "00", 2); err != logstore.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Lookup(ctx, hash("missing")); err != logstore.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Digests
+	for _, c := range []struct {
+		at   time.Time
+		want logstore.Entry
+	}{
+		{time.Time{}, a1},
+		{a0.Timestamp, a0},
+		{b0.Timestamp, a1},
+	} {
+		d, err := s.Digest(ctx, "NA", "00", c.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.String() != c.want.Digest().String() {
+			t.Errorf("Digest at %s: expected %s, got %s", c.at, c.want.Digest(), d)
+		}
+	}
+	if _, err := s.Digest(ctx, "NA", "00", a0.Timestamp.Add(-time.Nanosecond)); err != logstore.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Digest(ctx, "EU", "00", time.Time{}); err != logstore.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	for _, c := range []struct {
+		region string
+		at     time.Time
+		want   []logstore.Entry
+	}{
+		{"NA", time.Time{}, []logstore.Entry{a1, b0}},
+		{"NA", a1.Timestamp, []logstore.Entry{a1}},
+		{"NA", a0.Timestamp, []logstore.Entry{a0}},
+		{"EU", time.Time{}, nil},
+	} {
+		ds, err := s.Digests(ctx, c.region, c.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []digest.Prefix
+		for _, e := range c.want {
+			want = append(want, e.Digest())
+		}
+		if got := digestStrings(ds); !reflect.DeepEqual(got, digestStrings(want)) {
+			t.Errorf("Digests(%s, %s): expected %v, got %v", c.region, c.at, digestStrings(want), got)
+		}
+	}
+
+	// Scan
+	for _, c := range []struct {
+		region     string
+		start, end time.Time
+		want       []logstore.Entry
+	}{
+		{"NA", time.Time{}, time.Time{}, []logstore.Entry{a0, a1, b0}},
+		{"NA", a1.Timestamp, time.Time{}, []logstore.Entry{a1, b0}},
+		{"NA", a0.Timestamp, b0.Timestamp, []logstore.Entry{a0, a1}},
+		{"NA", b0.Timestamp.Add(time.Nanosecond), time.Time{}, nil},
+		{"EU", time.Time{}, time.Time{}, nil},
+	} {
+		got := scanAll(t, s.Scan(ctx, c.region, c.start, c.end))
+		ok := len(got) == len(c.want)
+		for i := 0; ok && i < len(got); i++ {
+			ok = sameEntry(got[i], c.want[i])
+		}
+		if !ok {
+			t.Errorf("Scan(%s, %s, %s): expected %+v, got %+v", c.region, c.start, c.end, c.want, got)
+		}
+	}
+}
+
+func scanAll(t *testing.T, itr logstore.Iterator) []logstore.Entry {
+	t.Helper()
+	defer itr.Stop()
+	var r []logstore.Entry
+	for {
+		e, err := itr.Next()
+		if err == iterator.Done {
+			return r
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = append(r, e)
+	}
+}
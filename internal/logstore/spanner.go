@@ -0,0 +1,289 @@
+package logstore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/vsekhar/fabula/internal/digest"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+)
+
+// SpannerSchema are the DDL statements creating the tables used by Spanner.
+//
+// Log is keyed in descending SequenceNo so the last entry of a prefix chain is
+// the first row read. The index on DataSHA3512 stores Timestamp so that an
+// entry found by DataSHA3512 can be used to read the log in the past. Making
+// it unique guards against the exceedingly unlikely possibility of
+// collision.
+var SpannerSchema = []string{
+	`CREATE TABLE Log (
+		Region          STRING(MAX) NOT NULL,
+		Prefix          STRING(MAX) NOT NULL,
+		SequenceNo      INT64 NOT NULL,
+		DataSHA3512     BYTES(64) NOT NULL,
+		NodeSHA3512     BYTES(64) NOT NULL,
+		Timestamp       TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+		CrossPrefix     STRING(MAX),
+		CrossSequenceNo INT64,
+	) PRIMARY KEY (Region, Prefix, SequenceNo DESC)`,
+	`CREATE UNIQUE INDEX LogByDataSHA3512 ON Log(DataSHA3512) STORING (Timestamp)`,
+	`CREATE INDEX LogByTimestamp ON Log(Region, Timestamp)`,
+}
+
+const (
+	logTable = "Log"
+	logIndex = "LogByDataSHA3512"
+)
+
+// logRow is a row of the Log table.
+type logRow struct {
+	Region          string
+	Prefix          string
+	SequenceNo      int64
+	DataSHA3512     []byte
+	NodeSHA3512     []byte
+	Timestamp       time.Time
+	CrossPrefix     spanner.NullString
+	CrossSequenceNo spanner.NullInt64
+}
+
+var logColumns = []string{"Region", "Prefix", "SequenceNo", "DataSHA3512", "NodeSHA3512", "Timestamp", "CrossPrefix", "CrossSequenceNo"}
+
+func (r *logRow) entry() Entry {
+	e := Entry{
+		Region:      r.Region,
+		Prefix:      r.Prefix,
+		SequenceNo:  uint64(r.SequenceNo),
+		DataSHA3512: r.DataSHA3512,
+		NodeSHA3512: r.NodeSHA3512,
+		Timestamp:   r.Timestamp,
+	}
+	if r.CrossPrefix.Valid {
+		e.CrossPrefix = r.CrossPrefix.StringVal
+		e.CrossSequenceNo = uint64(r.CrossSequenceNo.Int64)
+	}
+	return e
+}
+
+func toEntry(row *spanner.Row) (Entry, error) {
+	var r logRow
+	if err := row.ToStruct(&r); err != nil {
+		return Entry{}, err
+	}
+	return r.entry(), nil
+}
+
+// Spanner is a log store backed by Cloud Spanner.
+//
+// Each entry is appended in a read-write transaction that reads its
+// predecessors, and is timestamped with the transaction's commit timestamp.
+// Reads in the past use Spanner's snapshot reads, so they are limited to the
+// database's version retention period.
+type Spanner struct {
+	client *spanner.Client
+}
+
+// NewSpanner returns a log store using the Spanner database, of the form
+// projects/P/instances/I/databases/D. The database must have SpannerSchema.
+func NewSpanner(ctx context.Context, database string, opts ...option.ClientOption) (*Spanner, error) {
+	client, err := spanner.NewClient(ctx, database, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Spanner{client: client}, nil
+}
+
+// Close closes the connection to the database.
+func (s *Spanner) Close() {
+	s.client.Close()
+}
+
+// reader is implemented by read-only and read-write transactions.
+type reader interface {
+	ReadWithOptions(ctx context.Context, table string, keys spanner.KeySet, columns []string, opts *spanner.ReadOptions) *spanner.RowIterator
+}
+
+// last returns the last entry of a prefix chain.
+func last(ctx context.Context, r reader, region, prefix string) (Entry, error) {
+	itr := r.ReadWithOptions(ctx, logTable, spanner.Key{region, prefix}.AsPrefix(), logColumns, &spanner.ReadOptions{Limit: 1})
+	defer itr.Stop()
+	row, err := itr.Next()
+	if err == iterator.Done {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	return toEntry(row)
+}
+
+func bound(at time.Time) spanner.TimestampBound {
+	if at.IsZero() {
+		return spanner.StrongRead()
+	}
+	return spanner.ReadTimestamp(at)
+}
+
+// Append implements Interface.
+func (s *Spanner) Append(ctx context.Context, region, prefix, crossPrefix string, dataSHA3512 []byte) (Entry, error) {
+	var e Entry
+	ts, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		e = Entry{Region: region, Prefix: prefix, DataSHA3512: dataSHA3512}
+		var predecessors []Entry
+		prev, err := last(ctx, txn, region, prefix)
+		switch err {
+		case nil:
+			e.SequenceNo = prev.SequenceNo + 1
+			predecessors = append(predecessors, prev)
+		case ErrNotFound:
+		default:
+			return err
+		}
+		r := logRow{
+			Region:      region,
+			Prefix:      prefix,
+			SequenceNo:  int64(e.SequenceNo),
+			DataSHA3512: dataSHA3512,
+			Timestamp:   spanner.CommitTimestamp,
+		}
+		if crossPrefix != "" {
+			cross, err := last(ctx, txn, region, crossPrefix)
+			switch err {
+			case nil:
+				e.CrossPrefix, e.CrossSequenceNo = crossPrefix, cross.SequenceNo
+				r.CrossPrefix = spanner.NullString{StringVal: crossPrefix, Valid: true}
+				r.CrossSequenceNo = spanner.NullInt64{Int64: int64(cross.SequenceNo), Valid: true}
+				predecessors = append(predecessors, cross)
+			case ErrNotFound:
+			default:
+				return err
+			}
+		}
+		e.NodeSHA3512 = NodeSHA3512(dataSHA3512, predecessors...)
+		r.NodeSHA3512 = e.NodeSHA3512
+		m, err := spanner.InsertStruct(logTable, &r)
+		if err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{m})
+	})
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		return Entry{}, ErrExists
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	e.Timestamp = ts
+	return e, nil
+}
+
+// Get implements Interface.
+func (s *Spanner) Get(ctx context.Context, region, prefix string, seqNo uint64) (Entry, error) {
+	row, err := s.client.Single().ReadRow(ctx, logTable, spanner.Key{region, prefix, int64(seqNo)}, logColumns)
+	if spanner.ErrCode(err) == codes.NotFound {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	return toEntry(row)
+}
+
+// Tail implements Interface.
+func (s *Spanner) Tail(ctx context.Context, region, prefix string) (Entry, error) {
+	return last(ctx, s.client.Single(), region, prefix)
+}
+
+// Lookup implements Interface.
+func (s *Spanner) Lookup(ctx context.Context, dataSHA3512 []byte) (Entry, error) {
+	txn := s.client.ReadOnlyTransaction()
+	defer txn.Close()
+	row, err := txn.ReadRowUsingIndex(ctx, logTable, logIndex, spanner.Key{dataSHA3512}, []string{"Region", "Prefix", "SequenceNo"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	var region, prefix string
+	var seqNo int64
+	if err := row.Columns(&region, &prefix, &seqNo); err != nil {
+		return Entry{}, err
+	}
+	row, err = txn.ReadRow(ctx, logTable, spanner.Key{region, prefix, seqNo}, logColumns)
+	if err != nil {
+		return Entry{}, err
+	}
+	return toEntry(row)
+}
+
+// Digest implements Interface.
+func (s *Spanner) Digest(ctx context.Context, region, prefix string, at time.Time) (digest.Prefix, error) {
+	e, err := last(ctx, s.client.Single().WithTimestampBound(bound(at)), region, prefix)
+	if err != nil {
+		return digest.Prefix{}, err
+	}
+	return e.Digest(), nil
+}
+
+// Digests implements Interface.
+func (s *Spanner) Digests(ctx context.Context, region string, at time.Time) ([]digest.Prefix, error) {
+	stmt := spanner.Statement{
+		SQL: `SELECT l.* FROM Log AS l
+			WHERE l.Region = @region AND l.SequenceNo = (
+				SELECT MAX(SequenceNo) FROM Log
+				WHERE Region = l.Region AND Prefix = l.Prefix)
+			ORDER BY l.Prefix`,
+		Params: map[string]interface{}{"region": region},
+	}
+	itr := s.client.Single().WithTimestampBound(bound(at)).Query(ctx, stmt)
+	defer itr.Stop()
+	var r []digest.Prefix
+	for {
+		row, err := itr.Next()
+		if err == iterator.Done {
+			return r, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		e, err := toEntry(row)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, e.Digest())
+	}
+}
+
+type spannerIterator struct {
+	itr *spanner.RowIterator
+}
+
+func (si *spannerIterator) Next() (Entry, error) {
+	row, err := si.itr.Next()
+	if err != nil {
+		return Entry{}, err
+	}
+	return toEntry(row)
+}
+
+func (si *spannerIterator) Stop() {
+	si.itr.Stop()
+}
+
+// Scan implements Interface. Entries are read in a single snapshot.
+func (s *Spanner) Scan(ctx context.Context, region string, start, end time.Time) Iterator {
+	sql := `SELECT * FROM Log WHERE Region = @region AND Timestamp >= @start`
+	params := map[string]interface{}{"region": region, "start": start}
+	if !end.IsZero() {
+		sql += ` AND Timestamp < @end`
+		params["end"] = end
+	}
+	sql += ` ORDER BY Timestamp, Prefix, SequenceNo`
+	return &spannerIterator{
+		itr: s.client.Single().Query(ctx, spanner.Statement{SQL: sql, Params: params}),
+	}
+}
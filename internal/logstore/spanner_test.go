@@ -0,0 +1,88 @@
+package logstore_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	instance "cloud.google.com/go/spanner/admin/instance/apiv1"
+	"github.com/vsekhar/fabula/internal/logstore"
+	databasepb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+	instancepb "google.golang.org/genproto/googleapis/spanner/admin/instance/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Spanner tests run against the Spanner emulator, e.g.:
+//
+//	gcloud emulators spanner start &
+//	SPANNER_EMULATOR_HOST=localhost:9010 go test ./internal/logstore
+const (
+	emulatorProject  = "projects/fabula-test"
+	emulatorInstance = emulatorProject + "/instances/test"
+)
+
+// newSpanner returns a log store using a new database in the emulator.
+func newSpanner(t *testing.T) *logstore.Spanner {
+	if os.Getenv("SPANNER_EMULATOR_HOST") == "" {
+		t.Skip("SPANNER_EMULATOR_HOST not set, skipping Spanner tests")
+	}
+	ctx := context.Background()
+
+	ic, err := instance.NewInstanceAdminClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+	iop, err := ic.CreateInstance(ctx, &instancepb.CreateInstanceRequest{
+		Parent:     emulatorProject,
+		InstanceId: "test",
+		Instance: &instancepb.Instance{
+			Config:      emulatorProject + "/instanceConfigs/emulator-config",
+			DisplayName: "test",
+			NodeCount:   1,
+		},
+	})
+	if err == nil {
+		_, err = iop.Wait(ctx)
+	}
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		t.Fatal(err)
+	}
+
+	dc, err := database.NewDatabaseAdminClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := fmt.Sprintf("test%d", time.Now().UnixNano()%1e12)
+	dop, err := dc.CreateDatabase(ctx, &databasepb.CreateDatabaseRequest{
+		Parent:          emulatorInstance,
+		CreateStatement: "CREATE DATABASE `" + id + "`",
+		ExtraStatements: logstore.SpannerSchema,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := dop.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dc.DropDatabase(context.Background(), &databasepb.DropDatabaseRequest{Database: db.Name})
+		dc.Close()
+	})
+
+	s, err := logstore.NewSpanner(ctx, db.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSpanner(t *testing.T) {
+	testStore(t, newSpanner(t))
+}
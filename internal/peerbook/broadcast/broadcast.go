@@ -0,0 +1,208 @@
+// Package broadcast implements typed broadcast messages over a PeerBook.
+//
+// Messages are protocol buffers. Each message is broadcast with the full name
+// of its type (e.g. "fabula.broadcast.v1.PrefixDigest") so that incompatible
+// changes are made by introducing a new versioned type, which peers that do
+// not recognize it will ignore.
+//
+// Broadcasts may be delivered more than once and out of order. A Registry
+// drops duplicate messages and, for types registered with an ordering key,
+// messages older (by Lamport time) than the latest message delivered for the
+// same key.
+package broadcast
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// MaxSize is the largest broadcast, as measured by Size, that peers will send
+// (Serf's default user event size limit).
+const MaxSize = 512
+
+// Size returns the size of a broadcast of name and payload once encoded by
+// Serf, which limits the size of the encoded event rather than of its name and
+// payload.
+//
+// Serf encodes a broadcast as a message type byte followed by a msgpack map of
+// its Lamport time, name, payload and coalesce flag. The Lamport time is
+// assigned when the broadcast is sent, so the size of the largest one is
+// assumed.
+func Size(name string, payload []byte) int {
+	const fixed = 1 + // message type
+		1 + // map header
+		(1 + len("LTime")) + (1 + len("Name")) + (1 + len("Payload")) + (1 + len("CC")) +
+		9 + // largest Lamport time
+		1 // coalesce flag
+	return fixed + rawSize(len(name)) + rawSize(len(payload))
+}
+
+// rawSize returns the size of n bytes encoded as a msgpack raw string.
+func rawSize(n int) int {
+	switch {
+	case n < 32:
+		return 1 + n
+	case n < 1<<16:
+		return 3 + n
+	}
+	return 5 + n
+}
+
+// Size of the window of recent messages remembered to drop duplicates of
+// unordered messages.
+const dedupeWindow = 1024
+
+var (
+	// ErrTooLarge is returned when sending a message exceeding MaxSize.
+	ErrTooLarge = errors.New("broadcast: message too large")
+
+	// ErrUnregistered is returned when handling a message of an unregistered
+	// type.
+	ErrUnregistered = errors.New("broadcast: unregistered message type")
+)
+
+// Sender sends raw broadcasts. It is implemented by *peerbook.PeerBook.
+type Sender interface {
+	Broadcast(name string, payload []byte, coalesce bool) error
+}
+
+// Handler handles a message broadcast at Lamport time ltime.
+type Handler func(ltime uint64, m proto.Message)
+
+type digestT [sha256.Size]byte
+
+type seen struct {
+	ltime    uint64
+	payloads map[digestT]struct{}
+}
+
+type registration struct {
+	typ     protoreflect.MessageType
+	key     func(proto.Message) string // nil if unordered
+	handler Handler
+
+	latest map[string]*seen // map[key]; ordered types
+
+	recent    map[digestT]struct{} // unordered types
+	recentLog []digestT
+}
+
+// Registry sends typed messages and dispatches received messages to handlers
+// registered for their type.
+//
+// It is safe to use a Registry from multiple goroutines.
+type Registry struct {
+	sender Sender
+
+	mu    sync.Mutex
+	types map[protoreflect.FullName]*registration
+}
+
+// New returns a new Registry sending messages via s.
+func New(s Sender) *Registry {
+	return &Registry{
+		sender: s,
+		types:  make(map[protoreflect.FullName]*registration),
+	}
+}
+
+// Register calls h with each received message of the same type as example.
+//
+// If key is not nil, messages with the same key are delivered in Lamport time
+// order and messages older than the latest delivered message with the same key
+// are dropped. If key is nil, messages are delivered in the order received and
+// only duplicates are dropped.
+//
+// Register panics if a handler is already registered for the type.
+func (r *Registry) Register(example proto.Message, key func(proto.Message) string, h Handler) {
+	typ := example.ProtoReflect().Type()
+	name := typ.Descriptor().FullName()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.types[name]; ok {
+		panic(fmt.Sprintf("broadcast: handler already registered for %s", name))
+	}
+	r.types[name] = &registration{
+		typ:     typ,
+		key:     key,
+		handler: h,
+		latest:  make(map[string]*seen),
+		recent:  make(map[digestT]struct{}),
+	}
+}
+
+// Send broadcasts m to all peers. If coalesce is true, peers may drop older
+// messages of the same type that have not yet been delivered.
+func (r *Registry) Send(m proto.Message, coalesce bool) error {
+	name := string(m.ProtoReflect().Descriptor().FullName())
+	payload, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if n := Size(name, payload); n > MaxSize {
+		return fmt.Errorf("%w: %s is %d bytes, limit is %d", ErrTooLarge, name, n, MaxSize)
+	}
+	return r.sender.Broadcast(name, payload, coalesce)
+}
+
+// Handle handles a raw broadcast received from a peer. Duplicate and stale
+// messages are dropped without error.
+func (r *Registry) Handle(ltime uint64, name string, payload []byte) error {
+	r.mu.Lock()
+	reg, ok := r.types[protoreflect.FullName(name)]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnregistered, name)
+	}
+	m := reg.typ.New().Interface()
+	if err := proto.Unmarshal(payload, m); err != nil {
+		return fmt.Errorf("broadcast: unmarshalling %s: %w", name, err)
+	}
+	d := digestT(sha256.Sum256(payload))
+
+	r.mu.Lock()
+	deliver := reg.admit(ltime, d, m)
+	r.mu.Unlock()
+	if deliver {
+		reg.handler(ltime, m)
+	}
+	return nil
+}
+
+// admit returns true if a message should be delivered. r.mu must be held.
+func (reg *registration) admit(ltime uint64, d digestT, m proto.Message) bool {
+	if reg.key == nil {
+		if _, ok := reg.recent[d]; ok {
+			return false
+		}
+		reg.recent[d] = struct{}{}
+		reg.recentLog = append(reg.recentLog, d)
+		if len(reg.recentLog) > dedupeWindow {
+			delete(reg.recent, reg.recentLog[0])
+			reg.recentLog = reg.recentLog[1:]
+		}
+		return true
+	}
+
+	k := reg.key(m)
+	s, ok := reg.latest[k]
+	switch {
+	case !ok || ltime > s.ltime:
+		reg.latest[k] = &seen{ltime: ltime, payloads: map[digestT]struct{}{d: {}}}
+		return true
+	case ltime < s.ltime:
+		return false
+	}
+	// Concurrent messages from different peers can have the same Lamport
+	// time.
+	if _, dup := s.payloads[d]; dup {
+		return false
+	}
+	s.payloads[d] = struct{}{}
+	return true
+}
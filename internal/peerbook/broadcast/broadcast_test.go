@@ -0,0 +1,162 @@
+package broadcast_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vsekhar/fabula/internal/peerbook/broadcast"
+	"github.com/vsekhar/fabula/pkg/api/broadcastpb"
+	"google.golang.org/protobuf/proto"
+)
+
+type sent struct {
+	name    string
+	payload []byte
+}
+
+// loopback records broadcasts so they can be replayed to a Registry.
+type loopback struct {
+	sent []sent
+}
+
+func (l *loopback) Broadcast(name string, payload []byte, _ bool) error {
+	l.sent = append(l.sent, sent{name, payload})
+	return nil
+}
+
+func digestKey(m proto.Message) string {
+	d := m.(*broadcastpb.PrefixDigest)
+	return d.Region + ":" + d.Prefix
+}
+
+func TestRoundTrip(t *testing.T) {
+	lb := new(loopback)
+	r := broadcast.New(lb)
+	var got []*broadcastpb.PrefixDigest
+	r.Register(&broadcastpb.PrefixDigest{}, digestKey, func(_ uint64, m proto.Message) {
+		got = append(got, m.(*broadcastpb.PrefixDigest))
+	})
+	want := &broadcastpb.PrefixDigest{Region: "NA", Prefix: "a1", Entries: 3, Sha3512: []byte{1, 2, 3}}
+	if err := r.Send(want, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(lb.sent) != 1 {
+		t.Fatalf("expected 1 broadcast, got %d", len(lb.sent))
+	}
+	if lb.sent[0].name != "fabula.broadcast.v1.PrefixDigest" {
+		t.Errorf("unexpected name %s", lb.sent[0].name)
+	}
+	if err := r.Handle(1, lb.sent[0].name, lb.sent[0].payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !proto.Equal(got[0], want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	r := broadcast.New(new(loopback))
+	var got []uint64
+	r.Register(&broadcastpb.PrefixDigest{}, digestKey, func(_ uint64, m proto.Message) {
+		got = append(got, m.(*broadcastpb.PrefixDigest).Entries)
+	})
+	handle := func(ltime uint64, prefix string, entries uint64) {
+		t.Helper()
+		m := &broadcastpb.PrefixDigest{Region: "NA", Prefix: prefix, Entries: entries}
+		b, err := proto.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Handle(ltime, "fabula.broadcast.v1.PrefixDigest", b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handle(5, "a1", 5)
+	handle(5, "a1", 5) // duplicate
+	handle(4, "a1", 4) // stale
+	handle(4, "b2", 1) // different key
+	handle(5, "a1", 6) // concurrent
+	handle(6, "a1", 7)
+	want := []uint64{5, 1, 6, 7}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestUnordered(t *testing.T) {
+	r := broadcast.New(new(loopback))
+	n := 0
+	r.Register(&broadcastpb.PrefixLease{}, nil, func(uint64, proto.Message) { n++ })
+	b1, _ := proto.Marshal(&broadcastpb.PrefixLease{Region: "NA", Prefix: "a1", Epoch: 2, Owner: "b"})
+	b2, _ := proto.Marshal(&broadcastpb.PrefixLease{Region: "NA", Prefix: "a1", Epoch: 2, Owner: "a"})
+	for _, h := range []struct {
+		ltime   uint64
+		payload []byte
+	}{{5, b1}, {4, b2}, {5, b1}, {6, b2}} {
+		if err := r.Handle(h.ltime, "fabula.broadcast.v1.PrefixLease", h.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 deliveries, got %d", n)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	r := broadcast.New(new(loopback))
+	r.Register(&broadcastpb.PrefixLease{}, nil, func(uint64, proto.Message) {})
+	if err := r.Handle(1, "fabula.broadcast.v0.Unknown", nil); !errors.Is(err, broadcast.ErrUnregistered) {
+		t.Errorf("expected ErrUnregistered, got %v", err)
+	}
+	if err := r.Handle(1, "fabula.broadcast.v1.PrefixLease", []byte{0xff}); err == nil {
+		t.Error("expected error unmarshalling bad payload")
+	}
+	big := &broadcastpb.PrefixLease{Owner: strings.Repeat("x", broadcast.MaxSize)}
+	if err := r.Send(big, false); !errors.Is(err, broadcast.ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic registering type twice")
+		}
+	}()
+	r.Register(&broadcastpb.PrefixLease{}, nil, func(uint64, proto.Message) {})
+}
+
+func TestMaxSize(t *testing.T) {
+	r := broadcast.New(new(loopback))
+	name := "fabula.broadcast.v1.PrefixDigest"
+	var last int // largest size sent
+	for n := 0; ; n++ {
+		m := &broadcastpb.PrefixDigest{Sha3512: make([]byte, n)}
+		b, err := proto.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Serf adds 40 bytes to names and payloads of 32 bytes or more, with
+		// the largest Lamport times.
+		if got, want := broadcast.Size(name, b), len(name)+len(b)+40; len(b) >= 32 && got != want {
+			t.Fatalf("expected size %d, got %d", want, got)
+		}
+		err = r.Send(m, false)
+		if broadcast.Size(name, b) > broadcast.MaxSize {
+			if !errors.Is(err, broadcast.ErrTooLarge) {
+				t.Errorf("%d bytes: expected ErrTooLarge, got %v", broadcast.Size(name, b), err)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("%d bytes: %v", broadcast.Size(name, b), err)
+		}
+		last = broadcast.Size(name, b)
+	}
+	if last < broadcast.MaxSize-2 {
+		t.Errorf("largest broadcast sent was %d bytes, limit is %d", last, broadcast.MaxSize)
+	}
+}
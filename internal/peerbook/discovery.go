@@ -0,0 +1,116 @@
+package peerbook
+
+import (
+	"context"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Discoverer finds peers to join.
+//
+// Implementations for various environments are provided in package discovery.
+type Discoverer interface {
+	// Discover returns the control addresses (host:port) of peers. It need not
+	// return every peer, only enough for the local peer to join the group.
+	Discover(ctx context.Context) ([]string, error)
+}
+
+const (
+	maxDiscoverySleep      = 30 * time.Second
+	discoverySleepPerPeer  = 1 * time.Second
+	minDiscoverySleep      = 1 * time.Second
+	discoveryErrorCooldown = 5 * time.Second
+)
+
+// Discover periodically joins peers found by d that are not already members
+// until ctx is done.
+//
+// Discovery slows down as the group grows since each peer learns of other
+// peers through the group itself.
+func (p *PeerBook) Discover(ctx context.Context, d Discoverer) {
+	for {
+		sleep := p.discoverOnce(ctx, d)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sleep):
+		}
+	}
+}
+
+// discoverOnce joins newly discovered peers and returns how long to wait
+// before discovering again.
+func (p *PeerBook) discoverOnce(ctx context.Context, d Discoverer) time.Duration {
+	known := make(map[string]struct{})
+	peers := p.Peers()
+	for _, peer := range peers {
+		if port, ok := peer.Tags[controlPortTagName]; ok {
+			known[net.JoinHostPort(peer.Addr.String(), port)] = struct{}{}
+		}
+	}
+
+	addrs, err := d.Discover(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).Error("peerbook: discovering peers")
+		}
+		return discoveryErrorCooldown
+	}
+	var toJoin []string
+	for _, addr := range addrs {
+		if !isKnown(ctx, known, addr) {
+			toJoin = append(toJoin, addr)
+		}
+	}
+	if len(toJoin) > 0 {
+		n, err := p.Join(toJoin)
+		if err != nil {
+			log.WithError(err).Warn("peerbook: joining discovered peers")
+		}
+		log.WithFields(log.Fields{
+			"discovered": len(addrs),
+			"new":        len(toJoin),
+			"joined":     n,
+		}).Debug("peerbook: joined discovered peers")
+	}
+
+	sleep := time.Duration(len(peers)) * discoverySleepPerPeer
+	if sleep < minDiscoverySleep {
+		sleep = minDiscoverySleep
+	}
+	if sleep > maxDiscoverySleep {
+		sleep = maxDiscoverySleep
+	}
+	return sleep
+}
+
+// isKnown returns true if addr is the address of a peer in known, which holds
+// the IP:port addresses of members. Discoverers may return host names, so addr
+// is resolved before it is compared. An address that cannot be resolved is
+// not known.
+func isKnown(ctx context.Context, known map[string]struct{}, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return false
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if _, ok := known[net.JoinHostPort(ip.String(), port)]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// Package discovery provides ways for peers to find each other.
+//
+// Each implementation satisfies peerbook.Discoverer. Kubernetes discovery is
+// provided separately in package k8s so that other deployments do not depend
+// on the Kubernetes client.
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Static discovers a fixed list of peer addresses (host:port).
+type Static []string
+
+// Discover implements peerbook.Discoverer.
+func (s Static) Discover(context.Context) ([]string, error) {
+	r := make([]string, len(s))
+	copy(r, s)
+	return r, nil
+}
+
+// File discovers peer addresses listed in a file, one per line. Blank lines and
+// lines starting with '#' are ignored.
+//
+// The file is read on each call to Discover, so peers can be added while
+// running. This is convenient for local development clusters.
+type File struct {
+	Path string
+
+	// DefaultPort is used for addresses in the file without a port. If zero,
+	// every address must include a port.
+	DefaultPort int
+}
+
+// Discover implements peerbook.Discoverer.
+func (f File) Discover(context.Context) ([]string, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r []string
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		addr, err := withPort(s, f.DefaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("discovery: %s:%d: %w", f.Path, line, err)
+		}
+		r = append(r, addr)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func withPort(addr string, defaultPort int) (string, error) {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr, nil
+	}
+	if defaultPort == 0 {
+		return "", fmt.Errorf("address %q has no port", addr)
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(defaultPort)), nil
+}
+
+// DNSSRV discovers peers from DNS SRV records (e.g. a Kubernetes headless
+// service or a Consul service).
+type DNSSRV struct {
+	// Name is queried directly for SRV records, e.g.
+	// "_serf._udp.fabula.example.com".
+	Name string
+
+	// Resolver is used to look up records. If nil, net.DefaultResolver is
+	// used.
+	Resolver *net.Resolver
+}
+
+// Discover implements peerbook.Discoverer.
+func (d DNSSRV) Discover(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, srvs, err := resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]string, len(srvs))
+	for i, srv := range srvs {
+		r[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+	}
+	return r, nil
+}
+
+// Candidate is a peer address that was created (e.g. started) at a known time.
+type Candidate struct {
+	Addr    string
+	Created time.Time
+}
+
+// Sample returns the addresses of up to n candidates chosen at random,
+// preferring candidates created at least minAge before now. Established peers
+// are more likely to be members of the group than peers that are still
+// starting up.
+//
+// If n <= 0, all candidates are returned in order of preference.
+func Sample(cands []Candidate, n int, minAge time.Duration, now time.Time, rnd *rand.Rand) []string {
+	cs := make([]Candidate, len(cands))
+	copy(cs, cands)
+	rnd.Shuffle(len(cs), func(i, j int) { cs[i], cs[j] = cs[j], cs[i] })
+	cutoff := now.Add(-minAge)
+	sort.SliceStable(cs, func(i, j int) bool {
+		return !cs[i].Created.After(cutoff) && cs[j].Created.After(cutoff)
+	})
+	if n > 0 && len(cs) > n {
+		cs = cs[:n]
+	}
+	r := make([]string, len(cs))
+	for i, c := range cs {
+		r[i] = c.Addr
+	}
+	return r
+}
@@ -0,0 +1,95 @@
+package discovery_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/peerbook/discovery"
+)
+
+func TestStatic(t *testing.T) {
+	s := discovery.Static{"a:1", "b:2"}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got[0] = "c:3"
+	if s[0] != "a:1" {
+		t.Error("Discover returned the underlying slice")
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers")
+	contents := "# local peers\n10.0.0.1:7946\n\n  10.0.0.2  \n[::1]:8000\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := discovery.File{Path: path, DefaultPort: 7946}.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1:7946", "10.0.0.2:7946", "[::1]:8000"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	}
+
+	if _, err := (discovery.File{Path: path}).Discover(context.Background()); err == nil {
+		t.Error("expected error for address without port")
+	}
+	if _, err := (discovery.File{Path: filepath.Join(dir, "missing")}).Discover(context.Background()); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestSample(t *testing.T) {
+	now := time.Unix(1608000000, 0)
+	const minAge = 5 * time.Minute
+	var cands []discovery.Candidate
+	old := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		c := discovery.Candidate{Addr: string(rune('a' + i)), Created: now.Add(-time.Duration(i) * time.Minute)}
+		if i >= 5 {
+			old[c.Addr] = true
+		}
+		cands = append(cands, c)
+	}
+	rnd := rand.New(rand.NewSource(1))
+
+	got := discovery.Sample(cands, 10, minAge, now, rnd)
+	if len(got) != 10 {
+		t.Fatalf("expected 10 addresses, got %d", len(got))
+	}
+	for _, a := range got {
+		if !old[a] {
+			t.Errorf("expected only old candidates, got %s", a)
+		}
+	}
+
+	got = discovery.Sample(cands, 0, minAge, now, rnd)
+	if len(got) != len(cands) {
+		t.Fatalf("expected %d addresses, got %d", len(cands), len(got))
+	}
+	for i, a := range got {
+		if old[a] != (i < len(old)) {
+			t.Errorf("expected old candidates first, got %v", got)
+			break
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Package k8s discovers peers running as pods in a Kubernetes cluster.
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/peerbook/discovery"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// ErrNotInCluster is returned by InCluster when not running in a Kubernetes
+// cluster.
+var ErrNotInCluster = rest.ErrNotInCluster
+
+// Defaults for Pods.
+const (
+	DefaultMinAge = 5 * time.Minute
+	DefaultMax    = 10
+)
+
+// Pods discovers peers among running pods matching a label selector.
+//
+// Pods that have been running for at least MinAge are preferred since they are
+// more likely to already be members of the group. At most Max pods are
+// returned, sampled at random so that large clusters do not join every pod at
+// once.
+type Pods struct {
+	Pods     corev1client.PodInterface
+	Selector string // e.g. "app=fabula"; empty selects all pods
+	Port     int    // peerbook control port of each pod
+	MinAge   time.Duration
+	Max      int // if zero, all matching pods are returned
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// namespaceFile holds the namespace of the current pod. It is mounted with the
+// pod's service account.
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// InCluster returns a Pods discovering pods in the namespace in the
+// K8S_NAMESPACE environment variable, or if it is not set, the namespace of the
+// current pod, using the service account of the current pod.
+func InCluster(selector string, port int) (*Pods, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := corev1client.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	namespace := os.Getenv("K8S_NAMESPACE")
+	if namespace == "" {
+		b, err := ioutil.ReadFile(namespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("k8s: K8S_NAMESPACE environment variable not set and reading namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(b))
+	}
+	if namespace == "" {
+		return nil, errors.New("k8s: no namespace in K8S_NAMESPACE environment variable or " + namespaceFile)
+	}
+	return &Pods{
+		Pods:     client.Pods(namespace),
+		Selector: selector,
+		Port:     port,
+		MinAge:   DefaultMinAge,
+		Max:      DefaultMax,
+	}, nil
+}
+
+// Discover implements peerbook.Discoverer.
+func (p *Pods) Discover(ctx context.Context) ([]string, error) {
+	list, err := p.Pods.List(ctx, metav1.ListOptions{LabelSelector: p.Selector})
+	if err != nil {
+		return nil, err
+	}
+	cands := make([]discovery.Candidate, 0, len(list.Items))
+	for _, pod := range list.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		created := pod.CreationTimestamp.Time
+		if pod.Status.StartTime != nil {
+			created = pod.Status.StartTime.Time
+		}
+		cands = append(cands, discovery.Candidate{
+			Addr:    net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(p.Port)),
+			Created: created,
+		})
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rnd == nil {
+		p.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return discovery.Sample(cands, p.Max, p.MinAge, time.Now(), p.rnd), nil
+}
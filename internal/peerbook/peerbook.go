@@ -7,32 +7,34 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/groupcache/consistenthash"
 	"github.com/hashicorp/serf/serf"
 	log "github.com/sirupsen/logrus"
 	"github.com/vsekhar/fabula/internal/hclog2logrus"
 	"github.com/vsekhar/fabula/internal/notify"
+	"github.com/vsekhar/fabula/internal/peerbook/broadcast"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/label"
 	"go.opentelemetry.io/otel/metric"
 )
 
-// The number of shards to divide the keyspace into for each server in the
-// cluster. A higher number will ensure a more evently divided keyspace for
-// smaller numbers of servers. There is no real cost to having a very high
-// number since keys are discrete and independent: we don't gain anything by
-// having nearby keys in the keyspace allocated to the same server, only that
+// DefaultShardsPerServer is the number of shards to divide the keyspace into
+// for each server in the cluster when using the default consistent hash ring.
+// A higher number will ensure a more evently divided keyspace for smaller
+// numbers of servers. There is no real cost to having a very high number
+// since keys are discrete and independent: we don't gain anything by having
+// nearby keys in the keyspace allocated to the same server, only that
 // individual keys are consistently allocated to the same server on each client.
 //
 // For very large numbers of servers, many shards per server increases overhead
 // (e.g. 500 servers x 100 shards means we must build a table of 50,000 shards
 // each time a server is added or removed). But we do this asynchronously so it
 // should be manageable.
-const shardsPerServer = 100
+const DefaultShardsPerServer = 100
 
 // Do an update of the ring hash agianst all members every forcedUpdatePeriod
 // to ensure we capture all members even if we miss member join events.
@@ -40,6 +42,16 @@ const forcedUpdatePeriod = 30 * time.Second
 
 const controlPortTagName = "_peerbookControlPort"
 
+var (
+	// ErrNoPeers is returned when looking up a key while there are no alive
+	// peers.
+	ErrNoPeers = errors.New("peerbook: no peers")
+
+	// ErrNotMember is returned when the ring names a peer for which member
+	// information is not available.
+	ErrNotMember = errors.New("peerbook: peer is not a member")
+)
+
 // LamportTime is a monotonic clock that can be used to order broadcast
 // messages.
 type LamportTime = serf.LamportTime
@@ -52,9 +64,12 @@ type PeerBook struct {
 	controlPort int
 	serf        *serf.Serf
 
-	memberNotifier *notify.Notifier
-	ring           atomic.Value // *consistenthash.Map[string(prefix)]string(name)
-	members        *sync.Map    // map[string(name)]serf.Member
+	memberNotifier  *notify.Notifier
+	newRing         RingFunc
+	serfConfigFuncs []func(*serf.Config)
+	ring            atomic.Value  // ringValue
+	ringReady       chan struct{} // closed once ring is first stored
+	ringReadyOnce   sync.Once
 
 	// BroadcastHandler is called to handle each broadcast message sent to
 	// peers. It should complete quickly to prevent missing future messages.
@@ -77,8 +92,8 @@ type PeerBook struct {
 	// If DestroyPeerObject is nil, then the peer object is simply dropped. If
 	// PeerBook held the only reference to the peer object, then the object will
 	// be deallocated.
-	DestroyPeerObject func(key string, obj interface{})
-	peerObjects       *sync.Map // TODO: lru.ARCCache?
+	DestroyPeerObject func(peerName string, obj interface{})
+	peerObjects       *sync.Map // map[string(name)]interface{}; TODO: lru.ARCCache?
 
 	ctx        context.Context
 	shutdownWg *sync.WaitGroup
@@ -86,10 +101,38 @@ type PeerBook struct {
 	peerCount metric.BoundInt64ValueRecorder
 }
 
+// Option configures a PeerBook.
+type Option func(*PeerBook)
+
+// WithRing sets the function used to build the ring assigning keys to peers.
+// All peers in a group must use the same kind of ring.
+//
+// The default is ConsistentHashRing(100).
+func WithRing(f RingFunc) Option {
+	return func(p *PeerBook) {
+		p.newRing = f
+	}
+}
+
+// WithSerfConfig calls f to adjust the Serf configuration of a PeerBook before
+// it is created (e.g. to shorten timeouts or to replace the memberlist
+// transport). It is mostly useful for tests; see package peerbooktest.
+func WithSerfConfig(f func(*serf.Config)) Option {
+	return func(p *PeerBook) {
+		p.serfConfigFuncs = append(p.serfConfigFuncs, f)
+	}
+}
+
 // New returns a new PeerBook.
 //
 // Cancelling the provided context terminates the peer.
-func New(ctx context.Context, nodeName string, controlPort int, tags map[string]string) (*PeerBook, error) {
+func New(ctx context.Context, nodeName string, controlPort int, tags map[string]string, opts ...Option) (*PeerBook, error) {
+	r := new(PeerBook)
+	r.newRing = ConsistentHashRing(DefaultShardsPerServer)
+	for _, opt := range opts {
+		opt(r)
+	}
+
 	serfConfig := serf.DefaultConfig()
 	serfConfig.NodeName = nodeName
 	serfConfig.MemberlistConfig.BindAddr = "0.0.0.0"
@@ -97,6 +140,7 @@ func New(ctx context.Context, nodeName string, controlPort int, tags map[string]
 	toLogrus := hclog2logrus.New()
 	serfConfig.MemberlistConfig.Logger = toLogrus
 	serfConfig.Logger = toLogrus
+	serfConfig.UserEventSizeLimit = broadcast.MaxSize
 	setTags := make(map[string]string)
 	for k, v := range tags {
 		setTags[k] = v
@@ -105,16 +149,18 @@ func New(ctx context.Context, nodeName string, controlPort int, tags map[string]
 	serfConfig.Tags = setTags
 	eventCh := make(chan serf.Event, 10)
 	serfConfig.EventCh = eventCh
+	for _, f := range r.serfConfigFuncs {
+		f(serfConfig)
+	}
 	s, err := serf.Create(serfConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	r := new(PeerBook)
 	r.ctx = ctx
 	r.controlPort = controlPort
 	r.serf = s
-	r.members = new(sync.Map)
+	r.ringReady = make(chan struct{})
 	r.memberNotifier = notify.New(r.updateMembers)
 	r.peerObjects = new(sync.Map)
 	r.shutdownWg = new(sync.WaitGroup)
@@ -220,44 +266,41 @@ func (p *PeerBook) updateMembers() {
 
 	nameMap := make(map[string]struct{})
 	addrMap := make(map[string]struct{})
+	peers := make(map[string]Peer)
 	for _, m := range members {
 		if m.Status == serf.StatusAlive {
 			if m.Name == "" || m.Addr.String() == "" {
 				continue
 			}
-			nameMap[m.Name] = struct{}{}
 			addr := m.Addr.String()
 			port, ok := m.Tags[controlPortTagName]
 			if !ok {
 				log.WithField("name", m.Name).Error("node does not have 'controlPort' tag")
 				continue
 			}
+			nameMap[m.Name] = struct{}{}
 			addrMap[fmt.Sprintf("%s:%s", addr, port)] = struct{}{}
-			p.members.Store(m.Name, m)
+			peers[m.Name] = Peer{Name: m.Name, Addr: m.Addr, Tags: m.Tags}
 		}
 	}
 	names := make([]string, 0, len(nameMap))
 	for name := range nameMap {
 		names = append(names, name)
 	}
-
-	// TODO: maglev hash?
-
-	// package consistenthash refers to shardsPerServer as "replicas" which
-	// isn't really accurate since there is no replication involved.
-	newRing := consistenthash.New(shardsPerServer /* "replicas" */, nil)
-	newRing.Add(names...)
-	p.ring.Store(newRing)
-
-	// Prevent member and peerobject maps from growing endlessly.
-	p.members.Range(func(key, value interface{}) bool {
-		name := key.(string)
-		if _, ok := nameMap[name]; !ok {
-			p.members.Delete(key)
-			log.WithField("peer_name", name).Debug("peerbook: dropping peer", name)
-		}
-		return true // keep going
+	sort.Strings(names)
+
+	// The ring and the members it names are stored together so lookups never
+	// see a peer in one but not the other.
+	start := time.Now()
+	p.ring.Store(ringValue{
+		Ring:    buildRing(p.newRing, names),
+		names:   names,
+		members: peers,
 	})
+	buildTime := time.Since(start)
+	p.ringReadyOnce.Do(func() { close(p.ringReady) })
+
+	// Prevent the peer object map from growing endlessly.
 	p.peerObjects.Range(func(key, value interface{}) bool {
 		name := key.(string)
 		if _, ok := nameMap[name]; !ok {
@@ -270,8 +313,9 @@ func (p *PeerBook) updateMembers() {
 	})
 
 	log.WithFields(log.Fields{
-		"size":      len(addrMap),
-		"addresses": addrMap,
+		"size":       len(addrMap),
+		"addresses":  addrMap,
+		"build_time": buildTime,
 	}).Debug("peerbook: hashring update")
 	p.peerCount.Record(context.Background(), int64(len(addrMap)))
 }
@@ -279,33 +323,85 @@ func (p *PeerBook) updateMembers() {
 // Broadcast broadcasts a small message to all peers in the group. Broadcasts
 // can be used to keep peers up-to-date. Broadcasts are delivered on an
 // eventually consistent basis.
+//
+// broadcast.Size of the name and payload must not exceed broadcast.MaxSize. Most
+// callers should send typed messages using package broadcast instead.
 func (p *PeerBook) Broadcast(name string, payload []byte, coalesce bool) error {
 	return p.serf.UserEvent(name, payload, coalesce)
 }
 
-// GetPeer returns the peerName, ip and tags of the peer owning the provided
-// key.
-func (p *PeerBook) GetPeer(key string) (peerName string, addr net.IP, tags map[string]string) {
-	peerName = p.ring.Load().(*consistenthash.Map).Get(key)
-	memberi, ok := p.members.Load(peerName)
+// snapshot returns the current ring, waiting for the first one to be built if
+// necessary.
+func (p *PeerBook) snapshot(ctx context.Context) (ringValue, error) {
+	select {
+	case <-p.ringReady:
+		return p.ring.Load().(ringValue), nil
+	case <-ctx.Done():
+		return ringValue{}, ctx.Err()
+	}
+}
+
+func (rv ringValue) peer(name string) (Peer, error) {
+	if name == "" {
+		return Peer{}, ErrNoPeers
+	}
+	peer, ok := rv.members[name]
 	if !ok {
-		log.WithField("peer_name", peerName).Fatal("peerbook: expected to load member information")
+		return Peer{}, fmt.Errorf("%w: %s", ErrNotMember, name)
+	}
+	return peer, nil
+}
+
+// GetPeer returns the peer owning the provided key.
+//
+// If the first snapshot of peers has not yet been taken, GetPeer waits for it
+// or until ctx is done.
+func (p *PeerBook) GetPeer(ctx context.Context, key string) (Peer, error) {
+	rv, err := p.snapshot(ctx)
+	if err != nil {
+		return Peer{}, err
 	}
-	member := memberi.(serf.Member)
-	return peerName, member.Addr, member.Tags
+	return rv.peer(rv.Get(key))
+}
+
+// GetPeers returns up to n distinct peers to place replicas of the provided key
+// on, in order of preference. The first peer is the one returned by GetPeer.
+//
+// Fewer than n peers are returned if there are fewer than n alive peers.
+func (p *PeerBook) GetPeers(ctx context.Context, key string, n int) ([]Peer, error) {
+	rv, err := p.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := Replicas(rv.Ring, rv.names, key, n)
+	if len(names) == 0 {
+		return nil, ErrNoPeers
+	}
+	r := make([]Peer, len(names))
+	for i, name := range names {
+		if r[i], err = rv.peer(name); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
 }
 
 // GetPeerObject returns an object associated with the peer owning the provided
 // key. Objects are created from the NewPeerObject function member in the
 // PeerBook.
 //
-// Peer objects are typically used for client connections.
-func (p *PeerBook) GetPeerObject(key string) (interface{}, error) {
-	obj, ok := p.peerObjects.Load(key)
+// Peer objects are cached per peer, so keys owned by the same peer share the
+// same object. Peer objects are typically used for client connections.
+func (p *PeerBook) GetPeerObject(ctx context.Context, key string) (interface{}, error) {
+	peer, err := p.GetPeer(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := p.peerObjects.Load(peer.Name)
 	if ok {
 		return obj, nil
 	}
-	return p.RefreshPeerObject(key)
+	return p.newPeerObject(peer.Name, peer.Addr, peer.Tags)
 }
 
 // RefreshPeerObject returns a new peer object associated with the peer. Any
@@ -314,27 +410,74 @@ func (p *PeerBook) GetPeerObject(key string) (interface{}, error) {
 // RefreshPeerObject should only be used if an older per object returned by
 // GetPeerObject is found to be invalid in some way (e.g. if a client handle has
 // timed out or the connection has produced an error).
-func (p *PeerBook) RefreshPeerObject(key string) (interface{}, error) {
-	p.peerObjects.Delete(key)
+func (p *PeerBook) RefreshPeerObject(ctx context.Context, key string) (interface{}, error) {
+	peer, err := p.GetPeer(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if obj, loaded := p.peerObjects.LoadAndDelete(peer.Name); loaded && p.DestroyPeerObject != nil {
+		p.DestroyPeerObject(peer.Name, obj)
+	}
+	return p.newPeerObject(peer.Name, peer.Addr, peer.Tags)
+}
 
+func (p *PeerBook) newPeerObject(peerName string, addr net.IP, tags map[string]string) (interface{}, error) {
 	if p.NewPeerObject == nil {
 		return nil, nil
 	}
 
 	// Create or use old (in case we lose the race on p.peerObjects)
-	peerName, addr, tags := p.GetPeer(key)
 	newobj, err := p.NewPeerObject(peerName, addr, tags)
 	if err != nil {
 		return nil, err
 	}
-	obj, loaded := p.peerObjects.LoadOrStore(key, newobj)
+	obj, loaded := p.peerObjects.LoadOrStore(peerName, newobj)
 	if loaded && p.DestroyPeerObject != nil {
-		p.DestroyPeerObject(key, newobj)
+		p.DestroyPeerObject(peerName, newobj)
 	}
 	return obj, nil
 }
 
-// PeerCount returns the number of alive peers.
+// Peer describes a peer.
+type Peer struct {
+	Name string
+	Addr net.IP
+	Tags map[string]string
+}
+
+// Peers returns the alive peers, including the local peer.
+func (p *PeerBook) Peers() []Peer {
+	var r []Peer
+	for _, m := range p.serf.Members() {
+		if m.Status == serf.StatusAlive {
+			r = append(r, Peer{Name: m.Name, Addr: m.Addr, Tags: m.Tags})
+		}
+	}
+	return r
+}
+
+// Alive returns true if the local peer is an active member of the group of
+// peers (i.e. it has not left or been shut down).
+func (p *PeerBook) Alive() bool {
+	return p.serf.State() == serf.SerfAlive
+}
+
+// LocalName returns the name of the local peer.
+func (p *PeerBook) LocalName() string {
+	return p.serf.LocalMember().Name
+}
+
+// Ready reports whether the ring assigning keys to peers has been built.
+func (p *PeerBook) Ready() bool {
+	select {
+	case <-p.ringReady:
+		return true
+	default:
+		return false
+	}
+}
+
+// PeerCount returns the number of alive peers, including the local peer.
 func (p *PeerBook) PeerCount() int {
 	n := 0
 	members := p.serf.Members()
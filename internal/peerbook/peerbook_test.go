@@ -7,10 +7,12 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
 	"testing"
 
+	"github.com/dgryski/go-maglev"
 	"github.com/vsekhar/fabula/internal/peerbook"
 )
 
@@ -131,7 +133,7 @@ func TestPeerObject(t *testing.T) {
 	}()
 
 	linkLocalPeers(t, peers)
-	obj, err := peers[0].GetPeerObject("a127")
+	obj, err := peers[0].GetPeerObject(ctx, "a127")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -185,3 +187,96 @@ func TestBroadcast(t *testing.T) {
 		h.wg.Wait()
 	}
 }
+
+var rings = []struct {
+	name string
+	f    peerbook.RingFunc
+}{
+	{"consistenthash", peerbook.ConsistentHashRing(100)},
+	{"maglev", peerbook.MaglevRing(maglev.SmallM)},
+}
+
+func ringNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("peer-%d", i)
+	}
+	return names
+}
+
+func TestKeyMovement(t *testing.T) {
+	const peerCount = 20
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	names := ringNames(peerCount + 1)
+	for _, r := range rings {
+		t.Run(r.name, func(t *testing.T) {
+			before := r.f(names[:peerCount])
+			if got := peerbook.KeyMovement(before, r.f(names[:peerCount]), keys); got != 0 {
+				t.Errorf("rebuilding the same ring moved %f of keys", got)
+			}
+
+			// Ideally 1/(peerCount+1) of keys move to the new peer.
+			joined := peerbook.KeyMovement(before, r.f(names), keys)
+			left := peerbook.KeyMovement(before, r.f(names[1:peerCount]), keys)
+			t.Logf("%s: join moved %.3f, leave moved %.3f of keys (ideal %.3f)", r.name, joined, left, 1.0/peerCount)
+			if max := 2.0 / peerCount; joined > max || left > max {
+				t.Errorf("expected at most %.3f of keys to move, got join: %.3f, leave: %.3f", max, joined, left)
+			}
+		})
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	for _, r := range rings {
+		t.Run(r.name, func(t *testing.T) {
+			for _, peerCount := range []int{1, 2, 3, 20} {
+				names := ringNames(peerCount)
+				sort.Strings(names)
+				ring := r.f(names)
+				for _, k := range keys {
+					reps := peerbook.Replicas(ring, names, k, 3)
+					want := 3
+					if peerCount < want {
+						want = peerCount
+					}
+					if len(reps) != want {
+						t.Fatalf("%d peers: expected %d replicas, got %v", peerCount, want, reps)
+					}
+					if reps[0] != ring.Get(k) {
+						t.Fatalf("expected first replica %s, got %s", ring.Get(k), reps[0])
+					}
+					seen := make(map[string]bool)
+					for _, rep := range reps {
+						if seen[rep] {
+							t.Fatalf("duplicate replica in %v", reps)
+						}
+						seen[rep] = true
+					}
+				}
+			}
+		})
+	}
+	if reps := peerbook.Replicas(peerbook.ConsistentHashRing(100)(nil), nil, "a", 3); len(reps) != 0 {
+		t.Errorf("expected no replicas without peers, got %v", reps)
+	}
+}
+
+func BenchmarkRingBuild(b *testing.B) {
+	for _, r := range rings {
+		for _, n := range []int{10, 100, 1000} {
+			names := ringNames(n)
+			b.Run(fmt.Sprintf("%s/%d_peers", r.name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_ = r.f(names)
+				}
+			})
+		}
+	}
+}
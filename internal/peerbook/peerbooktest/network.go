@@ -0,0 +1,183 @@
+package peerbooktest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+var errUnreachable = errors.New("peerbooktest: address unreachable")
+
+// Network is a simulated network connecting memberlist transports in the same
+// process. Nodes can be partitioned from each other, messages between nodes can
+// be delayed, and nodes can be taken down.
+//
+// A zero Network is not usable; use NewNetwork.
+type Network struct {
+	mu         sync.Mutex
+	transports map[string]*transport // map[addr]
+	group      map[string]int        // map[addr]partition; missing means 0
+	down       map[string]bool       // map[addr]
+	delay      time.Duration
+}
+
+// NewNetwork returns a new Network with no partitions or delay.
+func NewNetwork() *Network {
+	return &Network{
+		transports: make(map[string]*transport),
+		group:      make(map[string]int),
+		down:       make(map[string]bool),
+	}
+}
+
+// Partition splits the network so that nodes can only reach nodes at
+// addresses in the same group. Nodes not in any group can reach each other.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[string]int)
+	for i, g := range groups {
+		for _, addr := range g {
+			n.group[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// SetDelay delays every packet and new connection by d.
+func (n *Network) SetDelay(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.delay = d
+}
+
+// SetDown takes the node at addr down (drops all of its traffic) or brings it
+// back up.
+func (n *Network) SetDown(addr string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[addr] = down
+}
+
+// route returns the destination transport if from can reach to, and the delay
+// to apply.
+func (n *Network) route(from, to string) (*transport, time.Duration, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	dst, ok := n.transports[to]
+	if !ok || n.down[from] || n.down[to] || n.group[from] != n.group[to] {
+		return nil, 0, false
+	}
+	return dst, n.delay, true
+}
+
+// NewTransport returns a memberlist transport for a node at ip:port on n.
+func (n *Network) NewTransport(ip net.IP, port int) memberlist.Transport {
+	t := &transport{
+		net:      n,
+		ip:       ip,
+		port:     port,
+		addr:     net.JoinHostPort(ip.String(), strconv.Itoa(port)),
+		packetCh: make(chan *memberlist.Packet, 1024),
+		streamCh: make(chan net.Conn, 64),
+		shutdown: make(chan struct{}),
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.transports[t.addr] = t
+	return t
+}
+
+// transport implements memberlist.Transport over a Network.
+type transport struct {
+	net      *Network
+	ip       net.IP
+	port     int
+	addr     string
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+
+	shutdownOnce sync.Once
+	shutdown     chan struct{}
+}
+
+func (t *transport) FinalAdvertiseAddr(string, int) (net.IP, int, error) {
+	return t.ip, t.port, nil
+}
+
+func (t *transport) WriteTo(b []byte, addr string) (time.Time, error) {
+	now := time.Now()
+	dst, delay, ok := t.net.route(t.addr, addr)
+	if !ok {
+		// Like UDP, packets to unreachable nodes are silently dropped.
+		return now, nil
+	}
+	p := &memberlist.Packet{
+		Buf:       append([]byte(nil), b...),
+		From:      &net.UDPAddr{IP: t.ip, Port: t.port},
+		Timestamp: now,
+	}
+	deliver := func() {
+		select {
+		case dst.packetCh <- p:
+		case <-dst.shutdown:
+		default:
+			// Receiver is overwhelmed; drop like a full socket buffer.
+		}
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, deliver)
+	} else {
+		deliver()
+	}
+	return now, nil
+}
+
+func (t *transport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+func (t *transport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dst, delay, ok := t.net.route(t.addr, addr)
+	if !ok {
+		return nil, fmt.Errorf("dialing %s: %w", addr, errUnreachable)
+	}
+	if delay > timeout {
+		time.Sleep(timeout)
+		return nil, fmt.Errorf("dialing %s: timeout", addr)
+	}
+	time.Sleep(delay)
+	local, remote := net.Pipe()
+	select {
+	case dst.streamCh <- remote:
+		return local, nil
+	case <-dst.shutdown:
+	case <-time.After(timeout - delay):
+	}
+	local.Close()
+	remote.Close()
+	return nil, fmt.Errorf("dialing %s: %w", addr, errUnreachable)
+}
+
+func (t *transport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+func (t *transport) Shutdown() error {
+	t.shutdownOnce.Do(func() {
+		close(t.shutdown)
+		t.net.mu.Lock()
+		delete(t.net.transports, t.addr)
+		t.net.mu.Unlock()
+	})
+	return nil
+}
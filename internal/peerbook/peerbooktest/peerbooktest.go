@@ -0,0 +1,461 @@
+// Package peerbooktest runs groups of PeerBooks in a single process over a
+// simulated network, so that tests can partition, delay, kill and add peers and
+// check that the group converges.
+//
+// Nodes can also lease prefixes the way servers do (see package prefixlease):
+// each node claims a lease on the prefixes it owns according to its ring,
+// renews it while it still owns them, and releases it once it does not, so
+// tests can check that handoffs leave one owner per prefix.
+package peerbooktest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"github.com/vsekhar/fabula/internal/peerbook"
+	"github.com/vsekhar/fabula/internal/prefixlease"
+)
+
+// ControlPort is the control port of every simulated peer. Peers are
+// distinguished by IP address.
+const ControlPort = 7946
+
+// Number of keys checked to decide whether peers agree on ownership.
+const convergenceKeys = 100
+
+const pollPeriod = 20 * time.Millisecond
+
+// LeaseBroadcast is the name of the broadcasts carrying leases between nodes.
+const LeaseBroadcast = "peerbooktest.lease"
+
+// Leases held by nodes last LeaseDuration and are renewed every
+// leaseRenewPeriod. They are held on prefixes in leaseRegion.
+const (
+	LeaseDuration    = 3 * time.Second
+	leaseRenewPeriod = 300 * time.Millisecond
+	leaseRegion      = "test"
+)
+
+// Node is a peer in a Cluster.
+type Node struct {
+	Name string
+	Addr string // host:port
+	Book *peerbook.PeerBook
+
+	// Leases holds the latest lease on each prefix known to the node.
+	Leases *prefixlease.Table
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	alive    bool
+	received map[string][][]byte // map[broadcast name]payloads
+}
+
+func (n *Node) handleBroadcast(_ peerbook.LamportTime, name string, payload []byte, _ bool) {
+	if name == LeaseBroadcast {
+		if l, err := prefixlease.Parse(string(payload)); err == nil {
+			n.Leases.Observe(l)
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.received[name] = append(n.received[name], append([]byte(nil), payload...))
+}
+
+// Received returns the payloads of broadcasts named name received by n.
+func (n *Node) Received(name string) [][]byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([][]byte(nil), n.received[name]...)
+}
+
+func (n *Node) broadcastLease(l prefixlease.Lease) {
+	// Errors are ignored: the lease is broadcast again when renewed, and a
+	// node shutting down cannot broadcast.
+	n.Book.Broadcast(LeaseBroadcast, []byte(l.String()), false)
+}
+
+// updateLease claims or renews n's lease on prefix if n owns prefix according
+// to its ring, and releases it otherwise.
+func (n *Node) updateLease(prefix string) {
+	owner, err := n.Book.GetPeer(n.ctx, prefix)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if owner.Name != n.Name {
+		if l, ok := n.Leases.Release(leaseRegion, prefix, n.Name, now); ok {
+			n.broadcastLease(l)
+		}
+		return
+	}
+	// Claims fail while another node holds the lease, and are retried when
+	// it is released or expires.
+	if l, err := n.Leases.Claim(leaseRegion, prefix, n.Name, now, LeaseDuration); err == nil {
+		n.broadcastLease(l)
+	}
+}
+
+// maintainLeases updates n's leases on prefixes until n is shut down.
+func (n *Node) maintainLeases(prefixes []string) {
+	t := time.NewTicker(leaseRenewPeriod)
+	defer t.Stop()
+	for {
+		for _, p := range prefixes {
+			n.updateLease(p)
+		}
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Holds returns true if n holds a lease on prefix according to its own lease
+// table.
+func (n *Node) Holds(prefix string) bool {
+	return n.Leases.Held(leaseRegion, prefix, n.Name, time.Now())
+}
+
+// Alive returns true if n has not been killed or stopped.
+func (n *Node) Alive() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.alive
+}
+
+// Cluster is a group of PeerBooks connected by a simulated Network.
+type Cluster struct {
+	t    testing.TB
+	Net  *Network
+	opts []peerbook.Option
+
+	mu       sync.Mutex
+	nodes    []*Node
+	prefixes []string // leased by nodes
+}
+
+// New returns a Cluster of n joined peers created with opts. The Cluster is
+// shut down when the test completes.
+func New(t testing.TB, n int, opts ...peerbook.Option) *Cluster {
+	t.Helper()
+	c := &Cluster{t: t, Net: NewNetwork(), opts: opts}
+	t.Cleanup(c.Close)
+	for i := 0; i < n; i++ {
+		c.Add()
+	}
+	return c
+}
+
+// fastConfig returns memberlist and Serf timings suited to a simulated network
+// so that tests converge quickly.
+func fastConfig(t memberlist.Transport, ip net.IP) func(*serf.Config) {
+	return func(c *serf.Config) {
+		ml := memberlist.DefaultLocalConfig()
+		ml.Logger = c.MemberlistConfig.Logger
+		ml.Transport = t
+		ml.AdvertiseAddr = ip.String()
+		ml.AdvertisePort = ControlPort
+		ml.BindPort = ControlPort
+		ml.ProbeInterval = 50 * time.Millisecond
+		ml.ProbeTimeout = 25 * time.Millisecond
+		ml.GossipInterval = 10 * time.Millisecond
+		ml.PushPullInterval = 500 * time.Millisecond
+		ml.TCPTimeout = 200 * time.Millisecond
+		ml.SuspicionMult = 2
+		c.MemberlistConfig = ml
+
+		c.ReapInterval = 500 * time.Millisecond
+		c.ReconnectInterval = 100 * time.Millisecond
+		c.ReconnectTimeout = 5 * time.Second
+		c.TombstoneTimeout = 5 * time.Second
+		c.BroadcastTimeout = 200 * time.Millisecond
+		c.LeavePropagateDelay = 0
+	}
+}
+
+// Add creates a new peer and joins it to the cluster.
+func (c *Cluster) Add() *Node {
+	c.t.Helper()
+	c.mu.Lock()
+	i := len(c.nodes)
+	c.mu.Unlock()
+
+	ip := net.IPv4(10, 0, byte((i+1)>>8), byte(i+1))
+	tr := c.Net.NewTransport(ip, ControlPort)
+	ctx, cancel := context.WithCancel(context.Background())
+	name := fmt.Sprintf("node-%d", i)
+	opts := append([]peerbook.Option{peerbook.WithSerfConfig(fastConfig(tr, ip))}, c.opts...)
+	book, err := peerbook.New(ctx, name, ControlPort, nil, opts...)
+	if err != nil {
+		cancel()
+		c.t.Fatal(err)
+	}
+	n := &Node{
+		Name:     name,
+		Addr:     net.JoinHostPort(ip.String(), strconv.Itoa(ControlPort)),
+		Book:     book,
+		Leases:   prefixlease.NewTable(time.Now()),
+		ctx:      ctx,
+		cancel:   cancel,
+		alive:    true,
+		received: make(map[string][][]byte),
+	}
+	book.BroadcastHandler = n.handleBroadcast
+
+	var seeds []string
+	for _, other := range c.Alive() {
+		seeds = append(seeds, other.Addr)
+	}
+	c.mu.Lock()
+	c.nodes = append(c.nodes, n)
+	prefixes := c.prefixes
+	c.mu.Unlock()
+	if len(seeds) > 0 {
+		if _, err := book.Join(seeds); err != nil {
+			c.t.Fatalf("joining %s: %s", name, err)
+		}
+	}
+	if len(prefixes) > 0 {
+		go n.maintainLeases(prefixes)
+	}
+	return n
+}
+
+// LeasePrefixes starts all alive nodes, and nodes added later, leasing
+// prefixes. It must be called at most once.
+func (c *Cluster) LeasePrefixes(prefixes ...string) {
+	c.mu.Lock()
+	c.prefixes = prefixes
+	c.mu.Unlock()
+	for _, n := range c.Alive() {
+		go n.maintainLeases(prefixes)
+	}
+}
+
+// Node returns the i'th node added to the cluster.
+func (c *Cluster) Node(i int) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodes[i]
+}
+
+// Alive returns the nodes that have not been killed or stopped.
+func (c *Cluster) Alive() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var r []*Node
+	for _, n := range c.nodes {
+		if n.Alive() {
+			r = append(r, n)
+		}
+	}
+	return r
+}
+
+func (c *Cluster) nodesAt(is []int) []*Node {
+	if len(is) == 0 {
+		return c.Alive()
+	}
+	r := make([]*Node, len(is))
+	for j, i := range is {
+		r[j] = c.Node(i)
+	}
+	return r
+}
+
+func (n *Node) shutdown() {
+	n.mu.Lock()
+	n.alive = false
+	n.mu.Unlock()
+	n.cancel()
+}
+
+// Kill crashes node i: its traffic is dropped so it cannot tell peers it is
+// leaving.
+func (c *Cluster) Kill(i int) {
+	n := c.Node(i)
+	c.Net.SetDown(n.Addr, true)
+	n.shutdown()
+}
+
+// Stop gracefully shuts down node i, which tells its peers it is leaving.
+func (c *Cluster) Stop(i int) {
+	n := c.Node(i)
+	n.shutdown()
+	n.Book.WaitForShutdown()
+}
+
+// Partition splits the cluster so that nodes can only reach nodes in the same
+// group. Groups are lists of node indexes.
+func (c *Cluster) Partition(groups ...[]int) {
+	addrs := make([][]string, len(groups))
+	for i, g := range groups {
+		for _, n := range c.nodesAt(g) {
+			addrs[i] = append(addrs[i], n.Addr)
+		}
+	}
+	c.Net.Partition(addrs...)
+}
+
+// Heal removes all partitions.
+func (c *Cluster) Heal() {
+	c.Net.Heal()
+}
+
+// SetDelay delays all traffic between nodes by d.
+func (c *Cluster) SetDelay(d time.Duration) {
+	c.Net.SetDelay(d)
+}
+
+// Close shuts down all nodes and waits for them to exit.
+func (c *Cluster) Close() {
+	c.mu.Lock()
+	nodes := append([]*Node(nil), c.nodes...)
+	c.mu.Unlock()
+	for _, n := range nodes {
+		n.shutdown()
+	}
+	for _, n := range nodes {
+		n.Book.WaitForShutdown()
+	}
+}
+
+// Converged returns nil if the nodes at indexes is (or all alive nodes if is
+// is empty) see exactly each other as peers and agree on which of them owns
+// each key.
+func (c *Cluster) Converged(ctx context.Context, is ...int) error {
+	nodes := c.nodesAt(is)
+	want := make([]string, len(nodes))
+	for i, n := range nodes {
+		want[i] = n.Name
+	}
+	sort.Strings(want)
+	for _, n := range nodes {
+		var got []string
+		for _, p := range n.Book.Peers() {
+			got = append(got, p.Name)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("%s sees peers %v, expected %v", n.Name, got, want)
+		}
+	}
+	for k := 0; k < convergenceKeys; k++ {
+		key := fmt.Sprintf("key-%d", k)
+		var owner string
+		for i, n := range nodes {
+			p, err := n.Book.GetPeer(ctx, key)
+			if err != nil {
+				return fmt.Errorf("%s: looking up %s: %w", n.Name, key, err)
+			}
+			if i > 0 && p.Name != owner {
+				return fmt.Errorf("%s owned by %s according to %s, but %s according to %s", key, owner, nodes[0].Name, p.Name, n.Name)
+			}
+			owner = p.Name
+		}
+	}
+	return nil
+}
+
+// Leased returns nil if, among the nodes at indexes is (or all alive nodes if
+// is is empty), exactly one node holds a lease on each prefix, it is the owner
+// of the prefix according to the ring, and all nodes know of its lease.
+func (c *Cluster) Leased(ctx context.Context, prefixes []string, is ...int) error {
+	nodes := c.nodesAt(is)
+	for _, p := range prefixes {
+		owner, err := nodes[0].Book.GetPeer(ctx, p)
+		if err != nil {
+			return fmt.Errorf("%s: looking up %s: %w", nodes[0].Name, p, err)
+		}
+		var holders []string
+		for _, n := range nodes {
+			if n.Holds(p) {
+				holders = append(holders, n.Name)
+			}
+			if l, _ := n.Leases.Get(leaseRegion, p); l.Owner != owner.Name {
+				return fmt.Errorf("%s sees %s leased to '%s', expected %s", n.Name, p, l.Owner, owner.Name)
+			}
+		}
+		if len(holders) != 1 || holders[0] != owner.Name {
+			return fmt.Errorf("%s held by %v, expected %s", p, holders, owner.Name)
+		}
+	}
+	return nil
+}
+
+// Delivered returns nil if the nodes at indexes is (or all alive nodes if is
+// is empty) have received a broadcast named name with payload.
+func (c *Cluster) Delivered(name string, payload []byte, is ...int) error {
+	for _, n := range c.nodesAt(is) {
+		found := false
+		for _, p := range n.Received(name) {
+			if bytes.Equal(p, payload) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s has not received broadcast %s", n.Name, name)
+		}
+	}
+	return nil
+}
+
+// waitFor polls f until it returns nil or timeout elapses, in which case the
+// test fails with the last error.
+func (c *Cluster) waitFor(timeout time.Duration, f func(context.Context) error) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	for {
+		if err = f(ctx); err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			c.t.Fatalf("not converged after %s: %s", timeout, err)
+		case <-time.After(pollPeriod):
+		}
+	}
+}
+
+// AssertConverged fails the test unless the nodes at indexes is (or all alive
+// nodes) converge within timeout. See Converged.
+func (c *Cluster) AssertConverged(timeout time.Duration, is ...int) {
+	c.t.Helper()
+	c.waitFor(timeout, func(ctx context.Context) error {
+		return c.Converged(ctx, is...)
+	})
+}
+
+// AssertLeased fails the test unless the leases on prefixes held by the nodes
+// at indexes is (or all alive nodes) settle within timeout. See Leased.
+func (c *Cluster) AssertLeased(timeout time.Duration, prefixes []string, is ...int) {
+	c.t.Helper()
+	c.waitFor(timeout, func(ctx context.Context) error {
+		return c.Leased(ctx, prefixes, is...)
+	})
+}
+
+// AssertDelivered fails the test unless the nodes at indexes is (or all alive
+// nodes) receive a broadcast named name with payload within timeout.
+func (c *Cluster) AssertDelivered(timeout time.Duration, name string, payload []byte, is ...int) {
+	c.t.Helper()
+	c.waitFor(timeout, func(context.Context) error {
+		return c.Delivered(name, payload, is...)
+	})
+}
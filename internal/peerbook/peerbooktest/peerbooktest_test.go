@@ -0,0 +1,101 @@
+package peerbooktest_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/peerbook/peerbooktest"
+)
+
+const timeout = 10 * time.Second
+
+func TestConverge(t *testing.T) {
+	c := peerbooktest.New(t, 5)
+	c.AssertConverged(timeout)
+}
+
+func TestPartition(t *testing.T) {
+	c := peerbooktest.New(t, 5)
+	c.AssertConverged(timeout)
+
+	// Each side of a partition converges on its own ring.
+	c.Partition([]int{0, 1, 2}, []int{3, 4})
+	c.AssertConverged(timeout, 0, 1, 2)
+	c.AssertConverged(timeout, 3, 4)
+
+	c.Heal()
+	c.AssertConverged(timeout)
+}
+
+func TestChurn(t *testing.T) {
+	c := peerbooktest.New(t, 4)
+	c.AssertConverged(timeout)
+
+	c.Kill(1)
+	c.AssertConverged(timeout)
+
+	c.Add()
+	c.Add()
+	c.AssertConverged(timeout)
+	if n := len(c.Alive()); n != 5 {
+		t.Errorf("expected 5 alive nodes, got %d", n)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	c := peerbooktest.New(t, 5)
+	c.AssertConverged(timeout)
+	c.SetDelay(20 * time.Millisecond)
+
+	payload := []byte("payload")
+	if err := c.Node(0).Book.Broadcast("peerbooktest", payload, false); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertDelivered(timeout, "peerbooktest", payload)
+}
+
+func TestStop(t *testing.T) {
+	c := peerbooktest.New(t, 3)
+	c.AssertConverged(timeout)
+	c.Stop(2)
+	c.AssertConverged(timeout)
+}
+
+func TestLeaseHandoff(t *testing.T) {
+	c := peerbooktest.New(t, 5)
+	c.AssertConverged(timeout)
+	var prefixes []string
+	for i := 0; i < 20; i++ {
+		prefixes = append(prefixes, fmt.Sprintf("p-%d", i))
+	}
+	c.LeasePrefixes(prefixes...)
+	// Nodes wait a lease duration for existing leases before claiming.
+	c.AssertLeased(timeout+peerbooktest.LeaseDuration, prefixes)
+
+	// Each side of a partition takes over the prefixes owned by the other
+	// side, but must wait for the other side's leases to expire.
+	c.Partition([]int{0, 1, 2}, []int{3, 4})
+	c.AssertConverged(timeout, 0, 1, 2)
+	c.AssertConverged(timeout, 3, 4)
+	waiting := 0
+	for _, p := range prefixes {
+		if !c.Node(3).Holds(p) && !c.Node(4).Holds(p) {
+			waiting++
+		}
+	}
+	if waiting == 0 {
+		t.Fatal("expected handoffs in progress when healing")
+	}
+
+	// Heal while handoffs are in progress. Each prefix ends up with one
+	// owner, which keeps its lease.
+	c.Heal()
+	c.AssertConverged(timeout)
+	c.AssertLeased(timeout, prefixes)
+	time.Sleep(2 * peerbooktest.LeaseDuration)
+	if err := c.Leased(context.Background(), prefixes); err != nil {
+		t.Error(err)
+	}
+}
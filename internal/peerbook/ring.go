@@ -0,0 +1,150 @@
+package peerbook
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/dgryski/go-maglev"
+	"github.com/golang/groupcache/consistenthash"
+)
+
+// Ring assigns keys to peers.
+//
+// Peers build their rings independently, so a Ring must assign keys the same
+// way given the same set of peer names.
+type Ring interface {
+	// Get returns the name of the peer owning key, or "" if there are no
+	// peers.
+	Get(key string) string
+}
+
+// RingFunc builds a Ring over the peers named in names. Names are provided in
+// sorted order.
+type RingFunc func(names []string) Ring
+
+// ConsistentHashRing returns a RingFunc building consistent hash rings with
+// the provided number of virtual nodes per peer.
+//
+// Building a consistent hash ring is proportional to the number of virtual
+// nodes, which can be slow with many peers. Lookups are O(log(virtual nodes)).
+func ConsistentHashRing(virtualNodes int) RingFunc {
+	return func(names []string) Ring {
+		// package consistenthash refers to virtual nodes as "replicas" which
+		// isn't really accurate since there is no replication involved.
+		m := consistenthash.New(virtualNodes /* "replicas" */, nil)
+		m.Add(names...)
+		return m
+	}
+}
+
+// MaglevRing returns a RingFunc building Maglev lookup tables of size m, which
+// must be prime and much larger than the number of peers (e.g. maglev.SmallM
+// or maglev.BigM).
+//
+// Building a Maglev table is roughly proportional to m regardless of the number
+// of peers, and lookups are O(1). Maglev moves slightly more keys than
+// consistent hashing when membership changes.
+//
+// See: https://research.google/pubs/pub44824/
+func MaglevRing(m uint64) RingFunc {
+	return func(names []string) Ring {
+		if len(names) == 0 {
+			return emptyRing{}
+		}
+		return &maglevRing{names: names, table: maglev.New(names, m)}
+	}
+}
+
+type maglevRing struct {
+	names []string
+	table *maglev.Table
+}
+
+func (r *maglevRing) Get(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return r.names[r.table.Lookup(h.Sum64())]
+}
+
+type emptyRing struct{}
+
+func (emptyRing) Get(string) string { return "" }
+
+// ringValue is a snapshot of the ring and the members it was built from. It
+// also wraps a Ring so that rings of different concrete types can be stored in
+// the same atomic.Value.
+type ringValue struct {
+	Ring
+	names   []string // sorted
+	members map[string]Peer
+}
+
+func buildRing(f RingFunc, names []string) Ring {
+	ns := make([]string, len(names))
+	copy(ns, names)
+	sort.Strings(ns)
+	return f(ns)
+}
+
+// Number of probes per replica when looking for distinct replicas before
+// falling back to the order of peer names.
+const replicaProbes = 8
+
+// Replicas returns the names of up to n distinct peers to place key on, in
+// order of preference. The first is the peer owning key according to r. names
+// must be the sorted names of the peers r was built over.
+//
+// Like Get, Replicas assigns keys the same way given the same set of peer
+// names. Subsequent replicas are found by looking up derived keys in r, so
+// they are spread across peers roughly as evenly as owners are.
+func Replicas(r Ring, names []string, key string, n int) []string {
+	if n > len(names) {
+		n = len(names)
+	}
+	if n <= 0 {
+		return nil
+	}
+	res := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	add := func(name string) {
+		if _, ok := seen[name]; ok || name == "" {
+			return
+		}
+		seen[name] = struct{}{}
+		res = append(res, name)
+	}
+	add(r.Get(key))
+	for i := 1; len(res) < n && i < n*replicaProbes; i++ {
+		add(r.Get(key + "#" + strconv.Itoa(i)))
+	}
+
+	// Unlucky or very few peers: take the peers following the owner in
+	// name order.
+	if len(res) < n {
+		start := 0
+		if len(res) > 0 {
+			start = sort.SearchStrings(names, res[0])
+		}
+		for i := 0; len(res) < n && i < len(names); i++ {
+			add(names[(start+i)%len(names)])
+		}
+	}
+	return res
+}
+
+// KeyMovement returns the fraction of keys assigned to a different peer by a
+// and b. It can be used to compare how much a Ring disrupts key assignment when
+// peers join or leave.
+func KeyMovement(a, b Ring, keys []string) float64 {
+	if len(keys) == 0 {
+		return 0
+	}
+	moved := 0
+	for _, k := range keys {
+		if a.Get(k) != b.Get(k) {
+			moved++
+		}
+	}
+	return float64(moved) / float64(len(keys))
+}
@@ -0,0 +1,200 @@
+// Package prefixlease tracks which server owns each prefix chain.
+//
+// Servers are assigned prefixes by a hash ring, but servers may briefly
+// disagree about the ring while membership changes. To avoid two servers
+// packing the same prefix chain, a server only packs a prefix while it holds a
+// lease on it.
+//
+// Leases are broadcast to all servers and are ordered by epoch. A server
+// claiming a prefix uses the next epoch after the latest lease it knows of,
+// and must wait for any unexpired lease held by another server to expire or be
+// released. If two servers claim the same epoch concurrently, the claim by the
+// server whose name sorts first wins. A lease is renewed by broadcasting it
+// with a later expiry, and released by broadcasting the next epoch with no
+// owner, so that renewals arriving late cannot revive it.
+//
+// A server that has just started has not yet observed the leases of other
+// servers. Its Table refuses claims on prefixes with no known lease until a
+// lease duration after it started, by which time any valid lease has been
+// renewed and broadcast.
+//
+// A lease is encoded as:
+//
+//	<region>:<prefix>:<epoch>:<owner>:<expiry timestamp>
+package prefixlease
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/fabula/pkg/timestamp"
+)
+
+const separator = ":"
+
+// ErrLeased is returned when claiming a prefix leased to another server.
+var ErrLeased = errors.New("prefixlease: prefix leased to another server")
+
+// ErrNotSynced is returned when claiming a prefix before the leases of other
+// servers could have been observed.
+var ErrNotSynced = errors.New("prefixlease: leases not yet observed")
+
+// Lease is a lease on a prefix chain in a region.
+type Lease struct {
+	Region  string
+	Prefix  string
+	Epoch   uint64
+	Owner   string // empty if the lease has been released
+	Expires time.Time
+}
+
+func (l Lease) String() string {
+	return strings.Join([]string{
+		l.Region,
+		l.Prefix,
+		strconv.FormatUint(l.Epoch, 10),
+		l.Owner,
+		timestamp.ToString(l.Expires),
+	}, separator)
+}
+
+// Parse parses a lease produced by Lease.String.
+func Parse(s string) (Lease, error) {
+	parts := strings.Split(s, separator)
+	if len(parts) != 5 {
+		return Lease{}, fmt.Errorf("prefixlease: expected 5 fields in lease, got %d", len(parts))
+	}
+	epoch, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return Lease{}, fmt.Errorf("prefixlease: bad epoch: %w", err)
+	}
+	exp, err := timestamp.FromString(parts[4])
+	if err != nil {
+		return Lease{}, fmt.Errorf("prefixlease: bad expiry: %w", err)
+	}
+	return Lease{
+		Region:  parts[0],
+		Prefix:  parts[1],
+		Epoch:   epoch,
+		Owner:   parts[3],
+		Expires: exp,
+	}, nil
+}
+
+// Valid returns true if l is held and has not expired at now.
+func (l Lease) Valid(now time.Time) bool {
+	return l.Owner != "" && now.Before(l.Expires)
+}
+
+// supersedes returns true if l should replace cur.
+func (l Lease) supersedes(cur Lease) bool {
+	switch {
+	case l.Epoch != cur.Epoch:
+		return l.Epoch > cur.Epoch
+	case l.Owner != cur.Owner:
+		return l.Owner < cur.Owner
+	}
+	// Renewal by the same owner. Renewals may arrive out of order.
+	return l.Expires.After(cur.Expires)
+}
+
+// Table holds the latest known lease on each prefix.
+//
+// It is safe to use a Table from multiple goroutines.
+type Table struct {
+	mu     sync.Mutex
+	start  time.Time
+	leases map[string]Lease // map[region:prefix]Lease
+}
+
+// NewTable returns a new empty Table that begins observing leases at start.
+func NewTable(start time.Time) *Table {
+	return &Table{start: start, leases: make(map[string]Lease)}
+}
+
+func key(region, prefix string) string {
+	return region + separator + prefix
+}
+
+// Observe records a lease broadcast by a server. Observe returns true if l
+// replaced the lease held for its prefix.
+func (t *Table) Observe(l Lease) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key(l.Region, l.Prefix)
+	if cur, ok := t.leases[k]; ok && !l.supersedes(cur) {
+		return false
+	}
+	t.leases[k] = l
+	return true
+}
+
+// Get returns the latest known lease on prefix in region.
+func (t *Table) Get(region, prefix string) (Lease, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.leases[key(region, prefix)]
+	return l, ok
+}
+
+// Held returns true if owner holds a valid lease on prefix in region at now.
+func (t *Table) Held(region, prefix, owner string, now time.Time) bool {
+	l, ok := t.Get(region, prefix)
+	return ok && l.Owner == owner && l.Valid(now)
+}
+
+// Claim claims or renews a lease on prefix in region for owner until now+d,
+// where d is the lease duration used by all servers. The returned lease should
+// be broadcast to other servers.
+//
+// Claim returns ErrLeased if another server holds a valid lease on prefix, and
+// ErrNotSynced if no lease on prefix is known and less than d has passed since
+// t started observing leases.
+func (t *Table) Claim(region, prefix, owner string, now time.Time, d time.Duration) (Lease, error) {
+	if owner == "" {
+		return Lease{}, errors.New("prefixlease: empty owner")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key(region, prefix)
+	cur, ok := t.leases[k]
+	l := Lease{Region: region, Prefix: prefix, Owner: owner, Expires: now.Add(d)}
+	switch {
+	case !ok && now.Before(t.start.Add(d)):
+		return Lease{}, ErrNotSynced
+	case !ok:
+		l.Epoch = 1
+	case cur.Owner == owner && cur.Valid(now):
+		if !l.Expires.After(cur.Expires) {
+			return cur, nil
+		}
+		l.Epoch = cur.Epoch // renew
+	case cur.Valid(now):
+		return Lease{}, ErrLeased
+	default:
+		l.Epoch = cur.Epoch + 1
+	}
+	t.leases[k] = l
+	return l, nil
+}
+
+// Release releases owner's lease on prefix in region so another server can
+// claim it without waiting for it to expire. The returned lease should be
+// broadcast to other servers. Release returns false if owner does not hold the
+// lease.
+func (t *Table) Release(region, prefix, owner string, now time.Time) (Lease, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key(region, prefix)
+	cur, ok := t.leases[k]
+	if !ok || cur.Owner != owner || !cur.Valid(now) {
+		return Lease{}, false
+	}
+	rel := Lease{Region: region, Prefix: prefix, Epoch: cur.Epoch + 1, Expires: now}
+	t.leases[k] = rel
+	return rel, true
+}
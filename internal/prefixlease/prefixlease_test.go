@@ -0,0 +1,176 @@
+package prefixlease_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vsekhar/fabula/internal/prefixlease"
+)
+
+var now = time.Unix(1608000000, 0)
+
+const d = 10 * time.Second
+
+func TestRoundTrip(t *testing.T) {
+	l := prefixlease.Lease{Region: "NA", Prefix: "a1", Epoch: 7, Owner: "server-1", Expires: now}
+	got, err := prefixlease.Parse(l.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != l.String() {
+		t.Errorf("expected %s, got %s", l, got)
+	}
+	if _, err := prefixlease.Parse("NA:a1:x:server-1:0"); err == nil {
+		t.Error("expected error parsing bad epoch")
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	a := prefixlease.NewTable(now.Add(-d)) // old owner
+	b := prefixlease.NewTable(now.Add(-d)) // new owner
+
+	la, err := a.Claim("NA", "a1", "a", now, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Observe(la)
+
+	// b cannot claim while a holds the lease.
+	if _, err := b.Claim("NA", "a1", "b", now.Add(time.Second), d); !errors.Is(err, prefixlease.ErrLeased) {
+		t.Fatalf("expected ErrLeased, got %v", err)
+	}
+
+	// a drains and releases.
+	rel, ok := a.Release("NA", "a1", "a", now.Add(2*time.Second))
+	if !ok {
+		t.Fatal("expected release to succeed")
+	}
+	if !b.Observe(rel) {
+		t.Fatal("expected release to be observed")
+	}
+	lb, err := b.Claim("NA", "a1", "b", now.Add(2*time.Second), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.Epoch != rel.Epoch+1 {
+		t.Errorf("expected epoch %d, got %d", rel.Epoch+1, lb.Epoch)
+	}
+	if !a.Observe(lb) || a.Held("NA", "a1", "a", now.Add(3*time.Second)) {
+		t.Error("expected a to observe b's lease")
+	}
+	if !b.Held("NA", "a1", "b", now.Add(3*time.Second)) {
+		t.Error("expected b to hold lease")
+	}
+
+	// Stale leases are ignored.
+	if b.Observe(la) {
+		t.Error("expected stale lease to be ignored")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	tbl := prefixlease.NewTable(now.Add(-d))
+	l, err := tbl.Claim("NA", "a1", "a", now, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Renewal keeps the epoch.
+	r, err := tbl.Claim("NA", "a1", "a", now.Add(d/2), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Epoch != l.Epoch || !r.Expires.After(l.Expires) {
+		t.Errorf("expected renewal of %s, got %s", l, r)
+	}
+	// Another server can claim after expiry.
+	l2, err := tbl.Claim("NA", "a1", "b", r.Expires, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l2.Epoch != l.Epoch+1 {
+		t.Errorf("expected epoch %d, got %d", l.Epoch+1, l2.Epoch)
+	}
+}
+
+func TestConcurrentClaims(t *testing.T) {
+	a := prefixlease.Lease{Region: "NA", Prefix: "a1", Epoch: 2, Owner: "a", Expires: now.Add(d)}
+	b := prefixlease.Lease{Region: "NA", Prefix: "a1", Epoch: 2, Owner: "b", Expires: now.Add(d)}
+
+	// All servers converge on the same winner regardless of order.
+	for _, order := range [][]prefixlease.Lease{{a, b}, {b, a}} {
+		tbl := prefixlease.NewTable(now.Add(-d))
+		for _, l := range order {
+			tbl.Observe(l)
+		}
+		if got, _ := tbl.Get("NA", "a1"); got.Owner != "a" {
+			t.Errorf("expected a to win, got %s", got.Owner)
+		}
+	}
+}
+
+func TestLateRenewal(t *testing.T) {
+	a := prefixlease.NewTable(now.Add(-d))
+	b := prefixlease.NewTable(now.Add(-d))
+	l1, err := a.Claim("NA", "a1", "a", now, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := a.Claim("NA", "a1", "a", now.Add(time.Second), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewals received out of order do not move the expiry backwards.
+	if !b.Observe(l2) || b.Observe(l1) {
+		t.Fatal("expected earlier renewal to be ignored")
+	}
+	if got, _ := b.Get("NA", "a1"); !got.Expires.Equal(l2.Expires) {
+		t.Errorf("expected expiry %s, got %s", l2.Expires, got.Expires)
+	}
+
+	// Renewals received after a release do not revive the lease.
+	rel, ok := a.Release("NA", "a1", "a", now.Add(2*time.Second))
+	if !ok {
+		t.Fatal("expected release to succeed")
+	}
+	if !b.Observe(rel) || b.Observe(l2) {
+		t.Fatal("expected renewal after release to be ignored")
+	}
+	if b.Held("NA", "a1", "a", now.Add(2*time.Second)) {
+		t.Error("expected released lease not to be held")
+	}
+	if a.Held("NA", "a1", "a", now.Add(2*time.Second)) {
+		t.Error("expected released lease not to be held by releasing server")
+	}
+}
+
+func TestNotSynced(t *testing.T) {
+	old := prefixlease.NewTable(now.Add(-d))
+	if _, err := old.Claim("NA", "a1", "old", now, d); err != nil {
+		t.Fatal(err)
+	}
+
+	// A server that just started refuses to claim a prefix before it could
+	// have observed the leases of other servers.
+	started := now.Add(time.Second)
+	tbl := prefixlease.NewTable(started)
+	if _, err := tbl.Claim("NA", "a1", "new", started, d); !errors.Is(err, prefixlease.ErrNotSynced) {
+		t.Fatalf("expected ErrNotSynced, got %v", err)
+	}
+
+	// The old owner's renewal arrives and is respected.
+	r, err := old.Claim("NA", "a1", "old", now.Add(d/2), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Observe(r)
+	if _, err := tbl.Claim("NA", "a1", "new", started.Add(d), d); !errors.Is(err, prefixlease.ErrLeased) {
+		t.Fatalf("expected ErrLeased, got %v", err)
+	}
+
+	// Prefixes with no lease can be claimed once synchronized.
+	if _, err := tbl.Claim("NA", "b2", "new", started.Add(d), d); err != nil {
+		t.Fatal(err)
+	}
+}
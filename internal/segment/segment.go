@@ -0,0 +1,288 @@
+// Package segment compacts consecutive packs of a prefix chain into larger
+// segment objects.
+//
+// Writing an object takes hundreds of milliseconds regardless of its size, so
+// packs are small objects written frequently. Over time, a prefix chain would
+// accumulate an unbounded number of them. Compact composes a run of packs into
+// a single segment object, writes an index recording where each pack lies
+// within the segment, and then deletes the packs. Readers that do not find a
+// pack look it up in the index of the segment containing it.
+//
+// The checksum of a segment is computed from the checksums of its packs using
+// crc32combine, and each pack read from a segment is verified against the
+// checksum it had as a pack. Compact can be safely retried after a failure.
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/vsekhar/fabula/internal/atomicwriter"
+	"github.com/vsekhar/fabula/internal/crc32combine"
+	"google.golang.org/api/iterator"
+)
+
+// MaxCompose is the maximum number of objects composed at once. Cloud Storage
+// allows up to 32. Segments with more packs are composed in two levels.
+const MaxCompose = 32
+
+// MaxPacks is the maximum number of packs in a segment.
+const MaxPacks = MaxCompose * MaxCompose
+
+// ErrMismatch is returned if a segment or index left by an earlier attempt to
+// compact does not match the packs being compacted.
+var ErrMismatch = errors.New("segment: existing segment does not match packs")
+
+// Pack is the location of a pack within a segment.
+type Pack struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	CRC32C uint32 `json:"crc32c"`
+}
+
+// Index describes the packs in a segment.
+type Index struct {
+	Segment string `json:"segment"`
+	Size    int64  `json:"size"`
+	CRC32C  uint32 `json:"crc32c"`
+	Packs   []Pack `json:"packs"`
+}
+
+// IndexName returns the name of the index of segment.
+func IndexName(segment string) string {
+	return segment + ".index"
+}
+
+// Find returns the location of the pack named name.
+func (ix *Index) Find(name string) (Pack, bool) {
+	for _, p := range ix.Packs {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Pack{}, false
+}
+
+// newIndex returns the index of a segment composed of packs.
+func newIndex(segment string, packs []atomicwriter.Attrs) *Index {
+	ix := &Index{Segment: segment, Packs: make([]Pack, len(packs))}
+	for i, p := range packs {
+		ix.Packs[i] = Pack{
+			Name:   p.Name,
+			Offset: ix.Size,
+			Size:   p.Size,
+			CRC32C: p.CRC32C,
+		}
+		if i == 0 {
+			ix.CRC32C = p.CRC32C
+		} else {
+			ix.CRC32C = crc32combine.Combine(ix.CRC32C, p.CRC32C, int(p.Size), crc32.Castagnoli)
+		}
+		ix.Size += p.Size
+	}
+	return ix
+}
+
+// Compact composes packs, which must be consecutive packs of a prefix chain in
+// order, into a segment named segment, writes its index and deletes the
+// packs.
+//
+// If an earlier call to Compact failed, Compact resumes where it left off. If
+// segment has already been indexed, Compact only deletes packs, which must be
+// in the index.
+func Compact(ctx context.Context, d atomicwriter.DriverInterface, segment string, packs []atomicwriter.Attrs) (*Index, error) {
+	if len(packs) == 0 || len(packs) > MaxPacks {
+		return nil, fmt.Errorf("segment: cannot compact %d packs (max %d)", len(packs), MaxPacks)
+	}
+	ix, err := ReadIndex(ctx, d, segment)
+	if err == nil {
+		for _, p := range packs {
+			if _, ok := ix.Find(p.Name); !ok {
+				return nil, ErrMismatch
+			}
+		}
+		return ix, deletePacks(ctx, d, packs)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	packs = append([]atomicwriter.Attrs(nil), packs...)
+	for i := range packs {
+		if !packs[i].HasCRC32C {
+			attrs, err := d.Attrs(ctx, packs[i].Name)
+			if err != nil {
+				return nil, err
+			}
+			if attrs.Generation != packs[i].Generation {
+				return nil, atomicwriter.ErrChanged
+			}
+			packs[i] = attrs
+		}
+	}
+	ix = newIndex(segment, packs)
+
+	attrs, err := d.Attrs(ctx, segment)
+	if os.IsNotExist(err) {
+		attrs, err = compose(ctx, d, segment, packs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if attrs.Size != ix.Size || !attrs.HasCRC32C || attrs.CRC32C != ix.CRC32C {
+		return nil, ErrMismatch
+	}
+
+	// Parts are no longer needed once the segment is verified, including
+	// parts left by an earlier attempt that composed the segment.
+	if err := deleteParts(ctx, d, segment); err != nil {
+		return nil, err
+	}
+
+	if err := writeIndex(ctx, d, ix); err != nil {
+		return nil, err
+	}
+
+	// Packs can be deleted now that readers can find them in the segment.
+	return ix, deletePacks(ctx, d, packs)
+}
+
+func deletePacks(ctx context.Context, d atomicwriter.DriverInterface, packs []atomicwriter.Attrs) error {
+	for _, p := range packs {
+		if err := d.Delete(ctx, p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// compose composes packs into segment, first composing runs of packs into
+// parts if there are too many to compose at once.
+func compose(ctx context.Context, d atomicwriter.DriverInterface, segment string, packs []atomicwriter.Attrs) (atomicwriter.Attrs, error) {
+	if len(packs) <= MaxCompose {
+		return d.Compose(ctx, segment, packs)
+	}
+	var parts []atomicwriter.Attrs
+	for i := 0; i < len(packs); i += MaxCompose {
+		j := i + MaxCompose
+		if j > len(packs) {
+			j = len(packs)
+		}
+		name := partName(segment, len(parts))
+		part, err := d.Compose(ctx, name, packs[i:j])
+		if os.IsExist(err) {
+			// Left by an earlier attempt, Compose below checks its
+			// contents.
+			part, err = d.Attrs(ctx, name)
+		}
+		if err != nil {
+			return atomicwriter.Attrs{}, err
+		}
+		parts = append(parts, part)
+	}
+	return d.Compose(ctx, segment, parts)
+}
+
+func partName(segment string, i int) string {
+	return fmt.Sprintf("%s%d", partPrefix(segment), i)
+}
+
+func partPrefix(segment string) string {
+	return segment + ".part-"
+}
+
+// deleteParts deletes the parts composed into segment.
+func deleteParts(ctx context.Context, d atomicwriter.DriverInterface, segment string) error {
+	var parts []atomicwriter.Attrs
+	itr := d.List(ctx, partPrefix(segment), "")
+	for {
+		attrs, err := itr.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		parts = append(parts, attrs)
+	}
+	return deletePacks(ctx, d, parts)
+}
+
+func writeIndex(ctx context.Context, d atomicwriter.DriverInterface, ix *Index) error {
+	buf, err := json.Marshal(ix)
+	if err != nil {
+		return err
+	}
+	w, err := d.NewAtomicWriter(ctx, IndexName(ix.Segment))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buf); err != nil {
+		w.Abort()
+		return err
+	}
+	err = w.CloseAtomically()
+	if os.IsExist(err) {
+		existing, err := ReadIndex(ctx, d, ix.Segment)
+		if err != nil {
+			return err
+		}
+		if existing.Size != ix.Size || existing.CRC32C != ix.CRC32C || len(existing.Packs) != len(ix.Packs) {
+			return ErrMismatch
+		}
+		return nil
+	}
+	return err
+}
+
+// ReadIndex reads the index of segment. It returns an error satisfying
+// os.IsNotExist if the segment has not been indexed.
+func ReadIndex(ctx context.Context, d atomicwriter.DriverInterface, segment string) (*Index, error) {
+	r, err := d.Open(ctx, IndexName(segment), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	ix := new(Index)
+	if err := json.Unmarshal(buf, ix); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type packReader struct {
+	io.ReadCloser
+	crc  uint32
+	want uint32
+}
+
+func (pr *packReader) Read(b []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(b)
+	pr.crc = crc32.Update(pr.crc, crc32cTable, b[:n])
+	if err == io.EOF && pr.crc != pr.want {
+		return n, atomicwriter.ErrChecksum
+	}
+	return n, err
+}
+
+// Open opens pack p of the segment indexed by ix for reading. The pack is
+// verified against its checksum as it is read to the end.
+func (ix *Index) Open(ctx context.Context, d atomicwriter.DriverInterface, p Pack) (io.ReadCloser, error) {
+	r, err := d.Open(ctx, ix.Segment, p.Offset, p.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &packReader{ReadCloser: r, want: p.CRC32C}, nil
+}
@@ -0,0 +1,241 @@
+package segment_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vsekhar/fabula/internal/atomicwriter"
+	"github.com/vsekhar/fabula/internal/segment"
+	"google.golang.org/api/iterator"
+)
+
+func packName(i int) string {
+	return fmt.Sprintf("NA/0-%04d.pack", i)
+}
+
+// writePacks writes n packs of varying sizes, returning their attributes and
+// their concatenated contents.
+func writePacks(t *testing.T, d atomicwriter.DriverInterface, n int) ([]atomicwriter.Attrs, string) {
+	ctx := context.Background()
+	var all strings.Builder
+	var packs []atomicwriter.Attrs
+	for i := 0; i < n; i++ {
+		contents := strings.Repeat(fmt.Sprintf("pack %d;", i), i%5)
+		w, err := d.NewAtomicWriter(ctx, packName(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.CloseAtomically(); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := d.Attrs(ctx, packName(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packs = append(packs, attrs)
+		all.WriteString(contents)
+	}
+	return packs, all.String()
+}
+
+func readPack(t *testing.T, d atomicwriter.DriverInterface, ix *segment.Index, name string) string {
+	t.Helper()
+	p, ok := ix.Find(name)
+	if !ok {
+		t.Fatalf("%s not in index", name)
+	}
+	r, err := ix.Open(context.Background(), d, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func listAll(t *testing.T, d atomicwriter.DriverInterface) []string {
+	var names []string
+	itr := d.List(context.Background(), "", "")
+	for {
+		attrs, err := itr.Next()
+		if err == iterator.Done {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, attrs.Name)
+	}
+}
+
+func testCompact(t *testing.T, d atomicwriter.DriverInterface, n int) {
+	ctx := context.Background()
+	packs, all := writePacks(t, d, n)
+	ix, err := segment.Compact(ctx, d, "NA/segments/0-0000", packs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := crc32.Checksum([]byte(all), crc32.MakeTable(crc32.Castagnoli)); ix.CRC32C != want || ix.Size != int64(len(all)) {
+		t.Errorf("expected size %d and CRC32C %x, got %d and %x", len(all), want, ix.Size, ix.CRC32C)
+	}
+	// Only the segment and its index remain.
+	if names := listAll(t, d); len(names) != 2 {
+		t.Errorf("expected segment and index, got %v", names)
+	}
+
+	ix, err = segment.ReadIndex(ctx, d, "NA/segments/0-0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		want := strings.Repeat(fmt.Sprintf("pack %d;", i), i%5)
+		if got := readPack(t, d, ix, packName(i)); got != want {
+			t.Errorf("pack %d: expected %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	for _, n := range []int{1, 5, segment.MaxCompose, 70} {
+		t.Run(fmt.Sprintf("memory/%d", n), func(t *testing.T) {
+			testCompact(t, atomicwriter.NewMemoryDriver(), n)
+		})
+		t.Run(fmt.Sprintf("fs/%d", n), func(t *testing.T) {
+			testCompact(t, atomicwriter.NewFileSystemDriver(t.TempDir()), n)
+		})
+	}
+	if _, err := segment.Compact(context.Background(), atomicwriter.NewMemoryDriver(), "s", nil); err == nil {
+		t.Error("expected error compacting no packs")
+	}
+}
+
+// failingDeletes fails deletes after the first n.
+type failingDeletes struct {
+	atomicwriter.DriverInterface
+	n int
+}
+
+func (fd *failingDeletes) Delete(ctx context.Context, attrs atomicwriter.Attrs) error {
+	if fd.n == 0 {
+		return errors.New("delete failed")
+	}
+	fd.n--
+	return fd.DriverInterface.Delete(ctx, attrs)
+}
+
+func TestCompactResume(t *testing.T) {
+	ctx := context.Background()
+	d := atomicwriter.NewMemoryDriver()
+
+	// Segment composed, but not indexed.
+	packs, _ := writePacks(t, d, 5)
+	if _, err := d.Compose(ctx, "seg", packs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := segment.ReadIndex(ctx, d, "seg"); !os.IsNotExist(err) {
+		t.Fatalf("expected os.IsNotExist, got %v", err)
+	}
+	if _, err := segment.Compact(ctx, d, "seg", packs[:3]); err != segment.ErrMismatch {
+		t.Errorf("expected ErrMismatch, got %v", err)
+	}
+	if _, err := segment.Compact(ctx, d, "seg", packs); err != nil {
+		t.Fatal(err)
+	}
+	if names := listAll(t, d); len(names) != 2 {
+		t.Errorf("expected segment and index, got %v", names)
+	}
+
+	// Segment indexed, but only some packs deleted.
+	packs, _ = writePacks(t, d, 5)
+	if _, err := segment.Compact(ctx, &failingDeletes{DriverInterface: d, n: 2}, "seg2", packs); err == nil {
+		t.Fatal("expected delete to fail")
+	}
+	if _, err := segment.Compact(ctx, d, "seg2", packs[2:]); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := segment.ReadIndex(ctx, d, "seg2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readPack(t, d, ix, packName(3)); got != "pack 3;pack 3;pack 3;" {
+		t.Errorf("unexpected pack contents %q", got)
+	}
+
+	// Segment composed from parts, but parts not deleted.
+	packs, _ = writePacks(t, d, 2*segment.MaxCompose+1)
+	if _, err := segment.Compact(ctx, &failingDeletes{DriverInterface: d, n: 0}, "seg3", packs); err == nil {
+		t.Fatal("expected delete to fail")
+	}
+	if _, err := d.Attrs(ctx, "seg3.part-0"); err != nil {
+		t.Fatalf("expected part to remain: %v", err)
+	}
+	if _, err := segment.Compact(ctx, d, "seg3", packs); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range listAll(t, d) {
+		if strings.HasPrefix(name, "seg3.part-") {
+			t.Errorf("part %s not deleted", name)
+		}
+	}
+
+	// Pack not in segment.
+	w, err := d.NewAtomicWriter(ctx, "other.pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseAtomically(); err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.Attrs(ctx, "other.pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := segment.Compact(ctx, d, "seg2", []atomicwriter.Attrs{other}); err != segment.ErrMismatch {
+		t.Errorf("expected ErrMismatch, got %v", err)
+	}
+}
+
+func TestCorruptSegment(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	d := atomicwriter.NewFileSystemDriver(dir)
+	packs, _ := writePacks(t, d, 4)
+	ix, err := segment.Compact(ctx, d, "seg", packs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := ix.Find(packName(2))
+	f, err := os.OpenFile(filepath.Join(dir, "seg"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), p.Offset); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r, err := ix.Open(ctx, d, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err != atomicwriter.ErrChecksum {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+	if got := readPack(t, d, ix, packName(1)); got != "pack 1;" {
+		t.Errorf("expected other packs to be readable, got %q", got)
+	}
+}
@@ -225,8 +225,21 @@ func (c *Client) Ready() {
 	<-c.readyCh
 }
 
+// Synced returns true if the client has synchronized with time servers at
+// least once. Unlike Ready, Synced does not block.
+func (c *Client) Synced() bool {
+	select {
+	case <-c.readyCh:
+		return true
+	default:
+		return false
+	}
+}
+
 // Uncertainty returns the current estimated uncertainty for the YouTimes
 // produced by Get.
+//
+// Uncertainty must not be called before the client is ready.
 func (c *Client) Uncertainty() time.Duration {
 	return c.get().EstimatedCommitWait()
 }
@@ -1,42 +1,125 @@
 // Package autobundler provides an automatic bundler for a stream of values.
+// Bundling amortizes an action with fixed costs over multiple values. For
+// example, if an API provides an RPC that accepts a list of values, but clients
+// would prefer adding values one at a time, then an AutoBundler can accept
+// individual values from clients and bundle many of them into a single RPC.
 //
 // Unlike `google.golang.org/api/support/bundler`, package autobundler does not
 // require setting timeouts or thresholds.
 //
 // Instead, Autobundler tries to minimize the latency between when a value
 // arrives and when it is handled. At steady state, autobundler will buffer
-// incoming values while an invocation of the handler is running, starting a new
-// invocation with the next bundle of values as soon as the prior invocation
+// incoming values while invocations of the handler are running, starting a new
+// invocation with the next bundle of values as soon as a prior invocation
 // finishes.
+//
+// By default, one invocation of the handler runs at a time and values are
+// handled in the order they were added. Options.Handlers allows multiple
+// concurrent invocations, in which case bundles may be handled in any order.
 package autobundler
 
 import (
 	"context"
-	"reflect"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 )
 
-// AutoBundler manages
-type AutoBundler struct {
-	max     int
-	valueCh reflect.Value // chan T
+// ErrClosed is returned when adding a value to an AutoBundler that has been
+// closed.
+var ErrClosed = errors.New("autobundler: closed")
+
+// Handler handles a bundle of values.
+//
+// Handler returns nil if every value was handled successfully. Otherwise it
+// returns a slice with the result for each value in values (nil for values
+// handled successfully).
+type Handler[T any] func(ctx context.Context, values []T) []error
+
+// Options configures an AutoBundler.
+type Options[T any] struct {
+	// MaxBuffered is the maximum number of values buffered while the handler
+	// is running. See New.
+	MaxBuffered int
+
+	// MaxBundleCount is the maximum number of values passed to each
+	// invocation of the handler. If zero, bundles are limited only by
+	// MaxBuffered.
+	MaxBundleCount int
+
+	// MaxBundleBytes is the maximum total size of values passed to each
+	// invocation of the handler, as measured by Size. A value larger than
+	// MaxBundleBytes is handled in a bundle by itself. If zero, the size of
+	// bundles is not limited.
+	MaxBundleBytes int
+
+	// Size returns the size of a value in bytes. Size must be set if
+	// MaxBundleBytes is set. If Size is set, it is also used to report the
+	// size of bundles and of the buffer to Metrics.
+	Size func(T) int
+
+	// Handlers is the maximum number of concurrent invocations of the
+	// handler. If Handlers is greater than one, bundles may be handled in any
+	// order, though values within a bundle remain in the order they were
+	// added. If zero, one invocation runs at a time.
+	Handlers int
+
+	// HandlerTimeout bounds each invocation of the handler. The context
+	// passed to the handler expires after HandlerTimeout and, if the handler
+	// has not returned, its values fail with context.DeadlineExceeded. The
+	// results of a late handler are discarded, but its slot is not given to
+	// the next bundle until it returns, so that no more than Handlers
+	// invocations ever run at once. If zero, invocations are not bounded.
+	HandlerTimeout time.Duration
+
+	// Metrics receives measurements of the AutoBundler. If nil, no
+	// measurements are reported.
+	Metrics Metrics
+}
+
+// Metrics receives measurements from an AutoBundler. Sizes are zero if
+// Options.Size is not set.
+//
+// Methods are called synchronously and should return quickly.
+type Metrics interface {
+	// Bundle is called after each invocation of the handler with the number
+	// and total size of values in the bundle and how long the handler took.
+	Bundle(count, bytes int, latency time.Duration)
+
+	// QueueDepth is called with the number and total size of buffered values
+	// when they change.
+	QueueDepth(count, bytes int)
+
+	// Rejected is called when AddNoWait fails to add a value.
+	Rejected()
+}
+
+type item[T any] struct {
+	value  T
+	size   int        // set by run
+	result chan error // buffered
+}
+
+// AutoBundler bundles values of type T and passes them to a Handler.
+type AutoBundler[T any] struct {
+	handler Handler[T]
+	opts    Options[T]
 	ctx     context.Context
-	wg      sync.WaitGroup
+	itemCh  chan item[T]
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+	err       error // why the AutoBundler stopped; set before done is closed
 }
 
 // New returns a new AutoBundler.
 //
-// The itemExample argument is used to set the type of values the AutoBundler
-// will handle.
-//
 // Handler is called and passed a bundle of values to be handled. Only one
 // instance of handler will be running at a time. Values are passed to handler
-// in the order they were added to the AutoBundler.
-//
-// If itemExample is of type T, then handler will be passed an argument of type
-// []T. For example, if you want to create bundles of type `*Entry` then you can
-// pass `&Entry{}` as itemExample and handler will then be passed an argument
-// of type `[]*Entry`.
+// in the order they were added to the AutoBundler. See NewWithOptions for
+// concurrent handlers.
 //
 // The AutoBundler will only buffer max values, after which calls to Add will
 // block until the bundle is submitted to the handler. Call AddNoWait if you
@@ -45,110 +128,250 @@ type AutoBundler struct {
 // CPU constrained (e.g. which write bundles to remote storage), a max of 1000
 // is reasonable.
 //
-// The context ctx will be passed to the handler. If ctx is cancelled, no future
-// handler invocations will occur and the autobundler will stop handling
-// buffered and new values. There is no way to safely "flush" an autobundler.
-// Applications should be resilient to losing values buffered in the autobundler
-// if the context is cancelled. In other words, context cancellation is treated
-// like termination of the program from the point of view of the autobundler.
-func New(ctx context.Context, itemExample interface{}, handler func(ctx context.Context, v interface{}), max int) *AutoBundler {
-	valueCh := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(itemExample)), 0)
-	r := &AutoBundler{
-		max:     max,
-		valueCh: valueCh,
+// The context ctx will be passed to the handler. To stop an AutoBundler
+// without losing values, call Close. If ctx is cancelled, no future handler
+// invocations will occur and buffered values fail with ctx.Err(). Either way,
+// every value accepted by the AutoBundler receives a result.
+func New[T any](ctx context.Context, handler Handler[T], max int) *AutoBundler[T] {
+	return NewWithOptions(ctx, handler, Options[T]{MaxBuffered: max})
+}
+
+// NewWithOptions returns a new AutoBundler configured by opts. See New.
+func NewWithOptions[T any](ctx context.Context, handler Handler[T], opts Options[T]) *AutoBundler[T] {
+	if opts.MaxBuffered < 1 {
+		panic("autobundler: MaxBuffered must be at least 1")
+	}
+	if opts.MaxBundleBytes > 0 && opts.Size == nil {
+		panic("autobundler: MaxBundleBytes requires Size")
+	}
+	if opts.Handlers < 1 {
+		opts.Handlers = 1
+	}
+	a := &AutoBundler[T]{
+		handler: handler,
+		opts:    opts,
 		ctx:     ctx,
+		itemCh:  make(chan item[T]),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
 	}
-	r.wg.Add(1)
-	go func() {
-		defer r.wg.Done()
-		typ := reflect.TypeOf(itemExample)
-		nilSlice := reflect.Zero(reflect.SliceOf(typ))
-		buf := nilSlice
-		var handlerCh chan struct{}
-		handlerRunning := false
-		allCases := []reflect.SelectCase{
-			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
-			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(handlerCh)},
-			{Dir: reflect.SelectRecv, Chan: r.valueCh}, // add new value
+	go a.run()
+	return a
+}
+
+func (a *AutoBundler[T]) run() {
+	var buf []item[T]
+	bufBytes := 0
+	handlerDone := make(chan struct{}, a.opts.Handlers)
+	running := 0
+	closing := a.closing
+	for {
+		itemCh := a.itemCh
+		if len(buf) >= a.opts.MaxBuffered || closing == nil {
+			// Stop receiving if the buffer is full or the AutoBundler is
+			// closing. This will cause calls to Add to block, and calls to
+			// AddNoWait to return false.
+			itemCh = nil
 		}
-		for {
-			var chosen int
-			var val reflect.Value
-			cases := allCases
-			if buf.Len() >= max {
-				// Exclude receive case if the buffer is full. This will cause
-				// calls to Add to block, and calls to AddNoWait to return false.
-				cases = cases[:2]
-			}
-			chosen, val, _ = reflect.Select(cases)
-			switch chosen {
-			case 0:
-				// <-ctx.Done()
-				if handlerRunning {
-					<-handlerCh
-				}
-				return
-			case 1:
-				// <-handlerCh
-				handlerRunning = false
-			case 2:
-				// val = <-valueCh
-				buf = reflect.Append(buf, val)
-			default:
-				panic("select error")
+		select {
+		case <-a.ctx.Done():
+		case <-closing:
+			closing = nil
+		case <-handlerDone:
+			running--
+		case it := <-itemCh:
+			if a.opts.Size != nil {
+				it.size = a.opts.Size(it.value)
 			}
+			buf = append(buf, it)
+			bufBytes += it.size
+			a.queueDepth(len(buf), bufBytes)
+		}
 
-			if buf.Len() > 0 && !handlerRunning {
-				handlerBuf := buf
-				// pre-allocate length of last slice
-				buf = reflect.MakeSlice(reflect.SliceOf(typ), 0, handlerBuf.Len())
-				handlerCh = make(chan struct{})
-				cases[1].Chan = reflect.ValueOf(handlerCh)
-				go func() {
-					handler(ctx, handlerBuf.Interface())
-					close(handlerCh)
-				}()
-				handlerRunning = true
+		if a.ctx.Err() != nil {
+			for ; running > 0; running-- {
+				<-handlerDone
 			}
+			for _, it := range buf {
+				it.result <- a.ctx.Err()
+			}
+			a.stop(a.ctx.Err())
+			return
+		}
+		for len(buf) > 0 && running < a.opts.Handlers {
+			n, bytes := a.bundleLen(buf)
+			handlerBuf := buf[:n:n]
+			// pre-allocate length of last slice
+			buf = append(make([]item[T], 0, n), buf[n:]...)
+			bufBytes -= bytes
+			a.queueDepth(len(buf), bufBytes)
+			go func() {
+				a.handle(handlerBuf, bytes)
+				handlerDone <- struct{}{}
+			}()
+			running++
 		}
+		if closing == nil && running == 0 && len(buf) == 0 {
+			a.stop(ErrClosed)
+			return
+		}
+	}
+}
+
+// bundleLen returns the number and total size of values at the front of buf
+// that fit in the next bundle.
+func (a *AutoBundler[T]) bundleLen(buf []item[T]) (n, bytes int) {
+	for n < len(buf) {
+		if a.opts.MaxBundleCount > 0 && n >= a.opts.MaxBundleCount {
+			break
+		}
+		if a.opts.MaxBundleBytes > 0 && n > 0 && bytes+buf[n].size > a.opts.MaxBundleBytes {
+			break
+		}
+		bytes += buf[n].size
+		n++
+	}
+	return n, bytes
+}
+
+func (a *AutoBundler[T]) queueDepth(count, bytes int) {
+	if a.opts.Metrics != nil {
+		a.opts.Metrics.QueueDepth(count, bytes)
+	}
+}
+
+func (a *AutoBundler[T]) handle(items []item[T], bytes int) {
+	values := make([]T, len(items))
+	for i, it := range items {
+		values[i] = it.value
+	}
+	start := time.Now()
+	errs, returned := a.callHandler(values)
+	defer func() { <-returned }() // hold the slot until the handler returns
+	if a.opts.Metrics != nil {
+		a.opts.Metrics.Bundle(len(items), bytes, time.Since(start))
+	}
+	if errs != nil && len(errs) != len(items) {
+		panic(fmt.Sprintf("autobundler: handler returned %d results for %d values", len(errs), len(items)))
+	}
+	for i, it := range items {
+		var err error
+		if errs != nil {
+			err = errs[i]
+		}
+		it.result <- err
+	}
+}
+
+// callHandler calls the handler, enforcing Options.HandlerTimeout. The
+// returned channel is closed once the handler has returned, which may be after
+// callHandler returns if the handler timed out.
+func (a *AutoBundler[T]) callHandler(values []T) ([]error, <-chan struct{}) {
+	returned := make(chan struct{})
+	if a.opts.HandlerTimeout <= 0 {
+		defer close(returned)
+		return a.handler(a.ctx, values), returned
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, a.opts.HandlerTimeout)
+	resultCh := make(chan []error, 1) // late handlers must not block
+	go func() {
+		defer close(returned)
+		defer cancel()
+		resultCh <- a.handler(ctx, values)
 	}()
-	return r
+	select {
+	case errs := <-resultCh:
+		return errs, returned
+	case <-ctx.Done():
+		errs := make([]error, len(values))
+		for i := range errs {
+			errs[i] = ctx.Err()
+		}
+		return errs, returned
+	}
+}
+
+func (a *AutoBundler[T]) stop(err error) {
+	a.err = err
+	close(a.done)
 }
 
-// Add adds item to the current bundler.
+// Add adds value to the AutoBundler and waits until it has been handled,
+// returning the result of handling value.
+//
+// If ctx is done before value has been handled, Add returns ctx.Err(). The
+// value may still be handled. If the AutoBundler has stopped, Add returns
+// ErrClosed or the error of the context passed to New.
 //
 // It is safe to call Add from multiple goroutines.
-func (a *AutoBundler) Add(ctx context.Context, item interface{}) {
-	cases := []reflect.SelectCase{
-		{Dir: reflect.SelectSend, Chan: a.valueCh, Send: reflect.ValueOf(item)},
-		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(a.ctx.Done())},
-		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+func (a *AutoBundler[T]) Add(ctx context.Context, value T) error {
+	result, err := a.AddAsync(ctx, value)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	reflect.Select(cases)
 }
 
-// AddNoWait tries to add an item to the current bundler. If successful, it
-// returns true, otherwise it returns false. AddNoWait does not block.
+// AddAsync adds value to the AutoBundler, blocking only while the buffer is
+// full. It returns a channel that will receive the result of handling value.
+//
+// If ctx is done before value is added, AddAsync returns ctx.Err(). If the
+// AutoBundler has stopped, AddAsync returns ErrClosed or the error of the
+// context passed to New.
+//
+// It is safe to call AddAsync from multiple goroutines.
+func (a *AutoBundler[T]) AddAsync(ctx context.Context, value T) (<-chan error, error) {
+	it := item[T]{value: value, result: make(chan error, 1)}
+	select {
+	case a.itemCh <- it:
+		return it.result, nil
+	case <-a.closing:
+		return nil, ErrClosed
+	case <-a.done:
+		return nil, a.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AddNoWait tries to add value to the AutoBundler without blocking. If
+// successful, it returns a channel that will receive the result of handling
+// value and true. Otherwise, it returns false.
 //
 // It is safe to call AddNoWait from multiple goroutines.
-func (a *AutoBundler) AddNoWait(item interface{}) bool {
-	cases := []reflect.SelectCase{
-		{Dir: reflect.SelectSend, Chan: a.valueCh, Send: reflect.ValueOf(item)},
-		{Dir: reflect.SelectDefault},
-	}
-	chosen, _, _ := reflect.Select(cases)
-	switch chosen {
-	case 0:
-		return true
-	case 1:
-		return false
+func (a *AutoBundler[T]) AddNoWait(value T) (<-chan error, bool) {
+	it := item[T]{value: value, result: make(chan error, 1)}
+	select {
+	case <-a.closing:
 	default:
-		panic("select error")
+		select {
+		case a.itemCh <- it:
+			return it.result, true
+		default:
+		}
 	}
+	if a.opts.Metrics != nil {
+		a.opts.Metrics.Rejected()
+	}
+	return nil, false
+}
+
+// Close stops the AutoBundler from accepting new values and waits until
+// buffered values have been handled.
+//
+// Close may be called more than once and from multiple goroutines.
+func (a *AutoBundler[T]) Close() {
+	a.closeOnce.Do(func() { close(a.closing) })
+	<-a.done
 }
 
 // Wait blocks until the autobundler has stopped. The autobundler will stop when
-// the context passed to New is cancelled.
-func (a *AutoBundler) Wait() {
-	a.wg.Wait()
+// it is closed or the context passed to New is cancelled.
+func (a *AutoBundler[T]) Wait() {
+	<-a.done
 }
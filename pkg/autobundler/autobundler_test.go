@@ -2,8 +2,13 @@ package autobundler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -17,10 +22,10 @@ func sleep(ctx context.Context, d time.Duration) {
 
 // addValues adds r random integer values per second to autobundler a until the
 // context is cancelled.
-func addValues(ctx context.Context, r int, a *AutoBundler) {
+func addValues(ctx context.Context, r int, a *AutoBundler[int]) {
 	interval := time.Duration(float64(time.Second) / float64(r))
-	for i := 0; true; i++ {
-		a.Add(ctx, i)
+	for i := 0; ctx.Err() == nil; i++ {
+		a.AddAsync(ctx, i)
 		sleep(ctx, interval)
 	}
 }
@@ -82,8 +87,7 @@ func TestAutoBundler(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 
 			largestBundle := 0
-			handler := func(ctx context.Context, v interface{}) {
-				b := v.([]int)
+			handler := func(ctx context.Context, b []int) []error {
 				n := len(b)
 				if n > largestBundle {
 					largestBundle = n
@@ -97,9 +101,10 @@ func TestAutoBundler(t *testing.T) {
 					}
 				}
 				sleep(ctx, tc.fixed+(time.Duration(n)*tc.variable))
+				return nil
 			}
 
-			a := New(ctx, int(0), handler, tc.max)
+			a := New(ctx, handler, tc.max)
 			go addValues(ctx, tc.rate, a)
 			time.Sleep(settleTime)
 			cancel()
@@ -122,3 +127,357 @@ func TestAutoBundler(t *testing.T) {
 		})
 	}
 }
+
+// mustAdd adds v to a without waiting for it to be handled. The AutoBundler
+// must not be full or closed.
+func mustAdd(a *AutoBundler[int], v int) <-chan error {
+	for {
+		if ch, ok := a.AddNoWait(v); ok {
+			return ch
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResults(t *testing.T) {
+	errOdd := errors.New("odd")
+	handler := func(ctx context.Context, b []int) []error {
+		errs := make([]error, len(b))
+		for i, v := range b {
+			if v%2 == 1 {
+				errs[i] = errOdd
+			}
+		}
+		return errs
+	}
+	a := New(context.Background(), handler, 10)
+	defer a.Close()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := a.Add(context.Background(), i)
+			if i%2 == 1 && err != errOdd {
+				t.Errorf("%d: expected %v, got %v", i, errOdd, err)
+			}
+			if i%2 == 0 && err != nil {
+				t.Errorf("%d: expected nil, got %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClose(t *testing.T) {
+	const n = 50
+	var handled int64
+	release := make(chan struct{})
+	handler := func(ctx context.Context, b []int) []error {
+		<-release
+		atomic.AddInt64(&handled, int64(len(b)))
+		return nil
+	}
+	a := New(context.Background(), handler, n)
+	results := make([]<-chan error, n)
+	for i := range results {
+		results[i] = mustAdd(a, i)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		a.Close()
+		close(closed)
+	}()
+	close(release)
+	<-closed
+	if handled != n {
+		t.Errorf("expected %d values handled after Close, got %d", n, handled)
+	}
+	for i, ch := range results {
+		if err := <-ch; err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+	if err := a.Add(context.Background(), 0); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, ok := a.AddNoWait(0); ok {
+		t.Error("expected AddNoWait to fail after Close")
+	}
+	a.Close() // idempotent
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	handler := func(ctx context.Context, b []int) []error {
+		close(started)
+		<-ctx.Done()
+		return nil
+	}
+	a := New(ctx, handler, 10)
+	first := mustAdd(a, 0)
+	<-started
+	second := mustAdd(a, 1)
+	cancel()
+	a.Wait()
+	if err := <-first; err != nil {
+		t.Errorf("expected result from handler, got %v", err)
+	}
+	if err := <-second; err != context.Canceled {
+		t.Errorf("expected buffered value to fail with %v, got %v", context.Canceled, err)
+	}
+	if err := a.Add(context.Background(), 2); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestBundleLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		count    int
+		bytes    int
+		sizes    []int
+		expected [][]int // sizes in each bundle after the first
+	}{
+		{"count", 3, 0, []int{1, 1, 1, 1, 1, 1, 1}, [][]int{{1, 1, 1}, {1, 1, 1}, {1}}},
+		{"bytes", 0, 10, []int{4, 4, 4, 9, 20, 1}, [][]int{{4, 4}, {4}, {9}, {20}, {1}}},
+		{"both", 2, 10, []int{1, 1, 1, 8, 3}, [][]int{{1, 1}, {1, 8}, {3}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var bundles [][]int
+			release := make(chan struct{})
+			handler := func(ctx context.Context, b []int) []error {
+				<-release
+				bundles = append(bundles, b)
+				return nil
+			}
+			a := NewWithOptions(context.Background(), handler, Options[int]{
+				MaxBuffered:    100,
+				MaxBundleCount: tc.count,
+				MaxBundleBytes: tc.bytes,
+				Size:           func(v int) int { return v },
+			})
+			first := mustAdd(a, 0) // blocks the handler so the rest are buffered
+			for _, size := range tc.sizes {
+				mustAdd(a, size)
+			}
+			close(release)
+			<-first
+			a.Close()
+			got := fmt.Sprint(bundles[1:])
+			if want := fmt.Sprint(tc.expected); got != want {
+				t.Errorf("expected bundles %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+type testMetrics struct {
+	mu       sync.Mutex
+	bundles  int
+	values   int
+	bytes    int
+	maxDepth int
+	rejected int
+}
+
+func (m *testMetrics) Bundle(count, bytes int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bundles++
+	m.values += count
+	m.bytes += bytes
+}
+
+func (m *testMetrics) QueueDepth(count, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if count > m.maxDepth {
+		m.maxDepth = count
+	}
+}
+
+func (m *testMetrics) Rejected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected++
+}
+
+func TestMetrics(t *testing.T) {
+	m := new(testMetrics)
+	release := make(chan struct{})
+	handler := func(ctx context.Context, b []int) []error {
+		<-release
+		return nil
+	}
+	a := NewWithOptions(context.Background(), handler, Options[int]{
+		MaxBuffered: 3,
+		Size:        func(int) int { return 10 },
+		Metrics:     m,
+	})
+	for i := 0; i < 4; i++ { // one being handled, three buffered
+		mustAdd(a, i)
+	}
+	m.mu.Lock()
+	rejected := m.rejected // by mustAdd while the AutoBundler was busy
+	m.mu.Unlock()
+	if _, ok := a.AddNoWait(4); ok {
+		t.Fatal("expected AddNoWait to fail when buffer is full")
+	}
+	close(release)
+	a.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values != 4 || m.bytes != 40 {
+		t.Errorf("expected 4 values and 40 bytes handled, got %d and %d", m.values, m.bytes)
+	}
+	if m.bundles != 2 {
+		t.Errorf("expected 2 bundles, got %d", m.bundles)
+	}
+	if m.maxDepth != 3 {
+		t.Errorf("expected max queue depth 3, got %d", m.maxDepth)
+	}
+	if m.rejected != rejected+1 {
+		t.Errorf("expected 1 rejection, got %d", m.rejected-rejected)
+	}
+}
+
+func TestConcurrentHandlers(t *testing.T) {
+	const handlers = 4
+	var running, maxRunning int64
+	handler := func(ctx context.Context, b []int) []error {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&running, -1)
+		return nil
+	}
+	a := NewWithOptions(context.Background(), handler, Options[int]{
+		MaxBuffered:    100,
+		MaxBundleCount: 5,
+		Handlers:       handlers,
+	})
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := a.Add(context.Background(), i); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	a.Close()
+	if maxRunning > handlers {
+		t.Errorf("expected at most %d concurrent handlers, got %d", handlers, maxRunning)
+	}
+	if maxRunning < 2 {
+		t.Errorf("expected concurrent handlers, got %d", maxRunning)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	stuck := make(chan struct{})
+	var running, maxRunning int32
+	handler := func(ctx context.Context, b []int) []error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		if b[0] == 0 {
+			<-stuck // ignores ctx
+		}
+		return nil
+	}
+	a := NewWithOptions(context.Background(), handler, Options[int]{
+		MaxBuffered:    10,
+		MaxBundleCount: 1,
+		HandlerTimeout: 50 * time.Millisecond,
+	})
+	first := mustAdd(a, 0)
+	second := mustAdd(a, 1)
+	if err := <-first; err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// The late handler keeps its slot, so the next bundle waits for it.
+	select {
+	case err := <-second:
+		t.Errorf("next bundle handled while late handler running (err: %v)", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(stuck)
+	if err := <-second; err != nil {
+		t.Errorf("expected next bundle to be handled, got %v", err)
+	}
+	if m := atomic.LoadInt32(&maxRunning); m != 1 {
+		t.Errorf("expected at most 1 concurrent handler, got %d", m)
+	}
+	a.Close()
+}
+
+// BenchmarkLatency measures how long values take to be handled under a load of
+// 100 producers each adding a value every ~10ms, with a handler taking ~100ms
+// per bundle.
+func BenchmarkLatency(b *testing.B) {
+	const producers = 100
+	for _, handlers := range []int{1, 10, 50} {
+		b.Run(fmt.Sprintf("handlers=%d", handlers), func(b *testing.B) {
+			var bundles, values int64
+			handler := func(ctx context.Context, vs []int) []error {
+				atomic.AddInt64(&bundles, 1)
+				atomic.AddInt64(&values, int64(len(vs)))
+				time.Sleep(time.Duration(87+rand.Intn(25)) * time.Millisecond) // 100ms avg
+				return nil
+			}
+			a := NewWithOptions(context.Background(), handler, Options[int]{
+				MaxBuffered: 1000,
+				Handlers:    handlers,
+			})
+			latencies := make([]time.Duration, b.N)
+			var next int64 = -1
+			wg := new(sync.WaitGroup)
+			wg.Add(producers)
+			b.ResetTimer()
+			for p := 0; p < producers; p++ {
+				go func() {
+					defer wg.Done()
+					for {
+						i := atomic.AddInt64(&next, 1)
+						if i >= int64(b.N) {
+							return
+						}
+						time.Sleep(time.Duration(7+rand.Intn(5)) * time.Millisecond) // 10ms avg
+						start := time.Now()
+						if err := a.Add(context.Background(), int(i)); err != nil {
+							b.Error(err)
+						}
+						latencies[i] = time.Since(start)
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+			a.Close()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+			b.ReportMetric(ms(latencies[len(latencies)/2]), "p50-ms")
+			b.ReportMetric(ms(latencies[len(latencies)*99/100]), "p99-ms")
+			b.ReportMetric(float64(values)/float64(bundles), "values/bundle")
+		})
+	}
+}
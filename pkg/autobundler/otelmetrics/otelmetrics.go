@@ -0,0 +1,78 @@
+// Package otelmetrics reports autobundler measurements to OpenTelemetry.
+package otelmetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/vsekhar/fabula/pkg/autobundler"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metrics implements autobundler.Metrics by recording measurements with an
+// OpenTelemetry meter.
+type Metrics struct {
+	bundleSize     metric.BoundInt64ValueRecorder
+	bundleBytes    metric.BoundInt64ValueRecorder
+	handlerLatency metric.BoundFloat64ValueRecorder
+	queueDepth     metric.BoundInt64ValueRecorder
+	queueBytes     metric.BoundInt64ValueRecorder
+	rejections     metric.BoundInt64Counter
+}
+
+var _ autobundler.Metrics = (*Metrics)(nil)
+
+// New returns Metrics recording measurements with meter, labelled with name.
+// AutoBundlers with the same purpose (e.g. one per shard) can share Metrics.
+func New(meter metric.Meter, name string) *Metrics {
+	m := metric.Must(meter)
+	labels := []label.KeyValue{label.String("autobundler", name)}
+	return &Metrics{
+		bundleSize: m.NewInt64ValueRecorder(
+			"autobundler.bundle_size",
+			metric.WithDescription("Number of values in each bundle"),
+		).Bind(labels...),
+		bundleBytes: m.NewInt64ValueRecorder(
+			"autobundler.bundle_bytes",
+			metric.WithDescription("Total size of values in each bundle"),
+		).Bind(labels...),
+		handlerLatency: m.NewFloat64ValueRecorder(
+			"autobundler.handler_latency",
+			metric.WithDescription("Time taken to handle each bundle"),
+			metric.WithUnit("ms"),
+		).Bind(labels...),
+		queueDepth: m.NewInt64ValueRecorder(
+			"autobundler.queue_depth",
+			metric.WithDescription("Number of values waiting to be bundled"),
+		).Bind(labels...),
+		queueBytes: m.NewInt64ValueRecorder(
+			"autobundler.queue_bytes",
+			metric.WithDescription("Total size of values waiting to be bundled"),
+		).Bind(labels...),
+		rejections: m.NewInt64Counter(
+			"autobundler.rejections",
+			metric.WithDescription("Values not added because the buffer was full"),
+		).Bind(labels...),
+	}
+}
+
+// Bundle implements autobundler.Metrics.
+func (m *Metrics) Bundle(count, bytes int, latency time.Duration) {
+	ctx := context.Background()
+	m.bundleSize.Record(ctx, int64(count))
+	m.bundleBytes.Record(ctx, int64(bytes))
+	m.handlerLatency.Record(ctx, float64(latency)/float64(time.Millisecond))
+}
+
+// QueueDepth implements autobundler.Metrics.
+func (m *Metrics) QueueDepth(count, bytes int) {
+	ctx := context.Background()
+	m.queueDepth.Record(ctx, int64(count))
+	m.queueBytes.Record(ctx, int64(bytes))
+}
+
+// Rejected implements autobundler.Metrics.
+func (m *Metrics) Rejected() {
+	m.rejections.Add(context.Background(), 1)
+}
@@ -0,0 +1,90 @@
+// Package pack reads and writes packs, the objects in which the entries of a
+// prefix chain are stored.
+//
+// A pack is laid out as:
+//
+//	magic "FBPK" and version
+//	header: prefix, sequence number, SHA3-512 of the previous pack in the
+//	        prefix chain and the pack's notarization in the parent prefix
+//	entries, each a length followed by the entry, ending with a zero length
+//	index: for each entry in order of DataSHA3512, its DataSHA3512, offset
+//	       and position in the pack
+//	trailer: offset of the index, number of entries, CRC32C checksum of all
+//	         preceding bytes and magic "FBPK"
+//
+// The version, header integers and lengths are uvarints. Byte strings in the
+// header are a length followed by their bytes. An entry is its timestamp,
+// encoded with package timestamp, followed by its DataSHA3512. Entries are in
+// order of timestamp and have distinct DataSHA3512s.
+//
+// Integers in the index and trailer are fixed size and big-endian, so that
+// the index can be binary searched to find an entry by DataSHA3512 with
+// O(log n) reads.
+//
+// The SHA3-512 of a pack is the hash of all of its bytes.
+package pack
+
+import (
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// Version is the version of the pack format written by this package.
+const Version = 1
+
+const magic = "FBPK"
+
+// Sizes of fixed size parts of a pack.
+const (
+	hashSize    = 64
+	slotSize    = hashSize + 8 + 4 // DataSHA3512, offset, position
+	trailerSize = 8 + 8 + 4 + 4    // index offset, entries, CRC32C, magic
+)
+
+// Limits on variable size parts of a pack.
+const (
+	maxPrefixLen       = 64
+	maxNotarizationLen = 1 << 16
+	maxEntryLen        = 1 << 10
+	maxEntries         = 1 << 24
+)
+
+// ErrFormat is returned when reading data that is not a valid pack.
+var ErrFormat = errors.New("pack: invalid format")
+
+// ErrChecksum is returned when the checksum of a pack does not match its
+// data.
+var ErrChecksum = errors.New("pack: checksum mismatch")
+
+// ErrNotFound is returned when an entry is not in a pack.
+var ErrNotFound = errors.New("pack: entry not found")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Header describes a pack.
+type Header struct {
+	Prefix string
+	SeqNo  uint64
+
+	// PrevSHA3512 is the SHA3-512 of the previous pack in the prefix chain,
+	// or empty if this is the first.
+	PrevSHA3512 []byte
+
+	// Notarization is the notarization of the pack in the parent prefix
+	// chain.
+	Notarization []byte
+}
+
+// Entry is an entry in a pack.
+type Entry struct {
+	Timestamp   time.Time
+	DataSHA3512 []byte
+}
+
+// slot is an entry in the index of a pack.
+type slot struct {
+	hash     []byte
+	offset   uint64
+	position uint32
+}
@@ -0,0 +1,263 @@
+package pack_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/vsekhar/fabula/pkg/pack"
+)
+
+func hash(s string) []byte {
+	h := sha3.Sum512([]byte(s))
+	return h[:]
+}
+
+func testHeader() pack.Header {
+	return pack.Header{
+		Prefix:       "ab",
+		SeqNo:        42,
+		PrevSHA3512:  hash("prev"),
+		Notarization: []byte("notarization"),
+	}
+}
+
+func testEntries(n int) []pack.Entry {
+	start := time.Date(2020, 8, 11, 18, 1, 34, 58982, time.UTC)
+	var r []pack.Entry
+	for i := 0; i < n; i++ {
+		r = append(r, pack.Entry{
+			// Two entries per timestamp.
+			Timestamp:   start.Add(time.Duration(i/2) * time.Millisecond),
+			DataSHA3512: hash(fmt.Sprint(i)),
+		})
+	}
+	return r
+}
+
+func writePack(t testing.TB, h pack.Header, entries []pack.Entry) ([]byte, []byte) {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w, err := pack.NewWriter(buf, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := w.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), w.SHA3512()
+}
+
+func sameHeader(a, b pack.Header) bool {
+	return a.Prefix == b.Prefix && a.SeqNo == b.SeqNo &&
+		bytes.Equal(a.PrevSHA3512, b.PrevSHA3512) &&
+		bytes.Equal(a.Notarization, b.Notarization)
+}
+
+func sameEntry(a, b pack.Entry) bool {
+	return a.Timestamp.Equal(b.Timestamp) && bytes.Equal(a.DataSHA3512, b.DataSHA3512)
+}
+
+// readAll reads and verifies all entries of a pack.
+func readAll(b []byte) (pack.Header, []pack.Entry, []byte, error) {
+	r, err := pack.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return pack.Header{}, nil, nil, err
+	}
+	var entries []pack.Entry
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return r.Header(), entries, r.SHA3512(), nil
+		}
+		if err != nil {
+			return pack.Header{}, nil, nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 100} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			h, entries := testHeader(), testEntries(n)
+			b, sum := writePack(t, h, entries)
+			if want := sha3.Sum512(b); !bytes.Equal(sum, want[:]) {
+				t.Errorf("writer hash %x, expected %x", sum, want)
+			}
+
+			gh, got, gsum, err := readAll(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameHeader(gh, h) {
+				t.Errorf("header %+v, expected %+v", gh, h)
+			}
+			if len(got) != len(entries) {
+				t.Fatalf("read %d entries, expected %d", len(got), len(entries))
+			}
+			for i := range got {
+				if !sameEntry(got[i], entries[i]) {
+					t.Errorf("entry %d: %+v, expected %+v", i, got[i], entries[i])
+				}
+			}
+			if !bytes.Equal(gsum, sum) {
+				t.Errorf("reader hash %x, expected %x", gsum, sum)
+			}
+
+			f, err := pack.Open(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameHeader(f.Header(), h) {
+				t.Errorf("file header %+v, expected %+v", f.Header(), h)
+			}
+			if f.Len() != n {
+				t.Errorf("file has %d entries, expected %d", f.Len(), n)
+			}
+			for i, e := range entries {
+				g, pos, err := f.Lookup(e.DataSHA3512)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pos != i || !sameEntry(g, e) {
+					t.Errorf("lookup %d: %+v at %d", i, g, pos)
+				}
+			}
+			if _, _, err := f.Lookup(hash("missing")); err != pack.ErrNotFound {
+				t.Errorf("lookup of missing entry: %v, expected %v", err, pack.ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestFirstPack(t *testing.T) {
+	h := pack.Header{Prefix: "", SeqNo: 0}
+	b, _ := writePack(t, h, testEntries(3))
+	gh, _, _, err := readAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameHeader(gh, h) {
+		t.Errorf("header %+v, expected %+v", gh, h)
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	if _, err := pack.NewWriter(io.Discard, pack.Header{PrevSHA3512: []byte("short")}); err == nil {
+		t.Error("expected error for short previous pack hash")
+	}
+	w, err := pack.NewWriter(io.Discard, testHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := testEntries(3)
+	if err := w.Append(entries[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(entries[0]); err == nil {
+		t.Error("expected error for out of order entry")
+	}
+	if err := w.Append(entries[2]); err == nil {
+		t.Error("expected error for duplicate entry")
+	}
+	if err := w.Append(pack.Entry{Timestamp: entries[2].Timestamp, DataSHA3512: []byte("short")}); err == nil {
+		t.Error("expected error for short DataSHA3512")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(testEntries(4)[3]); err == nil {
+		t.Error("expected error appending after close")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	b, _ := writePack(t, testHeader(), testEntries(10))
+	for i := range b {
+		c := append([]byte(nil), b...)
+		c[i] ^= 0x01
+		if _, _, _, err := readAll(c); err == nil {
+			t.Errorf("no error reading pack with byte %d corrupted", i)
+		} else if !errors.Is(err, pack.ErrFormat) && err != pack.ErrChecksum {
+			t.Errorf("byte %d: unexpected error %v", i, err)
+		}
+	}
+	for i := 0; i < len(b); i++ {
+		if _, _, _, err := readAll(b[:i]); !errors.Is(err, pack.ErrFormat) {
+			t.Errorf("truncated to %d bytes: %v, expected %v", i, err, pack.ErrFormat)
+		}
+	}
+	if _, _, _, err := readAll(append(b, 0)); !errors.Is(err, pack.ErrFormat) {
+		t.Errorf("trailing data: %v, expected %v", err, pack.ErrFormat)
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	for _, n := range []int{0, 1, 5} {
+		b, _ := writePack(f, testHeader(), testEntries(n))
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, entries, sum, err := readAll(b)
+		if err != nil {
+			return
+		}
+		// A valid pack must also be readable with random access.
+		file, err := pack.Open(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatalf("reader accepted pack that Open rejected: %v", err)
+		}
+		if !sameHeader(file.Header(), h) || file.Len() != len(entries) {
+			t.Fatalf("file header %+v with %d entries, expected %+v with %d", file.Header(), file.Len(), h, len(entries))
+		}
+		for i, e := range entries {
+			g, pos, err := file.Lookup(e.DataSHA3512)
+			if err != nil || pos != i || !sameEntry(g, e) {
+				t.Fatalf("lookup %d: %+v at %d, %v", i, g, pos, err)
+			}
+		}
+		if want := sha3.Sum512(b); !bytes.Equal(sum, want[:]) {
+			t.Fatalf("reader hash %x, expected %x", sum, want)
+		}
+		// And rewriting it must preserve its contents.
+		b2, _ := writePack(t, h, entries)
+		h2, entries2, _, err := readAll(b2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameHeader(h2, h) || len(entries2) != len(entries) {
+			t.Fatalf("rewritten pack differs")
+		}
+		for i := range entries {
+			if !sameEntry(entries2[i], entries[i]) {
+				t.Fatalf("rewritten entry %d differs", i)
+			}
+		}
+	})
+}
+
+func FuzzOpen(f *testing.F) {
+	b, _ := writePack(f, testHeader(), testEntries(5))
+	f.Add(b, hash("0"))
+	f.Add(b, hash("missing"))
+	f.Fuzz(func(t *testing.T, b []byte, dataSHA3512 []byte) {
+		file, err := pack.Open(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return
+		}
+		e, _, err := file.Lookup(dataSHA3512)
+		if err == nil && !bytes.Equal(e.DataSHA3512, dataSHA3512) {
+			t.Fatalf("lookup of %x returned %x", dataSHA3512, e.DataSHA3512)
+		}
+	})
+}
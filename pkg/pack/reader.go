@@ -0,0 +1,398 @@
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha3"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/vsekhar/fabula/pkg/timestamp"
+)
+
+func formatError(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrFormat, fmt.Sprintf(format, a...))
+}
+
+// unexpected converts an unexpected end of data into ErrFormat.
+func unexpected(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return formatError("unexpected end of pack")
+	}
+	return err
+}
+
+// byteReader reads from an io.Reader, hashing and counting the bytes read.
+type byteReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32 // nil once the checksum is read
+	sha *sha3.SHA3
+	off uint64
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	c, err := br.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	br.update([]byte{c})
+	return c, nil
+}
+
+func (br *byteReader) update(b []byte) {
+	if br.crc != nil {
+		br.crc.Write(b)
+	}
+	br.sha.Write(b)
+	br.off += uint64(len(b))
+}
+
+func (br *byteReader) readFull(n uint64) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br.r, b); err != nil {
+		return nil, unexpected(err)
+	}
+	br.update(b)
+	return b, nil
+}
+
+func (br *byteReader) readUvarint() (uint64, error) {
+	x, err := binary.ReadUvarint(br)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, unexpected(err)
+		}
+		return 0, formatError("%v", err)
+	}
+	return x, nil
+}
+
+func (br *byteReader) readBytes(max uint64) ([]byte, error) {
+	n, err := br.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, formatError("field of %d bytes exceeds %d", n, max)
+	}
+	return br.readFull(n)
+}
+
+func readHeader(br *byteReader) (Header, error) {
+	m, err := br.readFull(uint64(len(magic)))
+	if err != nil {
+		return Header{}, err
+	}
+	if string(m) != magic {
+		return Header{}, formatError("bad magic %q", m)
+	}
+	v, err := br.readUvarint()
+	if err != nil {
+		return Header{}, err
+	}
+	if v != Version {
+		return Header{}, formatError("unsupported version %d", v)
+	}
+	var h Header
+	prefix, err := br.readBytes(maxPrefixLen)
+	if err != nil {
+		return Header{}, err
+	}
+	h.Prefix = string(prefix)
+	if h.SeqNo, err = br.readUvarint(); err != nil {
+		return Header{}, err
+	}
+	if h.PrevSHA3512, err = br.readBytes(hashSize); err != nil {
+		return Header{}, err
+	}
+	if len(h.PrevSHA3512) != 0 && len(h.PrevSHA3512) != hashSize {
+		return Header{}, formatError("previous pack hash is %d bytes", len(h.PrevSHA3512))
+	}
+	if h.Notarization, err = br.readBytes(maxNotarizationLen); err != nil {
+		return Header{}, err
+	}
+	return h, nil
+}
+
+func decodeEntry(b []byte) (Entry, error) {
+	t, n := timestamp.FromBytes(b)
+	if n <= 0 {
+		return Entry{}, formatError("bad entry timestamp")
+	}
+	if len(b)-n != hashSize {
+		return Entry{}, formatError("entry DataSHA3512 is %d bytes", len(b)-n)
+	}
+	return Entry{Timestamp: t, DataSHA3512: b[n:]}, nil
+}
+
+func decodeSlot(b []byte) slot {
+	return slot{
+		hash:     b[:hashSize],
+		offset:   binary.BigEndian.Uint64(b[hashSize:]),
+		position: binary.BigEndian.Uint32(b[hashSize+8:]),
+	}
+}
+
+type trailer struct {
+	indexOffset uint64
+	entries     uint64
+	crc         uint32
+}
+
+func decodeTrailer(b []byte) (trailer, error) {
+	if string(b[20:]) != magic {
+		return trailer{}, formatError("bad trailer magic %q", b[20:])
+	}
+	return trailer{
+		indexOffset: binary.BigEndian.Uint64(b),
+		entries:     binary.BigEndian.Uint64(b[8:]),
+		crc:         binary.BigEndian.Uint32(b[16:]),
+	}, nil
+}
+
+// Reader reads the entries of a pack in order from an underlying io.Reader.
+//
+// A Reader verifies the whole pack, including its index and checksum, before
+// Next returns io.EOF.
+type Reader struct {
+	br     *byteReader
+	header Header
+	last   Entry
+	index  []slot
+	seen   map[string]bool
+	sum    []byte
+	err    error // sticky
+}
+
+// NewReader reads the header of a pack from r and returns a Reader for its
+// entries.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := &byteReader{
+		r:   bufio.NewReader(r),
+		crc: crc32.New(crc32cTable),
+		sha: sha3.New512(),
+	}
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{br: br, header: h, seen: make(map[string]bool)}, nil
+}
+
+// Header returns the header of the pack.
+func (pr *Reader) Header() Header {
+	return pr.header
+}
+
+// Next returns the next entry in the pack, or io.EOF once all entries have
+// been read and the pack has been verified.
+func (pr *Reader) Next() (Entry, error) {
+	if pr.err != nil {
+		return Entry{}, pr.err
+	}
+	e, err := pr.next()
+	if err != nil {
+		pr.err = err
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+func (pr *Reader) next() (Entry, error) {
+	offset := pr.br.off
+	n, err := pr.br.readUvarint()
+	if err != nil {
+		return Entry{}, err
+	}
+	if n == 0 {
+		if err := pr.finish(); err != nil {
+			return Entry{}, err
+		}
+		return Entry{}, io.EOF
+	}
+	if n > maxEntryLen {
+		return Entry{}, formatError("entry of %d bytes exceeds %d", n, maxEntryLen)
+	}
+	if len(pr.index) == maxEntries {
+		return Entry{}, formatError("more than %d entries", maxEntries)
+	}
+	b, err := pr.br.readFull(n)
+	if err != nil {
+		return Entry{}, err
+	}
+	e, err := decodeEntry(b)
+	if err != nil {
+		return Entry{}, err
+	}
+	if len(pr.index) > 0 && e.Timestamp.Before(pr.last.Timestamp) {
+		return Entry{}, formatError("entry at %s after %s", e.Timestamp, pr.last.Timestamp)
+	}
+	if pr.seen[string(e.DataSHA3512)] {
+		return Entry{}, formatError("duplicate entry %x", e.DataSHA3512)
+	}
+	pr.seen[string(e.DataSHA3512)] = true
+	pr.index = append(pr.index, slot{
+		hash:     e.DataSHA3512,
+		offset:   offset,
+		position: uint32(len(pr.index)),
+	})
+	pr.last = e
+	return e, nil
+}
+
+// finish reads and verifies the index and trailer of the pack.
+func (pr *Reader) finish() error {
+	br := pr.br
+	indexOffset := br.off
+	sortIndex(pr.index)
+	for _, want := range pr.index {
+		b, err := br.readFull(slotSize)
+		if err != nil {
+			return err
+		}
+		got := decodeSlot(b)
+		if !bytes.Equal(got.hash, want.hash) || got.offset != want.offset || got.position != want.position {
+			return formatError("index does not match entries")
+		}
+	}
+	crc := br.crc.Sum32()
+	br.crc = nil
+	b, err := br.readFull(trailerSize)
+	if err != nil {
+		return err
+	}
+	t, err := decodeTrailer(b)
+	if err != nil {
+		return err
+	}
+	if t.indexOffset != indexOffset || t.entries != uint64(len(pr.index)) {
+		return formatError("trailer does not match entries")
+	}
+	if t.crc != crc {
+		return ErrChecksum
+	}
+	if _, err := br.r.ReadByte(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return formatError("data after trailer")
+	}
+	pr.sum = br.sha.Sum(nil)
+	return nil
+}
+
+// SHA3512 returns the SHA3-512 of the pack, or nil if Next has not yet
+// returned io.EOF.
+func (pr *Reader) SHA3512() []byte {
+	return pr.sum
+}
+
+// File provides random access to the entries of a pack.
+//
+// Open does not verify the checksum of the pack. Use Reader to verify a pack.
+type File struct {
+	r      io.ReaderAt
+	header Header
+	t      trailer
+}
+
+// Open reads the header and trailer of a pack of size bytes from r.
+func Open(r io.ReaderAt, size int64) (*File, error) {
+	if size < trailerSize {
+		return nil, formatError("pack of %d bytes is too small", size)
+	}
+	b := make([]byte, trailerSize)
+	if _, err := r.ReadAt(b, size-trailerSize); err != nil {
+		return nil, unexpected(err)
+	}
+	t, err := decodeTrailer(b)
+	if err != nil {
+		return nil, err
+	}
+	if t.entries > maxEntries || t.indexOffset > uint64(size) || uint64(size)-t.indexOffset != t.entries*slotSize+trailerSize {
+		return nil, formatError("bad trailer")
+	}
+	br := &byteReader{
+		r:   bufio.NewReader(io.NewSectionReader(r, 0, int64(t.indexOffset))),
+		crc: crc32.New(crc32cTable),
+		sha: sha3.New512(),
+	}
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &File{r: r, header: h, t: t}, nil
+}
+
+// Header returns the header of the pack.
+func (f *File) Header() Header {
+	return f.header
+}
+
+// Len returns the number of entries in the pack.
+func (f *File) Len() int {
+	return int(f.t.entries)
+}
+
+func (f *File) slot(i int) (slot, error) {
+	b := make([]byte, slotSize)
+	if _, err := f.r.ReadAt(b, int64(f.t.indexOffset)+int64(i)*slotSize); err != nil {
+		return slot{}, unexpected(err)
+	}
+	return decodeSlot(b), nil
+}
+
+// Lookup returns the entry with dataSHA3512 and its position in the pack, or
+// ErrNotFound.
+func (f *File) Lookup(dataSHA3512 []byte) (Entry, int, error) {
+	// Binary search the index, as sort.Search but with errors.
+	lo, hi := 0, f.Len()
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		s, err := f.slot(mid)
+		if err != nil {
+			return Entry{}, 0, err
+		}
+		switch c := bytes.Compare(s.hash, dataSHA3512); {
+		case c < 0:
+			lo = mid + 1
+		case c > 0:
+			hi = mid
+		default:
+			e, err := f.entryAt(s.offset)
+			if err != nil {
+				return Entry{}, 0, err
+			}
+			if !bytes.Equal(e.DataSHA3512, dataSHA3512) {
+				return Entry{}, 0, formatError("index does not match entry at offset %d", s.offset)
+			}
+			return e, int(s.position), nil
+		}
+	}
+	return Entry{}, 0, ErrNotFound
+}
+
+// entryAt reads the entry at offset.
+func (f *File) entryAt(offset uint64) (Entry, error) {
+	if offset >= f.t.indexOffset {
+		return Entry{}, formatError("entry offset %d beyond entries", offset)
+	}
+	b := make([]byte, binary.MaxVarintLen64+maxEntryLen)
+	if rest := f.t.indexOffset - offset; rest < uint64(len(b)) {
+		b = b[:rest]
+	}
+	n, err := f.r.ReadAt(b, int64(offset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Entry{}, err
+	}
+	b = b[:n]
+	l, k := binary.Uvarint(b)
+	if k <= 0 || l == 0 || l > maxEntryLen || uint64(len(b)-k) < l {
+		return Entry{}, formatError("bad entry at offset %d", offset)
+	}
+	return decodeEntry(b[k : k+int(l)])
+}
@@ -0,0 +1,159 @@
+package pack
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/vsekhar/fabula/pkg/timestamp"
+)
+
+var errClosed = errors.New("pack: writer closed")
+
+// Writer writes a pack to an underlying io.Writer.
+type Writer struct {
+	w   io.Writer
+	crc hash.Hash32
+	sha *sha3.SHA3
+	off uint64
+
+	last  Entry
+	index []slot
+	seen  map[string]bool
+	err   error // sticky
+	sum   []byte
+}
+
+// NewWriter writes the header of a pack to w and returns a Writer to which its
+// entries can be appended.
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if len(h.Prefix) > maxPrefixLen {
+		return nil, fmt.Errorf("pack: prefix longer than %d bytes", maxPrefixLen)
+	}
+	if len(h.PrevSHA3512) != 0 && len(h.PrevSHA3512) != hashSize {
+		return nil, fmt.Errorf("pack: previous pack hash is %d bytes, expected %d", len(h.PrevSHA3512), hashSize)
+	}
+	if len(h.Notarization) > maxNotarizationLen {
+		return nil, fmt.Errorf("pack: notarization longer than %d bytes", maxNotarizationLen)
+	}
+	pw := &Writer{
+		w:    w,
+		crc:  crc32.New(crc32cTable),
+		sha:  sha3.New512(),
+		seen: make(map[string]bool),
+	}
+	pw.write([]byte(magic))
+	pw.writeUvarint(Version)
+	pw.writeBytes([]byte(h.Prefix))
+	pw.writeUvarint(h.SeqNo)
+	pw.writeBytes(h.PrevSHA3512)
+	pw.writeBytes(h.Notarization)
+	if pw.err != nil {
+		return nil, pw.err
+	}
+	return pw, nil
+}
+
+func (pw *Writer) write(b []byte) {
+	if pw.err != nil {
+		return
+	}
+	var n int
+	n, pw.err = pw.w.Write(b)
+	pw.crc.Write(b[:n])
+	pw.sha.Write(b[:n])
+	pw.off += uint64(n)
+}
+
+func (pw *Writer) writeUvarint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	pw.write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+func (pw *Writer) writeBytes(b []byte) {
+	pw.writeUvarint(uint64(len(b)))
+	pw.write(b)
+}
+
+// Append appends e to the pack. Entries must be appended in order of
+// timestamp and have distinct DataSHA3512s.
+func (pw *Writer) Append(e Entry) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if len(e.DataSHA3512) != hashSize {
+		return fmt.Errorf("pack: DataSHA3512 is %d bytes, expected %d", len(e.DataSHA3512), hashSize)
+	}
+	if len(pw.index) > 0 && e.Timestamp.Before(pw.last.Timestamp) {
+		return fmt.Errorf("pack: entry at %s appended after %s", e.Timestamp, pw.last.Timestamp)
+	}
+	if pw.seen[string(e.DataSHA3512)] {
+		return fmt.Errorf("pack: duplicate entry %x", e.DataSHA3512)
+	}
+	if len(pw.index) == maxEntries {
+		return fmt.Errorf("pack: more than %d entries", maxEntries)
+	}
+	pw.index = append(pw.index, slot{
+		hash:     append([]byte(nil), e.DataSHA3512...),
+		offset:   pw.off,
+		position: uint32(len(pw.index)),
+	})
+	pw.seen[string(e.DataSHA3512)] = true
+	pw.last = e
+	pw.writeBytes(encodeEntry(e))
+	return pw.err
+}
+
+func encodeEntry(e Entry) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+hashSize)
+	n := timestamp.ToBytes(buf, e.Timestamp)
+	n += copy(buf[n:], e.DataSHA3512)
+	return buf[:n]
+}
+
+func sortIndex(index []slot) {
+	sort.Slice(index, func(i, j int) bool {
+		return bytes.Compare(index[i].hash, index[j].hash) < 0
+	})
+}
+
+// Close writes the index and trailer of the pack. It does not close the
+// underlying io.Writer.
+func (pw *Writer) Close() error {
+	if pw.err != nil {
+		return pw.err
+	}
+	pw.writeUvarint(0) // end of entries
+	indexOffset := pw.off
+	sortIndex(pw.index)
+	buf := make([]byte, slotSize)
+	for _, s := range pw.index {
+		copy(buf, s.hash)
+		binary.BigEndian.PutUint64(buf[hashSize:], s.offset)
+		binary.BigEndian.PutUint32(buf[hashSize+8:], s.position)
+		pw.write(buf)
+	}
+	trailer := make([]byte, trailerSize)
+	binary.BigEndian.PutUint64(trailer, indexOffset)
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(pw.index)))
+	binary.BigEndian.PutUint32(trailer[16:], pw.crc.Sum32())
+	copy(trailer[20:], magic)
+	pw.write(trailer)
+	if pw.err != nil {
+		return pw.err
+	}
+	pw.sum = pw.sha.Sum(nil)
+	pw.err = errClosed
+	return nil
+}
+
+// SHA3512 returns the SHA3-512 of the pack, or nil if it has not been closed.
+func (pw *Writer) SHA3512() []byte {
+	return pw.sum
+}
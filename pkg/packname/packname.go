@@ -0,0 +1,104 @@
+// Package packname names the objects in which packs and segments of packs are
+// stored.
+//
+// Packs are named
+//
+//	<region>/<prefix>-<seqNo>.pack
+//
+// and segments
+//
+//	<region>/segments/<prefix>-<first seqNo>.segment
+//
+// where sequence numbers are encoded with sortablebase64. Packs are namespaced
+// by region so that each region's Merkle weave can be stored (and later
+// located) independently, and segments are kept apart from packs so that
+// listing the packs of a prefix chain does not list its segments.
+//
+// Sequence numbers are encoded at a fixed width, so the names of the packs of
+// a prefix chain sort in order of sequence number, and the names of packs of
+// other prefix chains do not start with Prefix of the chain. Listing Prefix in
+// order therefore lists the packs of a chain in sequence.
+package packname
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vsekhar/fabula/pkg/sortablebase64"
+)
+
+// ErrInvalid is returned when parsing a name that is not the name of a pack.
+var ErrInvalid = errors.New("packname: invalid pack name")
+
+const (
+	packExt        = ".pack"
+	segmentExt     = ".segment"
+	segmentsFolder = "segments"
+)
+
+// Valid returns an error if packs cannot be named for region and prefix.
+// Region must be non-empty and, like prefix, must not contain '/'. Prefix
+// must not contain '-'.
+func Valid(region, prefix string) error {
+	switch {
+	case region == "" || strings.Contains(region, "/"):
+		return fmt.Errorf("packname: invalid region '%s'", region)
+	case strings.ContainsAny(prefix, "/-"):
+		return fmt.Errorf("packname: invalid prefix '%s'", prefix)
+	}
+	return nil
+}
+
+func mustValid(region, prefix string) {
+	if err := Valid(region, prefix); err != nil {
+		panic(err)
+	}
+}
+
+// Prefix returns the common prefix of the names of the packs of a prefix
+// chain. It panics if region and prefix are not Valid.
+func Prefix(region, prefix string) string {
+	mustValid(region, prefix)
+	return region + "/" + prefix + "-"
+}
+
+// Name returns the name of pack seqNo of a prefix chain. It panics if region
+// and prefix are not Valid.
+func Name(region, prefix string, seqNo uint64) string {
+	return Prefix(region, prefix) + sortablebase64.EncodeUint64(seqNo) + packExt
+}
+
+// Segment returns the name of the segment of a prefix chain starting at pack
+// first. It panics if region and prefix are not Valid.
+func Segment(region, prefix string, first uint64) string {
+	mustValid(region, prefix)
+	return region + "/" + segmentsFolder + "/" + prefix + "-" + sortablebase64.EncodeUint64(first) + segmentExt
+}
+
+// Parse returns the region, prefix and sequence number of the pack named
+// name, or an error wrapping ErrInvalid.
+func Parse(name string) (region, prefix string, seqNo uint64, err error) {
+	invalid := func() (string, string, uint64, error) {
+		return "", "", 0, fmt.Errorf("%w: %s", ErrInvalid, name)
+	}
+	region, rest, ok := strings.Cut(name, "/")
+	if !ok {
+		return invalid()
+	}
+	prefix, rest, ok = strings.Cut(rest, "-")
+	if !ok || Valid(region, prefix) != nil {
+		return invalid()
+	}
+	s := strings.TrimSuffix(rest, packExt)
+	if len(s) == len(rest) {
+		return invalid()
+	}
+	seqNo, err = sortablebase64.DecodeUint64(s)
+	if err != nil || sortablebase64.EncodeUint64(seqNo) != s {
+		// Not every string decodes to the encoding of its value, and names
+		// must be canonical to sort in order.
+		return invalid()
+	}
+	return region, prefix, seqNo, nil
+}
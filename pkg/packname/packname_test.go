@@ -0,0 +1,141 @@
+package packname_test
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vsekhar/fabula/pkg/packname"
+)
+
+func TestName(t *testing.T) {
+	cases := []struct {
+		region, prefix string
+		seqNo          uint64
+		name           string
+	}{
+		{"local", "", 0, "local/-00000000000.pack"},
+		{"local", "a", 42, "local/a-0000000000e.pack"},
+		{"us-east1", "3f", 1<<64 - 1, "us-east1/3f-Ezzzzzzzzzz.pack"},
+	}
+	for _, c := range cases {
+		if n := packname.Name(c.region, c.prefix, c.seqNo); n != c.name {
+			t.Errorf("expected %s, got %s", c.name, n)
+		}
+		if !strings.HasPrefix(c.name, packname.Prefix(c.region, c.prefix)) {
+			t.Errorf("%s does not start with %s", c.name, packname.Prefix(c.region, c.prefix))
+		}
+		region, prefix, seqNo, err := packname.Parse(c.name)
+		if err != nil || region != c.region || prefix != c.prefix || seqNo != c.seqNo {
+			t.Errorf("parsed %s as %s, %s, %d (err: %v)", c.name, region, prefix, seqNo, err)
+		}
+	}
+}
+
+func TestSegment(t *testing.T) {
+	name := packname.Segment("local", "a", 256)
+	if name != "local/segments/a-00000000040.segment" {
+		t.Errorf("bad segment name %s", name)
+	}
+	if strings.HasPrefix(name, packname.Prefix("local", "a")) {
+		t.Errorf("segment %s listed with packs", name)
+	}
+	if _, _, _, err := packname.Parse(name); !errors.Is(err, packname.ErrInvalid) {
+		t.Errorf("parsed segment %s as a pack (err: %v)", name, err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, name := range []string{
+		"",
+		"local",
+		"a-00000000000.pack",
+		"/a-00000000000.pack",
+		"local/a00000000000.pack",
+		"local/a-00000000000",
+		"local/a-0000000000.pack",
+		"local/a-000000000000.pack",
+		"local/a-0000000000!.pack",
+		"local/a-z0000000000.pack", // overflows
+		"local/a/b-00000000000.pack",
+		"local/a-b-00000000000.pack",
+	} {
+		if _, _, _, err := packname.Parse(name); !errors.Is(err, packname.ErrInvalid) {
+			t.Errorf("%q: expected %v, got %v", name, packname.ErrInvalid, err)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, c := range [][2]string{{"", "a"}, {"a/b", "a"}, {"local", "a-b"}, {"local", "a/b"}} {
+		if packname.Valid(c[0], c[1]) == nil {
+			t.Errorf("expected region '%s', prefix '%s' to be invalid", c[0], c[1])
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic naming pack of invalid prefix")
+		}
+	}()
+	packname.Name("local", "a-b", 0)
+}
+
+func TestOrder(t *testing.T) {
+	var seqNos []uint64
+	for i := 0; i < 64; i++ {
+		seqNos = append(seqNos, 1<<i, 1<<i-1, 1<<i+1)
+	}
+	var names []string
+	for _, n := range seqNos {
+		names = append(names, packname.Name("local", "a", n))
+	}
+	sort.Slice(seqNos, func(i, j int) bool { return seqNos[i] < seqNos[j] })
+	sort.Strings(names)
+	for i, name := range names {
+		if _, _, seqNo, err := packname.Parse(name); err != nil || seqNo != seqNos[i] {
+			t.Errorf("name %d is %s, expected seqNo %d", i, name, seqNos[i])
+		}
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("local", "a", uint64(0))
+	f.Add("us-east1", "", uint64(1<<64-1))
+	f.Fuzz(func(t *testing.T, region, prefix string, seqNo uint64) {
+		if packname.Valid(region, prefix) != nil {
+			return
+		}
+		name := packname.Name(region, prefix, seqNo)
+		r, p, s, err := packname.Parse(name)
+		if err != nil || r != region || p != prefix || s != seqNo {
+			t.Fatalf("parsed %s as %s, %s, %d (err: %v)", name, r, p, s, err)
+		}
+	})
+}
+
+func FuzzOrder(f *testing.F) {
+	f.Add(uint64(0), uint64(1))
+	f.Add(uint64(63), uint64(64))
+	f.Fuzz(func(t *testing.T, a, b uint64) {
+		na, nb := packname.Name("local", "a", a), packname.Name("local", "a", b)
+		if (a < b) != (na < nb) || (a == b) != (na == nb) {
+			t.Fatalf("%d, %d named %s, %s", a, b, na, nb)
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add("local/a-0000000000e.pack")
+	f.Add("local/segments/a-00000000040.segment")
+	f.Fuzz(func(t *testing.T, name string) {
+		region, prefix, seqNo, err := packname.Parse(name)
+		if err != nil {
+			return
+		}
+		// Parsed names are canonical.
+		if n := packname.Name(region, prefix, seqNo); n != name {
+			t.Fatalf("parsed %s, which names %s", name, n)
+		}
+	})
+}
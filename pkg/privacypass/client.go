@@ -0,0 +1,59 @@
+package privacypass
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Issue requests n tokens from the issuance endpoint at url and returns the
+// unblinded tokens. The tokens must have been signed by pub.
+//
+// The bearer credential, if not empty, is sent to authorize issuance.
+func Issue(ctx context.Context, client *http.Client, url, bearer string, pub PublicKey, n int) ([]Token, error) {
+	req, err := NewRequest(rand.Reader, n)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(struct {
+		Blinded [][]byte `json:"blinded"`
+	}{req.Blinded()})
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		hreq.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("privacypass: issuance: %s", resp.Status)
+	}
+	signed := new(SignedTokens)
+	if err := json.NewDecoder(resp.Body).Decode(signed); err != nil {
+		return nil, err
+	}
+	return req.Unblind(pub, signed)
+}
+
+// NotarizeBinding returns the binding of a token redeemed to notarize
+// document. Binding the redemption to the document means a redemption that is
+// intercepted cannot be spent on any other document.
+func NotarizeBinding(document []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(notarizeLabel))
+	h.Write(document)
+	return h.Sum(nil)
+}
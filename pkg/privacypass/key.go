@@ -0,0 +1,249 @@
+package privacypass
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned when a token refers to a key that is not in the
+// keyring or has expired.
+var ErrUnknownKey = errors.New("privacypass: unknown or expired key")
+
+// PublicKey is an issuer's public key. Clients use it to verify that tokens
+// were signed with the key the issuer publishes.
+type PublicKey struct {
+	y point
+}
+
+// ParsePublicKey parses a public key produced by PublicKey.Bytes.
+func ParsePublicKey(b []byte) (PublicKey, error) {
+	y, err := unmarshalPoint(b)
+	if err != nil {
+		return PublicKey{}, err
+	}
+	return PublicKey{y: y}, nil
+}
+
+// Bytes returns the compressed encoding of the public key.
+func (pk PublicKey) Bytes() []byte {
+	return pk.y.marshal()
+}
+
+// ID returns a short identifier for the public key.
+func (pk PublicKey) ID() string {
+	h := sha256.Sum256(pk.Bytes())
+	return hex.EncodeToString(h[:8])
+}
+
+// PrivateKey is an issuer's signing key.
+type PrivateKey struct {
+	PublicKey
+	k *big.Int
+}
+
+// GenerateKey returns a new random PrivateKey.
+func GenerateKey(rand io.Reader) (*PrivateKey, error) {
+	k, err := randScalar(rand)
+	if err != nil {
+		return nil, err
+	}
+	return newPrivateKey(k), nil
+}
+
+func newPrivateKey(k *big.Int) *PrivateKey {
+	return &PrivateKey{
+		PublicKey: PublicKey{y: basePoint().mul(k)},
+		k:         k,
+	}
+}
+
+// ParsePrivateKey parses a private key produced by PrivateKey.Bytes.
+func ParsePrivateKey(b []byte) (*PrivateKey, error) {
+	if len(b) != scalarSize() {
+		return nil, fmt.Errorf("privacypass: expected private key of %d bytes, got %d", scalarSize(), len(b))
+	}
+	k := new(big.Int).SetBytes(b)
+	if k.Sign() == 0 || k.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("privacypass: invalid private key")
+	}
+	return newPrivateKey(k), nil
+}
+
+// Bytes returns the encoding of the private key.
+func (k *PrivateKey) Bytes() []byte {
+	return scalarBytes(k.k)
+}
+
+// Public returns the public key corresponding to k.
+func (k *PrivateKey) Public() PublicKey {
+	return k.PublicKey
+}
+
+type keyringEntry struct {
+	key      *PrivateKey
+	notAfter time.Time
+}
+
+// Keyring holds the keys of an issuer.
+//
+// Keys are rotated by adding new keys to the keyring. The most recently added
+// unexpired key is used to issue new tokens. Tokens issued under any unexpired
+// key in the keyring can be redeemed. Keys should remain in the keyring well
+// after they stop being used for issuance so that customers have time to
+// redeem their tokens.
+//
+// It is safe to use a Keyring from multiple goroutines.
+type Keyring struct {
+	mu      sync.RWMutex
+	entries []keyringEntry // ordered by when they were added
+}
+
+// NewKeyring returns a new empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// Add adds k to the keyring. Tokens issued under k can be redeemed until
+// notAfter.
+func (kr *Keyring) Add(k *PrivateKey, notAfter time.Time) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.entries = append(kr.entries, keyringEntry{key: k, notAfter: notAfter})
+}
+
+// Rotate generates a new key valid until notAfter and adds it to the keyring.
+// The new key is used for all subsequent issuance.
+func (kr *Keyring) Rotate(rand io.Reader, notAfter time.Time) (*PrivateKey, error) {
+	k, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	kr.Add(k, notAfter)
+	return k, nil
+}
+
+// Current returns the key to be used for issuing tokens at time now.
+func (kr *Keyring) Current(now time.Time) (*PrivateKey, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for i := len(kr.entries) - 1; i >= 0; i-- {
+		if now.Before(kr.entries[i].notAfter) {
+			return kr.entries[i].key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// Key returns the unexpired key with the provided ID.
+func (kr *Keyring) Key(id string, now time.Time) (*PrivateKey, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, e := range kr.entries {
+		if e.key.ID() == id && now.Before(e.notAfter) {
+			return e.key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// KeyInfo describes a public key in a keyring.
+type KeyInfo struct {
+	ID        string    `json:"id"`
+	PublicKey []byte    `json:"public_key"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// PublicKeys returns information about each unexpired key in the keyring.
+func (kr *Keyring) PublicKeys(now time.Time) []KeyInfo {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	var r []KeyInfo
+	for _, e := range kr.entries {
+		if now.Before(e.notAfter) {
+			r = append(r, KeyInfo{
+				ID:        e.key.ID(),
+				PublicKey: e.key.PublicKey.Bytes(),
+				NotAfter:  e.notAfter,
+			})
+		}
+	}
+	return r
+}
+
+// Prune removes expired keys from the keyring and returns their IDs.
+func (kr *Keyring) Prune(now time.Time) []string {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	var pruned []string
+	j := 0
+	for _, e := range kr.entries {
+		if now.Before(e.notAfter) {
+			kr.entries[j] = e
+			j++
+		} else {
+			pruned = append(pruned, e.key.ID())
+		}
+	}
+	kr.entries = kr.entries[:j]
+	return pruned
+}
+
+// MarshalText encodes the keyring, including private keys, one key per line in
+// the order the keys were added:
+//
+//	<not after, RFC 3339> <hex-encoded private key>
+func (kr *Keyring) MarshalText() ([]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	buf := new(bytes.Buffer)
+	for _, e := range kr.entries {
+		fmt.Fprintf(buf, "%s %s\n", e.notAfter.UTC().Format(time.RFC3339), hex.EncodeToString(e.key.Bytes()))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalText replaces the contents of the keyring with keys encoded by
+// MarshalText. Blank lines and lines starting with '#' are ignored.
+func (kr *Keyring) UnmarshalText(b []byte) error {
+	var entries []keyringEntry
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			return fmt.Errorf("privacypass: keyring line %d: expected 2 fields, got %d", line, len(fields))
+		}
+		notAfter, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil {
+			return fmt.Errorf("privacypass: keyring line %d: %w", line, err)
+		}
+		kb, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("privacypass: keyring line %d: %w", line, err)
+		}
+		k, err := ParsePrivateKey(kb)
+		if err != nil {
+			return fmt.Errorf("privacypass: keyring line %d: %w", line, err)
+		}
+		entries = append(entries, keyringEntry{key: k, notAfter: notAfter})
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	kr.entries = entries
+	kr.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,171 @@
+// Package privacypass implements blinded tokens for access control, following
+// the Privacy Pass protocol.
+//
+// A notary issues tokens to customers (e.g. upon payment) and redeems them when
+// customers submit documents for notarization. Tokens are blinded by the client
+// before being signed by the issuer, so the issuer cannot link a redeemed token
+// to the customer it was issued to.
+//
+// The protocol is a verifiable oblivious pseudorandom function (VOPRF) over
+// P-256:
+//
+//	Client: t random, T = H(t), r random, M = rT           --M-->
+//	Issuer: Z = kM, proof that log_G(kG) == log_M(Z)        <--Z, proof--
+//	Client: verify proof, N = (1/r)Z
+//	Client: MAC = HMAC(K(t, N), binding)                   --t, MAC-->
+//	Issuer: N = kH(t), verify MAC, check t not already spent
+//
+// The proof ensures the issuer signed with its published key, rather than a
+// key unique to the client that could be used to de-anonymize the client at
+// redemption time.
+//
+// See: https://github.com/privacypass/challenge-bypass-extension/blob/master/docs/PROTOCOL.md
+package privacypass
+
+import (
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+const (
+	hashToCurveLabel = "fabula-privacypass-h2c"
+	dleqLabel        = "fabula-privacypass-dleq"
+	deriveKeyLabel   = "fabula-privacypass-derive-key"
+	notarizeLabel    = "fabula-privacypass-notarize"
+)
+
+var curve = elliptic.P256()
+
+var errBadPoint = errors.New("privacypass: invalid point")
+
+type point struct {
+	x, y *big.Int
+}
+
+func basePoint() point {
+	p := curve.Params()
+	return point{p.Gx, p.Gy}
+}
+
+func (p point) marshal() []byte {
+	return elliptic.MarshalCompressed(curve, p.x, p.y)
+}
+
+func unmarshalPoint(b []byte) (point, error) {
+	x, y := elliptic.UnmarshalCompressed(curve, b)
+	if x == nil {
+		return point{}, errBadPoint
+	}
+	return point{x, y}, nil
+}
+
+func (p point) mul(k *big.Int) point {
+	x, y := curve.ScalarMult(p.x, p.y, k.Bytes())
+	return point{x, y}
+}
+
+func (p point) add(q point) point {
+	x, y := curve.Add(p.x, p.y, q.x, q.y)
+	return point{x, y}
+}
+
+// hashToCurve deterministically maps t to a point on the curve using the
+// try-and-increment method.
+func hashToCurve(t []byte) (point, error) {
+	params := curve.Params()
+	three := big.NewInt(3)
+	for ctr := 0; ctr < 256; ctr++ {
+		h := sha256.New()
+		h.Write([]byte(hashToCurveLabel))
+		h.Write([]byte{byte(ctr)})
+		h.Write(t)
+		x := new(big.Int).SetBytes(h.Sum(nil))
+		x.Mod(x, params.P)
+
+		// y² = x³ - 3x + b
+		y2 := new(big.Int).Exp(x, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(x, three))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+		y := new(big.Int).ModSqrt(y2, params.P)
+		if y == nil {
+			continue
+		}
+		if y.Bit(0) == 1 {
+			y.Sub(params.P, y)
+		}
+		if !curve.IsOnCurve(x, y) {
+			continue
+		}
+		return point{x, y}, nil
+	}
+	return point{}, fmt.Errorf("privacypass: could not hash to curve")
+}
+
+// randScalar returns a random non-zero scalar.
+func randScalar(rand io.Reader) (*big.Int, error) {
+	nMinusOne := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+	for {
+		b := make([]byte, (curve.Params().BitSize+7)/8)
+		if _, err := io.ReadFull(rand, b); err != nil {
+			return nil, err
+		}
+		k := new(big.Int).SetBytes(b)
+		if k.Cmp(nMinusOne) < 0 {
+			return k.Add(k, big.NewInt(1)), nil
+		}
+	}
+}
+
+// dleqChallenge computes the challenge for a proof that log_G(Y) == log_M(Z).
+func dleqChallenge(y, m, z, a, b point) *big.Int {
+	h := sha256.New()
+	h.Write([]byte(dleqLabel))
+	for _, p := range []point{basePoint(), y, m, z, a, b} {
+		h.Write(p.marshal())
+	}
+	c := new(big.Int).SetBytes(h.Sum(nil))
+	return c.Mod(c, curve.Params().N)
+}
+
+// proveDLEQ proves that Z = kM for the key k with public key Y = kG, without
+// revealing k.
+func proveDLEQ(rand io.Reader, k *big.Int, y, m, z point) ([]byte, error) {
+	s, err := randScalar(rand)
+	if err != nil {
+		return nil, err
+	}
+	a := basePoint().mul(s)
+	b := m.mul(s)
+	c := dleqChallenge(y, m, z, a, b)
+	n := curve.Params().N
+	u := new(big.Int).Mul(c, k)
+	u.Sub(s, u)
+	u.Mod(u, n)
+	return append(scalarBytes(c), scalarBytes(u)...), nil
+}
+
+func verifyDLEQ(proof []byte, y, m, z point) bool {
+	size := scalarSize()
+	if len(proof) != 2*size {
+		return false
+	}
+	c := new(big.Int).SetBytes(proof[:size])
+	u := new(big.Int).SetBytes(proof[size:])
+	a := basePoint().mul(u).add(y.mul(c))
+	b := m.mul(u).add(z.mul(c))
+	return dleqChallenge(y, m, z, a, b).Cmp(c) == 0
+}
+
+func scalarSize() int {
+	return (curve.Params().BitSize + 7) / 8
+}
+
+func scalarBytes(k *big.Int) []byte {
+	b := make([]byte, scalarSize())
+	return k.FillBytes(b)
+}
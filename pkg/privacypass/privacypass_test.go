@@ -0,0 +1,224 @@
+package privacypass_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vsekhar/fabula/pkg/privacypass"
+)
+
+var now = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func issue(t *testing.T, kr *privacypass.Keyring, n int) []privacypass.Token {
+	key, err := kr.Current(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := privacypass.NewRequest(rand.Reader, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := key.Sign(rand.Reader, req.Blinded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := req.Unblind(key.Public(), signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != n {
+		t.Fatalf("expected %d tokens, got %d", n, len(tokens))
+	}
+	return tokens
+}
+
+func TestIssueAndRedeem(t *testing.T) {
+	ctx := context.Background()
+	kr := privacypass.NewKeyring()
+	if _, err := kr.Rotate(rand.Reader, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	spent := privacypass.NewMemorySpentStore()
+	binding := privacypass.NotarizeBinding([]byte("document"))
+
+	tokens := issue(t, kr, 3)
+	for _, tok := range tokens {
+		r, err := privacypass.ParseRedemption(tok.Redeem(binding).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Verifying does not spend the token.
+		for i := 0; i < 2; i++ {
+			if err := kr.Verify(r, binding, now); err != nil {
+				t.Errorf("verify: %v", err)
+			}
+		}
+		if err := kr.Redeem(ctx, spent, r, binding, now); err != nil {
+			t.Errorf("redeem: %v", err)
+		}
+		if err := kr.Redeem(ctx, spent, r, binding, now); !errors.Is(err, privacypass.ErrDoubleSpend) {
+			t.Errorf("expected double spend, got %v", err)
+		}
+	}
+}
+
+func TestBadRedemption(t *testing.T) {
+	ctx := context.Background()
+	kr := privacypass.NewKeyring()
+	if _, err := kr.Rotate(rand.Reader, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	spent := privacypass.NewMemorySpentStore()
+	tok := issue(t, kr, 1)[0]
+
+	// Wrong binding
+	r := tok.Redeem([]byte("a"))
+	if err := kr.Redeem(ctx, spent, r, []byte("b"), now); !errors.Is(err, privacypass.ErrBadToken) {
+		t.Errorf("expected bad token, got %v", err)
+	}
+
+	// Redemption for another document
+	doc := tok.Redeem(privacypass.NotarizeBinding([]byte("a")))
+	if err := kr.Redeem(ctx, spent, doc, privacypass.NotarizeBinding([]byte("b")), now); !errors.Is(err, privacypass.ErrBadToken) {
+		t.Errorf("expected bad token, got %v", err)
+	}
+
+	if err := kr.Verify(doc, privacypass.NotarizeBinding([]byte("b")), now); !errors.Is(err, privacypass.ErrBadToken) {
+		t.Errorf("expected bad token, got %v", err)
+	}
+
+	// Forged N
+	forged := tok
+	forged.N = issue(t, kr, 1)[0].N
+	if err := kr.Redeem(ctx, spent, forged.Redeem([]byte("a")), []byte("a"), now); !errors.Is(err, privacypass.ErrBadToken) {
+		t.Errorf("expected bad token, got %v", err)
+	}
+
+	// Failed redemptions must not spend the token
+	if err := kr.Redeem(ctx, spent, r, []byte("a"), now); err != nil {
+		t.Errorf("redeem: %v", err)
+	}
+
+	if _, err := privacypass.ParseRedemption("garbage"); !errors.Is(err, privacypass.ErrBadToken) {
+		t.Errorf("expected bad token, got %v", err)
+	}
+}
+
+func TestUnblindWrongKey(t *testing.T) {
+	kr := privacypass.NewKeyring()
+	key, err := kr.Rotate(rand.Reader, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := privacypass.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := privacypass.NewRequest(rand.Reader, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Issuer signs with a key other than the one it publishes.
+	signed, err := other.Sign(rand.Reader, req.Blinded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed.KeyID = key.ID()
+	if _, err := req.Unblind(key.Public(), signed); err == nil {
+		t.Error("expected error unblinding tokens signed with unpublished key")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	ctx := context.Background()
+	kr := privacypass.NewKeyring()
+	k1, err := kr.Rotate(rand.Reader, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := issue(t, kr, 1)[0]
+	k2, err := kr.Rotate(rand.Reader, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur, _ := kr.Current(now); cur.ID() != k2.ID() {
+		t.Errorf("expected current key %s, got %s", k2.ID(), cur.ID())
+	}
+
+	// Tokens from the previous key are still redeemable.
+	spent := privacypass.NewMemorySpentStore()
+	if err := kr.Redeem(ctx, spent, old.Redeem(nil), nil, now); err != nil {
+		t.Errorf("redeem: %v", err)
+	}
+
+	// Until the previous key expires.
+	later := now.Add(90 * time.Minute)
+	old2 := old
+	old2.T = append([]byte{}, old.T...)
+	old2.T[0]++
+	if err := kr.Redeem(ctx, spent, old2.Redeem(nil), nil, later); !errors.Is(err, privacypass.ErrUnknownKey) {
+		t.Errorf("expected unknown key, got %v", err)
+	}
+	if pruned := kr.Prune(later); len(pruned) != 1 || pruned[0] != k1.ID() {
+		t.Errorf("expected %s to be pruned, got %v", k1.ID(), pruned)
+	}
+
+	// Round trip
+	b, err := kr.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr2 := privacypass.NewKeyring()
+	if err := kr2.UnmarshalText(b); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _ := kr2.Current(now); cur.ID() != k2.ID() {
+		t.Errorf("expected current key %s, got %s", k2.ID(), cur.ID())
+	}
+}
+
+func TestIssueHTTP(t *testing.T) {
+	kr := privacypass.NewKeyring()
+	key, err := kr.Rotate(rand.Reader, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := struct{ Blinded [][]byte }{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		signed, err := key.Sign(rand.Reader, req.Blinded)
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(signed)
+	}))
+	defer svr.Close()
+
+	ctx := context.Background()
+	tokens, err := privacypass.Issue(ctx, svr.Client(), svr.URL, "secret", key.Public(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := privacypass.NewMemorySpentStore()
+	for _, tok := range tokens {
+		if err := kr.Redeem(ctx, spent, tok.Redeem(nil), nil, now); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := privacypass.Issue(ctx, svr.Client(), svr.URL, "wrong", key.Public(), 1); err == nil {
+		t.Error("expected unauthorized issuance to fail")
+	}
+}
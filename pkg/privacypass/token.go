@@ -0,0 +1,278 @@
+package privacypass
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenSize is the number of random bytes in each token.
+const tokenSize = 32
+
+// ErrDoubleSpend is returned when a token is redeemed more than once.
+var ErrDoubleSpend = errors.New("privacypass: token already spent")
+
+// ErrBadToken is returned when a redemption is invalid.
+var ErrBadToken = errors.New("privacypass: invalid token")
+
+// SignedTokens is an issuer's response to a request for tokens.
+type SignedTokens struct {
+	KeyID  string   `json:"key_id"`
+	Signed [][]byte `json:"signed"`
+	Proofs [][]byte `json:"proofs"`
+}
+
+// Sign signs blinded tokens produced by a client using Request.Blinded.
+//
+// The issuer cannot learn the tokens that will later be redeemed from the
+// blinded tokens it signs.
+func (k *PrivateKey) Sign(rand io.Reader, blinded [][]byte) (*SignedTokens, error) {
+	r := &SignedTokens{
+		KeyID:  k.ID(),
+		Signed: make([][]byte, len(blinded)),
+		Proofs: make([][]byte, len(blinded)),
+	}
+	for i, b := range blinded {
+		m, err := unmarshalPoint(b)
+		if err != nil {
+			return nil, fmt.Errorf("privacypass: blinded token %d: %w", i, err)
+		}
+		z := m.mul(k.k)
+		proof, err := proveDLEQ(rand, k.k, k.y, m, z)
+		if err != nil {
+			return nil, err
+		}
+		r.Signed[i] = z.marshal()
+		r.Proofs[i] = proof
+	}
+	return r, nil
+}
+
+type blindToken struct {
+	t []byte
+	r *big.Int
+	m point
+}
+
+// Request is a client's request for tokens. Its blinded tokens are sent to the
+// issuer and the issuer's response is unblinded to obtain tokens.
+type Request struct {
+	tokens []blindToken
+}
+
+// NewRequest returns a request for n tokens.
+func NewRequest(rand io.Reader, n int) (*Request, error) {
+	r := &Request{tokens: make([]blindToken, n)}
+	for i := range r.tokens {
+		t := make([]byte, tokenSize)
+		if _, err := io.ReadFull(rand, t); err != nil {
+			return nil, err
+		}
+		p, err := hashToCurve(t)
+		if err != nil {
+			return nil, err
+		}
+		blind, err := randScalar(rand)
+		if err != nil {
+			return nil, err
+		}
+		r.tokens[i] = blindToken{t: t, r: blind, m: p.mul(blind)}
+	}
+	return r, nil
+}
+
+// Blinded returns the blinded tokens to be sent to the issuer.
+func (r *Request) Blinded() [][]byte {
+	b := make([][]byte, len(r.tokens))
+	for i, t := range r.tokens {
+		b[i] = t.m.marshal()
+	}
+	return b
+}
+
+// Unblind verifies the issuer's response s against the issuer's published key
+// pub and returns the resulting tokens.
+func (r *Request) Unblind(pub PublicKey, s *SignedTokens) ([]Token, error) {
+	if s.KeyID != pub.ID() {
+		return nil, fmt.Errorf("privacypass: tokens signed with key %s, expected %s", s.KeyID, pub.ID())
+	}
+	if len(s.Signed) != len(r.tokens) || len(s.Proofs) != len(r.tokens) {
+		return nil, fmt.Errorf("privacypass: expected %d signed tokens, got %d", len(r.tokens), len(s.Signed))
+	}
+	n := curve.Params().N
+	tokens := make([]Token, len(r.tokens))
+	for i, bt := range r.tokens {
+		z, err := unmarshalPoint(s.Signed[i])
+		if err != nil {
+			return nil, fmt.Errorf("privacypass: signed token %d: %w", i, err)
+		}
+		if !verifyDLEQ(s.Proofs[i], pub.y, bt.m, z) {
+			return nil, fmt.Errorf("privacypass: signed token %d: bad proof", i)
+		}
+		rInv := new(big.Int).ModInverse(bt.r, n)
+		tokens[i] = Token{
+			KeyID: s.KeyID,
+			T:     bt.t,
+			N:     z.mul(rInv).marshal(),
+		}
+	}
+	return tokens, nil
+}
+
+// Token is an unblinded signed token held by a client. Each token can be
+// redeemed once.
+type Token struct {
+	KeyID string
+	T     []byte
+	N     []byte
+}
+
+func deriveKey(t, n []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(deriveKeyLabel))
+	h.Write(t)
+	h.Write(n)
+	return h.Sum(nil)
+}
+
+// Redeem returns a redemption of the token bound to binding, which should
+// identify the request the token is being redeemed for.
+func (t Token) Redeem(binding []byte) Redemption {
+	mac := hmac.New(sha256.New, deriveKey(t.T, t.N))
+	mac.Write(binding)
+	return Redemption{
+		KeyID: t.KeyID,
+		T:     t.T,
+		MAC:   mac.Sum(nil),
+	}
+}
+
+// Redemption is sent by a client to the issuer to redeem a token.
+type Redemption struct {
+	KeyID string
+	T     []byte
+	MAC   []byte
+}
+
+const redemptionSeparator = "."
+
+// String encodes the redemption for use in an HTTP header or gRPC metadata.
+func (r Redemption) String() string {
+	return strings.Join([]string{
+		r.KeyID,
+		base64.RawURLEncoding.EncodeToString(r.T),
+		base64.RawURLEncoding.EncodeToString(r.MAC),
+	}, redemptionSeparator)
+}
+
+// ParseRedemption parses a redemption encoded by Redemption.String.
+func ParseRedemption(s string) (Redemption, error) {
+	parts := strings.Split(s, redemptionSeparator)
+	if len(parts) != 3 {
+		return Redemption{}, ErrBadToken
+	}
+	t, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(t) != tokenSize {
+		return Redemption{}, ErrBadToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Redemption{}, ErrBadToken
+	}
+	return Redemption{KeyID: parts[0], T: t, MAC: mac}, nil
+}
+
+// SpentStore records tokens that have been redeemed.
+type SpentStore interface {
+	// Spend records that token t issued under key keyID has been spent. Spend
+	// returns ErrDoubleSpend if t has already been spent.
+	Spend(ctx context.Context, keyID string, t []byte) error
+}
+
+// Redeem verifies a redemption r bound to binding using the keys in the
+// keyring and records the token as spent in s.
+//
+// Redeem returns ErrUnknownKey if the token was issued under a key not in the
+// keyring, ErrBadToken if the redemption is invalid, and ErrDoubleSpend if the
+// token has already been spent.
+func (kr *Keyring) Redeem(ctx context.Context, s SpentStore, r Redemption, binding []byte, now time.Time) error {
+	if err := kr.Verify(r, binding, now); err != nil {
+		return err
+	}
+	// Only spend tokens for valid redemptions, otherwise anyone could burn
+	// another customer's token by guessing or observing its T.
+	return s.Spend(ctx, r.KeyID, r.T)
+}
+
+// Verify verifies a redemption r bound to binding using the keys in the
+// keyring without spending the token. Callers that only want to charge for
+// requests that succeed can Verify a redemption before handling the request
+// and Spend its token afterwards.
+//
+// Verify returns ErrUnknownKey if the token was issued under a key not in the
+// keyring and ErrBadToken if the redemption is invalid.
+func (kr *Keyring) Verify(r Redemption, binding []byte, now time.Time) error {
+	k, err := kr.Key(r.KeyID, now)
+	if err != nil {
+		return err
+	}
+	if len(r.T) != tokenSize {
+		return ErrBadToken
+	}
+	p, err := hashToCurve(r.T)
+	if err != nil {
+		return ErrBadToken
+	}
+	expected := Token{KeyID: r.KeyID, T: r.T, N: p.mul(k.k).marshal()}.Redeem(binding)
+	if !hmac.Equal(expected.MAC, r.MAC) {
+		return ErrBadToken
+	}
+	return nil
+}
+
+// MemorySpentStore is a SpentStore held in memory. It is suitable for a single
+// issuer process.
+//
+// It is safe to use a MemorySpentStore from multiple goroutines.
+type MemorySpentStore struct {
+	mu    sync.Mutex
+	spent map[string]map[string]struct{} // map[keyID]map[string(t)]
+}
+
+// NewMemorySpentStore returns a new empty MemorySpentStore.
+func NewMemorySpentStore() *MemorySpentStore {
+	return &MemorySpentStore{spent: make(map[string]map[string]struct{})}
+}
+
+// Spend implements SpentStore.
+func (m *MemorySpentStore) Spend(_ context.Context, keyID string, t []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts, ok := m.spent[keyID]
+	if !ok {
+		ts = make(map[string]struct{})
+		m.spent[keyID] = ts
+	}
+	if _, ok := ts[string(t)]; ok {
+		return ErrDoubleSpend
+	}
+	ts[string(t)] = struct{}{}
+	return nil
+}
+
+// Forget drops records of tokens spent under keyID. Forget should only be
+// called once keyID has been removed from the keyring (e.g. by Prune), after
+// which its tokens can no longer be redeemed anyway.
+func (m *MemorySpentStore) Forget(keyID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.spent, keyID)
+}